@@ -1,129 +1,221 @@
 package main
 
 import (
-	"bufio"       //entrée sortie
-	"fmt"         //print
-	"image"       //image
-	"image/color" //couleur des pixels
-	"log"         //trace
-	"net"         //socket
+	"context"       //surveillance de la configuration
+	"encoding/json" //resultat de la detection envoyé par le serveur
+	"errors"        //erreurs de la connexion
+	"fmt"           //print
+	"image"         //image
+	"image/color"   //couleur des pixels
+	"io"            //lecture complete de la socket
+	"log/slog"      //trace
+	"net"           //socket
 	"os"
 	"strconv" //conversion avec des string
 	"strings"
+	"sync" //connexion partagée entre les cameras
+	"time"
 
 	"gocv.io/x/gocv" //librairie gocv
 )
 
 //variables globales et constantes
 
-var touche string = ""
+var connexionPrincipale sync.Mutex //la connexion principale est partagée par les screenshots et les detections de toutes les cameras
+var sourceDeclaree = -1            //camera annoncée au serveur sur la connexion principale, protegée par connexionPrincipale
 
 const PORT = "27001" //port choisi aléatoirement
-const BUFFERSIZE = 1024
-
-func camera(no_device int, connection net.Conn) {
+const ADRESSE_SERVEUR = "localhost:" + PORT
+const BUFFERSIZE = 1024             //buffer_size par defaut de la configuration
+const FIN_CONNEXION = "FIN"         //message envoyé au serveur a la place de la taille d'une image pour annoncer la deconnexion
+const COMMANDE_DETECTION = "DETECT" //envoyé avant l'image pour ne recevoir que les rectangles des visages
+const COMMANDE_SOURCE = "SOURCE"    //donne au serveur le nom de la camera, repris dans ses sidecars
+
+// commandes : mode et demandes de l'operateur, les touches de la fenetre y sont ajoutées
+func camera(no_device int, commandes *Commandes, connection net.Conn) {
 	//fmt.Println("start device ", no_device)
-	var newmat gocv.Mat //declaration ici car pb de compilation si déclarée dans un if
+	logger := slog.With("camera", no_device)
 
-	webcam, err := gocv.VideoCaptureDevice(no_device) //premier acces a la camera
+	webcam, err := OuvrirPeripherique(no_device, ConfigActuelle().Capture) //premier acces a la camera, avec la resolution et les fps demandés
 	if err != nil {
-		fmt.Println("Ne peut pas initialiser la camera : ", err)
+		logger.Error("ne peut pas initialiser la camera", "erreur", err)
 		return
 	}
 	defer webcam.Close() //ferme quand plus utilisé
-
-	img := gocv.NewMat() // creer une matrice d'image
-	defer img.Close()
+	peripherique := Caracteristiques(no_device, webcam)
+	logger.Info("camera ouverte", "largeur", peripherique.Largeur, "hauteur", peripherique.Hauteur, "fps", peripherique.Fps, "backend", peripherique.Backend)
 
 	title := "Floutage visages camera n° :" + strconv.Itoa(no_device) //on conv no_device (int) en str pour faire +
 	window := gocv.NewWindow(title)                                   //creer la fenetre graphique avec titre
 	defer window.Close()
 
-	// charger le classifieur pour reconnaitre qqch à partir de gocv
-	classifier := gocv.NewCascadeClassifier()
-	defer classifier.Close()
-
-	//charger un modele de reconnaissance (ici visage frontal)
-	if !classifier.Load("C:\\opencv\\haar-cascade-files-master\\haarcascade_frontalface_default.xml") {
-		log.Fatal("Erreur chargement du fichier: data/haarcascade_frontalface_default.xml")
+	pipeline, err := NouveauPipeline(ConfigActuelle().Pipeline, no_device) //etapes du floutage local
+	if err != nil {
+		logger.Error("ne peut pas construire le pipeline", "erreur", err)
+		return
 	}
 
-	fmt.Println("Demarrage lecture camera n°: ", no_device)
-
-	for { //boucle infinie pour lire et traiter chaque image de la camera
-		if ok := webcam.Read(&img); !ok { //lire une image de la camera et affecte cette image dans la matrice img (référencée par son adresse)
-			log.Fatal("ne peut pas lire camera n° :", no_device)
+	flux := diffusion.Ajouter(no_device) //diffusion mjpeg de la camera floutée
+	defer diffusion.Retirer(no_device)
+	segment := sidecars.NouveauSegment("camera " + strconv.Itoa(no_device)) //trace des images diffusées
+	defer segment.Fermer()
+
+	aTraiter := make(chan Image, TAILLE_FILE)
+	aAfficher := make(chan ImageTraitee, TAILLE_FILE)
+	mesureTraitement := NouvelleMesure("processing", no_device)
+	mesureAffichage := NouvelleMesure("display", no_device)
+	debogage := NouvelleSuperposition(no_device)
+
+	logger.Info("demarrage lecture camera")
+	go capturer(no_device, webcam, aTraiter, mesureTraitement, logger)
+	go traitement(no_device, commandes, connection, pipeline, flux, aTraiter, aAfficher, mesureTraitement, mesureAffichage, logger)
+
+	// affichage et diffusion dans cette go routine, qui a créé la fenetre
+	// la boucle se termine quand la capture s'arrete et que le traitement a vidé sa file
+	for img := range aAfficher {
+		debogage.Mesurer()
+		publiee := img.Diffusee //on ne diffuse jamais l'image non floutée
+		if img.Floutee && flux.Spectateurs() > 0 {
+			publiee = &img.Mat
+			if superposition.Load() { //la superposition de la fenetre montre les noms de la liste blanche, la diffusion a sa copie
+				copie := img.Mat.Clone()
+				img.Diffusee, publiee = &copie, &copie
+			}
 		}
-
-		if touche == "c\r\n" { //on active l'option floutage de la vidéo uniquement avec la touche 'c'
-			newmat = DetectionVisageFloutage(img, classifier) //fonction qui detecte les visages, convertit l'image, la floute , la reconvertit
-		} else {
-			newmat = img //image non floutée
+		if publiee != nil {
+			debogage.Dessiner(publiee, img.Detections, true)
 		}
-
-		if no_device == 0 && touche == "s\r\n" { //screenshot uniquement sur device 0
-			touche = "" //on reinitialise la valeur de touche pour ne faire qu'une fois le screenshot (et non pas toutes les 100ms)
-			screenshotclient(img, connection)
+		if publiee != nil && flux.Spectateurs() > 0 { //publiée avant la superposition de la fenetre, qui peut etre dessinée sur la meme image
+			if jpg := flux.Publier(*publiee); jpg != nil {
+				if err := segment.Ajouter(NouveauSidecarImage(img, jpg)); err != nil {
+					logger.Error("erreur d'ecriture du sidecar", "erreur", err)
+				}
+			}
 		}
 
-		// afficher la fenetre contenant la matrice et attendre 100 ms
-		window.IMShow(newmat)
-		window.WaitKey(100)
+		debogage.Dessiner(&img.Mat, img.Detections, false) //la fenetre est celle de l'operateur, meme si l'image n'est pas floutée
+		window.IMShow(img.Mat)
+		mesureAffichage.Traitee(img.Image)
+		img.Fermer()
+		// attendre frame_delay, ne ralentit que l'affichage : la capture et le traitement continuent a leur rythme
+		commandes.Touche(window.WaitKey(int(ConfigActuelle().AttenteTouche.Duration().Milliseconds())), no_device)
 	}
 }
 
-//fonction qui detecte les visages, convertit l'image, la floute , la reconvertit
-func DetectionVisageFloutage(img gocv.Mat, classifier gocv.CascadeClassifier) gocv.Mat {
-	Img_modifiable, err := img.ToImage() // image.ToImage est la fonction qui convertie une matrice gocv.Mat en une image.image (modifiable)
-	if err != nil {
-		log.Fatal("erreur conversion matricegocv en image.image ", err)
-	}
+// etape de traitement du pipeline d'une camera : floutage local par les etapes du pipeline ou par le serveur selon le mode,
+// screenshot et detection par le serveur, floutage de l'image diffusée
+// le pipeline est reconstruit quand la liste de ses etapes change dans la configuration
+func traitement(no_device int, commandes *Commandes, connection net.Conn, pipeline *Pipeline, flux *FluxMjpeg,
+	entree chan Image, sortie chan ImageTraitee, mesure *MesureEtape, suivante *MesureEtape, logger *slog.Logger) {
+	defer close(sortie)
+	defer func() {
+		pipeline.Fermer()
+	}()
+
+	var session *SessionFlux //floutage en continu par le serveur (touche 'f')
+	var err error
+	sessionImpossible := false   //evite de retenter a chaque image si le serveur est injoignable
+	img_serveur := gocv.NewMat() //derniere image floutée par le serveur
+	defer img_serveur.Close()
+	defer func() {
+		if session != nil {
+			session.Fermer()
+		}
+	}()
+
+	for img := range entree { //une image par tour, les images arrivées pendant le traitement sont remplacées par la plus recente
+		imagesTraitees.Ajouter(strconv.Itoa(no_device), 1)
+		config := ConfigActuelle() //relue a chaque image pour suivre les rechargements
+		if !pipeline.Meme(config.Pipeline) {
+			if nouveau, err := NouveauPipeline(config.Pipeline, no_device); err != nil {
+				logger.Error("nouveau pipeline refusé, le precedent reste en place", "etapes", config.Pipeline, "erreur", err)
+				erreurs.Ajouter("pipeline", 1)
+				pipeline.noms = config.Pipeline //pas de nouvel essai avant le prochain changement
+			} else {
+				pipeline.Fermer()
+				pipeline = nouveau
+				logger.Info("pipeline reconstruit", "etapes", config.Pipeline)
+			}
+		}
 
-	Img_RGBA, ok := Img_modifiable.(*image.RGBA) //On passe finalImg en image de type RGBA qui est un sous type de image.image
-	if !ok {
-		log.Fatal("Image pas de type rgba, et donc non modifiable")
-	}
+		mode := commandes.Mode()
+		if mode == MODE_SERVEUR && session == nil && !sessionImpossible { //on confie le floutage au serveur avec la touche 'f'
+			session, err = OuvrirSessionFlux(config.AdresseServeur, "camera "+strconv.Itoa(no_device), logger)
+			if err != nil {
+				logger.Error("session de flux impossible", "erreur", err)
+				erreurs.Ajouter("session_flux", 1)
+				session, sessionImpossible = nil, true
+			}
+		}
+		if session != nil && (mode != MODE_SERVEUR || session.Terminee()) {
+			session.Fermer()
+			session = nil
+		}
+		if mode != MODE_SERVEUR {
+			sessionImpossible = false
+		}
 
-	// detection visages qui sont retournés dans une liste de rectangles
-	rects := classifier.DetectMultiScale(img)
+		sortie_img := ImageTraitee{Image: img}         //par defaut l'image non floutée
+		if sidecars != nil && flux.Spectateurs() > 0 { //avant le floutage : l'image capturée est fermée quand une image floutée la remplace
+			sortie_img.EmpreinteEntree = empreinte(img.Mat.ToBytes())
+		}
+		if session != nil {
+			session.Soumettre(img.Mat)
+			if session.DerniereImage(&img_serveur) { //sinon aucune image floutée n'est encore revenue du serveur
+				sortie_img.Mat = img_serveur.Clone()
+				sortie_img.Floutee, sortie_img.Serveur = true, true
+			}
+		}
 
-	// pour chaque rectangle (visage)
-	for _, rect := range rects { // _ recupere l'indice dont on n'a pas besoin et rect recupere l'elmt de la liste
-		go blurMaison(Img_RGBA, rect) //on crée une goroutine sans attendre sa fin pour flouter l'interieur d'un rectangle dans Img_RGBA
-		//gocv.GaussianBlur(imgFace, &imgFace, image.Pt(75, 75), 0, 0, gocv.BorderDefault) on aurait pu utiliser cette fonction de flouttage
-	}
+		switch commandes.Ponctuelle(no_device) { //une seule fois par demande, et non pas a chaque image
+		case 's':
+			demandeServeur(no_device, connection, logger, func() { screenshotclient(img.Mat, no_device, connection, logger) })
+		case 'd':
+			demandeServeur(no_device, connection, logger, func() { detectionclient(img.Mat, connection, logger) })
+		}
 
-	newmat, err := NewMatRGB8FromImage(Img_RGBA) //fonction qui convertit image RGBA en matrice gocv
-	if err != nil {
-		log.Fatal(err)
-	}
-	return newmat
+		//floutage local avec la touche 'c', ou pour la diffusion car on ne diffuse jamais l'image non floutée
+		if !sortie_img.Floutee && (mode == MODE_LOCAL || flux.Spectateurs() > 0) {
+			if img_floutee, detections, ok := FloutageLocal(pipeline, img, logger); !ok {
+				//fail_open sans image anonymisée : l'image non floutée reste affichée mais n'est pas diffusée
+			} else if mode == MODE_LOCAL {
+				sortie_img.Mat = img_floutee
+				sortie_img.Floutee = true
+				sortie_img.Detections = detections
+			} else {
+				sortie_img.Diffusee = &img_floutee
+				sortie_img.Detections = detections
+			}
+		}
+		if sortie_img.Floutee {
+			img.Fermer() //l'image non floutée n'est plus utilisée, sinon elle passe a l'affichage
+		}
 
+		mesure.Traitee(img)
+		deposer(sortie, sortie_img, suivante)
+	}
 }
 
-// flouter l'interieur d'un rectangle dans Img_RGBA
-// on divise le rectangle en carrés de 64 x 64 bits
-// on calcule la moyenne de chaque couleurs d'un carré et on affecte cette couleur a tout le carré
-func blurMaison(imageInOut *image.RGBA, rectangle image.Rectangle) { //on retourne la meme image qu'en entrée mais modifiée
-
-	TAILLE_CARRE := 64 //on fait des carrés de ce nombre de pixels
-	SURFACE_CARRE := uint32(TAILLE_CARRE * TAILLE_CARRE)
+func blurMaison(imageInOut *image.RGBA, rectangle image.Rectangle, TAILLE_CARRE int) { //on retourne la meme image qu'en entrée mais modifiée
 
-	bounds := rectangle.Bounds() //on recupere les contours du rectangle
-	min := bounds.Min            // point min, en haut a gauche
-	max := bounds.Max            // point max, en bas a droite
+	bounds := rectangle.Intersect(imageInOut.Bounds()) //on recupere les contours du rectangle, sans deborder de l'image
+	min := bounds.Min                                  // point min, en haut a gauche
+	max := bounds.Max                                  // point max, en bas a droite
 
 	for y := min.Y; y < max.Y; y += TAILLE_CARRE { //on boucle sur chaque carré en y et en x
 		for x := min.X; x < max.X; x += TAILLE_CARRE {
+			carre := image.Rect(x, y, x+TAILLE_CARRE, y+TAILLE_CARRE).Intersect(bounds) //les carrés du bord sont coupés
+			SURFACE_CARRE := uint32(carre.Dx() * carre.Dy())
+
 			//a chaque nouveau carré initialisation des totaux rgba en 32bits
 			rtot := uint32(0)
 			gtot := uint32(0)
 			btot := uint32(0)
 			atot := uint32(0)
 
-			for yy := 0; yy < TAILLE_CARRE; yy++ { //on boucle sur l'interieur de chaque carré (on commence en haut a gauche)
-				for xx := 0; xx < TAILLE_CARRE; xx++ {
-					r, g, b, a := imageInOut.At(x+xx, y+yy).RGBA() //on recupere les valeurs rgba actuelles d'un pixel de l'image en 32 bits
+			for yy := carre.Min.Y; yy < carre.Max.Y; yy++ { //on boucle sur l'interieur de chaque carré (on commence en haut a gauche)
+				for xx := carre.Min.X; xx < carre.Max.X; xx++ {
+					r, g, b, a := imageInOut.At(xx, yy).RGBA() //on recupere les valeurs rgba actuelles d'un pixel de l'image en 32 bits
 					rtot += r
 					gtot += g
 					btot += b
@@ -141,9 +233,9 @@ func blurMaison(imageInOut *image.RGBA, rectangle image.Rectangle) { //on retour
 			bmoy8 := uint8(bmoy32 >> 8)
 			amoy8 := uint8(amoy32 >> 8)
 
-			for yy := 0; yy < TAILLE_CARRE; yy++ { //on boucle sur l'interieur de chaque carré (on commence en haut a gauche)
-				for xx := 0; xx < TAILLE_CARRE; xx++ {
-					imageInOut.Set(x+xx, y+yy, color.RGBA{rmoy8, gmoy8, bmoy8, amoy8}) //on affecte les memes valeurs rgba a tous les pixels du carré
+			for yy := carre.Min.Y; yy < carre.Max.Y; yy++ { //on boucle sur l'interieur de chaque carré (on commence en haut a gauche)
+				for xx := carre.Min.X; xx < carre.Max.X; xx++ {
+					imageInOut.Set(xx, yy, color.RGBA{rmoy8, gmoy8, bmoy8, amoy8}) //on affecte les memes valeurs rgba a tous les pixels du carré
 				}
 			}
 		}
@@ -169,101 +261,271 @@ func NewMatRGB8FromImage(img image.Image) (gocv.Mat, error) { //return renvoie 2
 }
 
 //traitement screenshot
-func screenshotclient(img gocv.Mat, connection net.Conn) {
+func screenshotclient(img gocv.Mat, no_device int, connection net.Conn, logger *slog.Logger) {
+
+	if connection == nil { //execution en mode partiel, pas de serveur
+		logger.Warn("pas de connexion au serveur, screenshot impossible")
+		return
+	}
+	debut := time.Now()
 
-	img_jpg, _ := gocv.IMEncode(".jpg", img) //gocv.Mat to *gocvNativeByteBuffer en utilisant le format jpg
+	img_bytes, err := codecServeur.Encoder(img) //gocv.Mat to bytes dans le format negocié avec le serveur
+	if err != nil {
+		logger.Error("erreur d'encodage du screenshot", "erreur", err)
+		erreurs.Ajouter("screenshot", 1)
+		return
+	}
 
 	//img_bytes := img.ToBytes() //on conv img (gocv.Mat) en bytes pour l'envoyer dans la socket
 
-	EnvoiImage(img_jpg.GetBytes(), connection) //getBytes = from *gocvNativeByteBuffer to bytes
+	if err := EnvoiImage(img_bytes, connection); err != nil {
+		logger.Error("erreur d'envoi du screenshot", "erreur", err)
+		erreurs.Ajouter("screenshot", 1)
+		return
+	}
 
-	img_blured_bytes := ReceptionImage(connection)
+	img_blured_bytes, err := ReceptionImage(connection)
+	if err != nil {
+		logger.Error("erreur de reception du screenshot flouté", "erreur", err)
+		erreurs.Ajouter("screenshot", 1)
+		return
+	}
 
-	img_screenshot, _ := gocv.IMDecode(img_blured_bytes, 1) //on decode des bytes au format jpg (1) pr avoir une gocv.Mat
+	img_screenshot, err := Decoder(img_blured_bytes, gocv.IMReadColor) //on decode des bytes pr avoir une gocv.Mat
+	if err != nil {
+		logger.Error("screenshot flouté illisible", "erreur", err)
+		erreurs.Ajouter("screenshot", 1)
+		return
+	}
 
-	title_screenshot := "Screenshot on camera n° 0 "
+	title_screenshot := "Screenshot on camera n° " + strconv.Itoa(no_device)
 	window_screenshot := gocv.NewWindow(title_screenshot)
 
 	//defer window_screenshot.Close() mis en commentaire car sinon on sort de la fonction screenshot et l'image ne reste pas
 
-	// afficher la fenetre contenant le screenshot et attendre 100 ms
-	fmt.Println("affichage screen")
+	// afficher la fenetre contenant le screenshot et attendre frame_delay
+	logger.Info("affichage du screenshot flouté", "taille_envoyee", len(img_bytes), "taille_recue", len(img_blured_bytes), "duree", time.Since(debut))
 	window_screenshot.IMShow(img_screenshot)
-	window_screenshot.WaitKey(100)
+	window_screenshot.WaitKey(int(ConfigActuelle().AttenteTouche.Duration().Milliseconds()))
+
+}
+
+// rectangle detecté par le serveur, en pixels de l'image
+type Boite struct {
+	X         int      `json:"x"`
+	Y         int      `json:"y"`
+	Largeur   int      `json:"width"`
+	Hauteur   int      `json:"height"`
+	Confiance *float64 `json:"confidence"`
+}
+
+// resultat de la detection seule renvoyé par le serveur
+type ResultatDetection struct {
+	Detecteur string  `json:"detector"`
+	Largeur   int     `json:"image_width"`
+	Hauteur   int     `json:"image_height"`
+	Visages   []Boite `json:"faces"`
+	Plaques   []Boite `json:"plates"` //absent si le serveur n'a pas detecté de plaque
+}
+
+// envoie l'image au serveur qui ne renvoie que les rectangles des visages detectés
+func detectionclient(img gocv.Mat, connection net.Conn, logger *slog.Logger) {
+
+	if connection == nil { //execution en mode partiel, pas de serveur
+		logger.Warn("pas de connexion au serveur, detection impossible")
+		return
+	}
+	debut := time.Now()
+
+	img_bytes, err := codecServeur.Encoder(img)
+	if err != nil {
+		logger.Error("erreur d'encodage de l'image", "erreur", err)
+		erreurs.Ajouter("detection", 1)
+		return
+	}
+
+	reponse, err := DemanderDetection(img_bytes, connection)
+	if err != nil {
+		logger.Error("erreur de detection par le serveur", "erreur", err)
+		erreurs.Ajouter("detection", 1)
+		return
+	}
+
+	var resultat ResultatDetection
+	if err := json.Unmarshal(reponse, &resultat); err != nil {
+		logger.Error("detection illisible", "erreur", err)
+		erreurs.Ajouter("detection", 1)
+		return
+	}
+	logger.Info("detection recue", "visages", len(resultat.Visages), "plaques", len(resultat.Plaques), "detecteur", resultat.Detecteur, "duree", time.Since(debut))
+	fmt.Println(len(resultat.Visages), "visage(s) detecté(s) par", resultat.Detecteur, "sur l'image", resultat.Largeur, "x", resultat.Hauteur)
+	for _, visage := range resultat.Visages {
+		fmt.Println(" - x =", visage.X, "y =", visage.Y, "largeur =", visage.Largeur, "hauteur =", visage.Hauteur)
+	}
+	if len(resultat.Plaques) > 0 {
+		fmt.Println(len(resultat.Plaques), "plaque(s) detectée(s)")
+		for _, plaque := range resultat.Plaques {
+			fmt.Println(" - x =", plaque.X, "y =", plaque.Y, "largeur =", plaque.Largeur, "hauteur =", plaque.Hauteur)
+		}
+	}
+}
 
+// envoie la commande de detection et l'image, renvoie le json des visages detectés
+func DemanderDetection(img_bytes []byte, connection net.Conn) ([]byte, error) {
+	if _, err := connection.Write([]byte(fillString(COMMANDE_DETECTION, 10))); err != nil {
+		return nil, fmt.Errorf("envoi de la commande de detection: %w", err)
+	}
+	if err := EnvoiImage(img_bytes, connection); err != nil {
+		return nil, fmt.Errorf("envoi de l'image: %w", err)
+	}
+	reponse, err := ReceptionImage(connection) //le json est envoyé comme une image
+	if err != nil {
+		return nil, fmt.Errorf("reception de la detection: %w", err)
+	}
+	return reponse, nil
 }
 
-func EnvoiImage(img_bytes []byte, connection net.Conn) {
+func EnvoiImage(img_bytes []byte, connection net.Conn) error {
+	tailleBuffer := ConfigActuelle().TailleBuffer //lue une fois pour toute l'image
 
 	//envoie de la taille de l'image au serveur
 	//fillString = comble une chaine a 10 caracteres (Le second 10)
 	//FormatInt = transforme un int en string en utlisant la base 10
 	Img_size := fillString(strconv.FormatInt(int64(len(img_bytes)), 10), 10) //bufSize = string
-	fmt.Println("taille image =", len(img_bytes), " buff=", Img_size)
-	connection.Write([]byte(Img_size)) //.write = envoie de bytes dans un socket //[]byte = cast string en bytes
+	slog.Debug("envoi de l'image", "remote", connection.RemoteAddr().String(), "taille", len(img_bytes))
+	if _, err := connection.Write([]byte(Img_size)); err != nil { //.write = envoie de bytes dans un socket //[]byte = cast string en bytes
+		return err
+	}
 
 	var sentBytes int64
 	sentBytes = 0
-	fmt.Println("Debut envoie image")
 
 	for { //on divise l'image en paquets de bytes de lataille du buffersize (1024 bytes)
-		if (int64(len(img_bytes)) - sentBytes) <= BUFFERSIZE { //dernier envoie de paquet
+		if (int64(len(img_bytes)) - sentBytes) <= tailleBuffer { //dernier envoie de paquet
 
 			sendBuffer := img_bytes[sentBytes:int64(len(img_bytes))] //sendBuffer = dernier paquet de l'image bytes
-			connection.Write(sendBuffer)
+			if _, err := connection.Write(sendBuffer); err != nil {
+				return err
+			}
 			//fmt.Println("Image envoyé de l'index", sentBytes, " à:", int64(len(img_bytes)))
 
 			break
 		}
 
 		//cas classique de paquet de 1024 bytes
-		sendBuffer := img_bytes[sentBytes : sentBytes+BUFFERSIZE]
-		connection.Write(sendBuffer)
+		sendBuffer := img_bytes[sentBytes : sentBytes+tailleBuffer]
+		if _, err := connection.Write(sendBuffer); err != nil {
+			return err
+		}
 		//fmt.Println("keep sending image:", noimg, "from index:", sentBytes, " to:", sentBytes+BUFFERSIZE)
 
-		sentBytes += BUFFERSIZE
+		sentBytes += tailleBuffer
 	}
-	fmt.Println("Fin envoi de l'image")
+	octetsEnvoyes.Ajouter("socket", float64(len(img_bytes)))
+	slog.Debug("fin envoi de l'image", "remote", connection.RemoteAddr().String())
+	return nil
 }
 
-func ReceptionImage(connection net.Conn) []byte {
-
-	var buffImage []byte //buffer qui va contenir l'image complete
+func ReceptionImage(connection net.Conn) ([]byte, error) {
+	slog.Debug("en attente de reception de l'image floutée", "remote", connection.RemoteAddr().String())
 
-	fmt.Println("En attente de reception de l'image floutée ")
+	entete, err := LectureEntete(connection)
+	if err != nil {
+		return nil, err
+	}
+	return ReceptionCorps(connection, entete)
+}
 
+// lit les 10 octets d'entete (taille de l'image ou numero d'image) sans les ":" de remplissage
+func LectureEntete(connection net.Conn) (string, error) {
 	bufferImageSize := make([]byte, 10) //creation du buffer de taille 10 bytes visant a contenir la taille de l'image
 
-	connection.Read(bufferImageSize)                         //on recupere les 10 premiers octets contenant la taille de l'image
-	cut_buffer := strings.Trim(string(bufferImageSize), ":") //on enleve les ":" a la chaine pour avoir uniquement la taille de l'image
-	imageSize, _ := strconv.ParseInt(cut_buffer, 10, 64)     //conversion from string to int64 en base 10
+	if _, err := io.ReadFull(connection, bufferImageSize); err != nil { //on recupere les 10 premiers octets contenant la taille de l'image
+		return "", err
+	}
+	return strings.Trim(string(bufferImageSize), ":"), nil //on enleve les ":" a la chaine pour avoir uniquement la taille de l'image
+}
+
+// lit l'image dont la taille a ete lue dans l'entete cut_buffer
+func ReceptionCorps(connection net.Conn, cut_buffer string) ([]byte, error) {
+
+	var buffImage []byte                          //buffer qui va contenir l'image complete
+	tailleBuffer := ConfigActuelle().TailleBuffer //lue une fois pour toute l'image
+
+	imageSize, err := strconv.ParseInt(cut_buffer, 10, 64) //conversion from string to int64 en base 10
+	if err != nil {
+		return nil, fmt.Errorf("taille d'image illisible %q: %w", cut_buffer, err)
+	}
 
 	//fmt.Println("Image size:", imageSize, " bufsize:", bufferImageSize, "   ", string(bufferImageSize))
 
-	if imageSize == 0 { //pb dans la transmission de la taille
-		fmt.Println("Image size is zero")
-		return buffImage //retourne un buffer vide
+	if imageSize <= 0 { //le serveur n'a pas pu traiter l'image
+		return nil, errors.New("image size is zero")
 	}
 
 	var receivedBytes int64 = 0
 
 	for { //on lit les paquets de 1024 bytes pour reconstituer l'image //on boucle sur chaque paquets
-		if (imageSize - receivedBytes) <= BUFFERSIZE { //cas du dernier paquet
+		if (imageSize - receivedBytes) <= tailleBuffer { //cas du dernier paquet
 
-			buffPartImage := make([]byte, imageSize-receivedBytes) //creation d'un buffer uniquement pour le dernier paquet
-			connection.Read(buffPartImage)                         //on lit le dernier paquet
-			buffImage = append(buffImage, buffPartImage...)        //on rajoute le dernier paquet dans le buffimage
+			buffPartImage := make([]byte, imageSize-receivedBytes)            //creation d'un buffer uniquement pour le dernier paquet
+			if _, err := io.ReadFull(connection, buffPartImage); err != nil { //on lit le dernier paquet
+				return nil, err
+			}
+			buffImage = append(buffImage, buffPartImage...) //on rajoute le dernier paquet dans le buffimage
 			break
 		}
-		buffPartImage := make([]byte, BUFFERSIZE)
-		connection.Read(buffPartImage)
+		buffPartImage := make([]byte, tailleBuffer)
+		if _, err := io.ReadFull(connection, buffPartImage); err != nil {
+			return nil, err
+		}
 		buffImage = append(buffImage, buffPartImage...) //on rajoute un paquet dans le buffimage
 		//fmt.Println("Keep receiving image:", noimg, " index:", receivedBytes)
-		receivedBytes += BUFFERSIZE //on passe au prochain paquet
+		receivedBytes += tailleBuffer //on passe au prochain paquet
+	}
+	octetsRecus.Ajouter("socket", float64(imageSize))
+	slog.Debug("image complete recue", "remote", connection.RemoteAddr().String(), "taille", imageSize)
+
+	return buffImage, nil //en byte
+}
+
+// donne au serveur le nom de la camera dont viennent les images de cette connexion
+// demande ponctuelle de la camera sur la connexion principale, la camera est annoncée au serveur si elle a changé
+// pour que ses sidecars portent le bon nom
+func demandeServeur(no_device int, connection net.Conn, logger *slog.Logger, demande func()) {
+	connexionPrincipale.Lock()
+	defer connexionPrincipale.Unlock()
+	if connection != nil && sourceDeclaree != no_device {
+		if err := DeclarerSource(connection, "camera "+strconv.Itoa(no_device)); err != nil {
+			logger.Warn("le serveur n'a pas accepté le nom de la camera", "erreur", err)
+		} else {
+			sourceDeclaree = no_device
+		}
+	}
+	demande()
+}
+
+func DeclarerSource(connection net.Conn, source string) error {
+	if _, err := connection.Write([]byte(fillString(COMMANDE_SOURCE, 10))); err != nil {
+		return err
+	}
+	if err := EnvoiImage([]byte(source), connection); err != nil {
+		return err
 	}
-	fmt.Println("On a recu l'image complete de taille :", imageSize)
+	_, err := ReceptionImage(connection) //le serveur confirme la source
+	return err
+}
 
-	return buffImage //en byte
+// previent le serveur qu'on se deconnecte pour qu'il ferme la connexion proprement
+func FinConnexion(connection net.Conn) {
+	if connection == nil {
+		return
+	}
+	if _, err := connection.Write([]byte(fillString(FIN_CONNEXION, 10))); err != nil {
+		slog.Warn("le serveur n'a pas pu etre prevenu de la deconnexion", "remote", connection.RemoteAddr().String(), "erreur", err)
+		return
+	}
+	slog.Info("déconnecté du serveur", "remote", connection.RemoteAddr().String())
 }
 
 func fillString(returnString string, toLength int) string { //comble le msg de 10 octet
@@ -279,35 +541,89 @@ func fillString(returnString string, toLength int) string { //comble le msg de 1
 }
 
 func main() {
+	os.Exit(executerCommande(os.Args[1:]))
+}
+
+// lit les cameras, les floute, les diffuse et les envoie au serveur
+// le programme continue sans serveur si la connexion est impossible
+func commandeCapture(args []string) int {
+	options := nouvellesOptions("capture", "[options]",
+		"lit les cameras, les affiche floutées et les diffuse en mjpeg. les touches des fenetres ou de la console (h pour l'aide) choisissent le floutage et envoient les images au serveur.")
+	avecMetriques := options.Bool("metrics", false, "expose les metriques prometheus sur /metrics du port de diffusion")
+	dossierSidecars := options.String("sidecars", "", "dossier ou ecrire un sidecar json par segment d'images diffusées en mjpeg (desactivé si vide)")
+	communes := optionsCommunes(options)
+	if err := options.Parse(args); err != nil {
+		return codeAnalyse(err)
+	}
+	config, code := communes.Preparer()
+	if code != SORTIE_OK {
+		return code
+	}
+
+	slog.Info("début programme client")
+
+	if *dossierSidecars != "" {
+		var err error
+		sidecars, err = NouveauJournalSidecars(*dossierSidecars)
+		if err != nil {
+			slog.Error("erreur sur le dossier des sidecars", "dossier", *dossierSidecars, "erreur", err)
+			return SORTIE_CONFIGURATION
+		}
+		slog.Info("sidecars activés", "dossier", *dossierSidecars)
+	}
+
+	if *communes.fichierConfig != "" {
+		go SurveillerConfiguration(context.Background(), *communes.fichierConfig)
+	}
 
-	fmt.Println("Début programme Client")
+	cameras := CamerasDisponibles(config)
+	if len(cameras) == 0 {
+		slog.Error("aucune camera disponible", "cameras", config.Cameras)
+		return SORTIE_CONNEXION
+	}
+	slog.Info("cameras lancées", "cameras", cameras)
 
-	serveurip := "localhost:" + PORT
+	serveurip := config.AdresseServeur
 
 	connection, err := net.Dial("tcp", serveurip) // fonction qui ouvre la connexion entre le serveur et le client en local sur un port défini
 	if err != nil {
-		fmt.Println("connexion au serveur impossible, execution en mode partiel")
+		slog.Warn("connexion au serveur impossible, execution en mode partiel", "adresse", serveurip, "erreur", err)
 	} else {
-		fmt.Println("Connecté au serveur!")
+		slog.Info("connecté au serveur", "adresse", serveurip)
+		connexionsActives.Ajouter("", 1)
 		defer connection.Close()
-	}
-	go camera(0, connection)
-	go camera(1, connection)
-
-	fmt.Println("Appuyer sur 'q' pour sortir, 'c' pour flouter, 's' pour envoyer l'image en cours au serveur et la récuperer floutée")
-	fmt.Println("Appuyer sur toute autre touche pour revenir au mode initial")
 
-	for { //boucle infinie pour laisser les go routines camera s'executer de leur coté
-		reader := bufio.NewReader(os.Stdin)  //on creer le reader sur l'entrée clavier
-		choice, _ := reader.ReadString('\n') //on lit jusqu'au \n
-		touche = string(choice)
+		codecServeur, err = NegocierCodec(connection, config.Codec)
+		if err != nil {
+			slog.Warn("negociation du codec impossible", "codec", codecServeur.Format, "erreur", err)
+		}
+		slog.Info("codec des images transmises", "codec", codecServeur.Format, "qualite", codecServeur.Qualite, "largeur_max", codecServeur.LargeurMax)
 
-		if touche == "q\r\n" { //on quitte le programme
-			break
+		if err := DeclarerSource(connection, "camera "+strconv.Itoa(cameras[0])); err != nil { //la premiere camera est la cible par defaut des screenshots
+			slog.Warn("le serveur n'a pas accepté le nom de la camera", "erreur", err)
+		} else {
+			sourceDeclaree = cameras[0]
 		}
 	}
-	fmt.Println("Fin programme Client")
+	go ServirDiffusion(config.HoteMjpeg, config.PortMjpeg, *avecMetriques)
+	commandes := NouvellesCommandes(cameras)
+	for _, no_device := range cameras {
+		go camera(no_device, commandes, connection)
+	}
 
+	fmt.Println(AIDE)
+	fmt.Println("Cameras floutées visibles dans un navigateur sur http://<adresse du poste>:" + config.PortMjpeg + "/")
+
+	go LireConsole(os.Stdin, commandes) //les go routines camera s'executent de leur coté jusqu'a q
+	<-commandes.Fin()
+	connexionPrincipale.Lock() //on attend la fin d'un screenshot ou d'une detection en cours
+	FinConnexion(connection)
+	connexionPrincipale.Unlock()
+	if err := sidecars.Fermer(); err != nil {
+		slog.Error("erreur d'ecriture des derniers sidecars", "erreur", err)
+	}
+	slog.Info("fin programme client")
+	return SORTIE_OK
 }
 
 /*
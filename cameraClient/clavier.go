@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio" //lecture de la console
+	"fmt"
+	"io"
+	"log/slog" //trace
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
+)
+
+// commandes de l'operateur, tapées dans la fenetre d'une camera (valeur renvoyée par WaitKey) ou dans la console
+// les deux passent par Executer et ont le meme effet, sauf s et d qui visent la camera de la fenetre
+// ou, depuis la console, la camera cible choisie avec son numero
+
+const MODE_INITIAL = 'r' //image non floutée
+const MODE_LOCAL = 'c'   //floutage local par le pipeline
+const MODE_SERVEUR = 'f' //floutage en continu par le serveur
+
+const AIDE = `commandes, au clavier d'une fenetre de camera ou dans la console :
+  c      flouter localement les images affichées
+  f      envoyer les images en continu au serveur et afficher le flux flouté qu'il renvoie
+  r      revenir au mode initial, images non floutées
+  s      envoyer l'image en cours au serveur et afficher le screenshot flouté
+  d      envoyer l'image en cours au serveur et afficher les visages detectés
+  o      afficher ou cacher la superposition de debogage (detections, pistes, fps)
+  0-9    choisir la camera visée par s et d depuis la console (dans une fenetre, s et d visent sa camera)
+  h, ?   afficher cette aide
+  q      quitter`
+
+type Commandes struct {
+	mode        atomic.Int32          //MODE_INITIAL, MODE_LOCAL ou MODE_SERVEUR, commun a toutes les cameras
+	cible       atomic.Int32          //camera visée par s et d depuis la console
+	ponctuelles map[int]*atomic.Int32 //screenshot ou detection demandé par camera, remis a 0 par son traitement
+	fin         chan struct{}         //fermé par q
+	arret       sync.Once
+}
+
+// la premiere camera est la cible par defaut, comme avant le choix au clavier
+func NouvellesCommandes(cameras []int) *Commandes {
+	commandes := &Commandes{ponctuelles: map[int]*atomic.Int32{}, fin: make(chan struct{})}
+	for _, no := range cameras {
+		commandes.ponctuelles[no] = &atomic.Int32{}
+	}
+	commandes.mode.Store(MODE_INITIAL)
+	commandes.cible.Store(int32(cameras[0]))
+	return commandes
+}
+
+func (commandes *Commandes) Mode() rune {
+	return rune(commandes.mode.Load())
+}
+
+// commande ponctuelle en attente pour la camera ('s' ou 'd'), 0 sinon ; elle n'est renvoyée qu'une fois
+func (commandes *Commandes) Ponctuelle(no_device int) rune {
+	if ponctuelle, ok := commandes.ponctuelles[no_device]; ok {
+		return rune(ponctuelle.Swap(0))
+	}
+	return 0
+}
+
+// fermé quand l'operateur quitte
+func (commandes *Commandes) Fin() <-chan struct{} {
+	return commandes.fin
+}
+
+// touche renvoyée par WaitKey dans la fenetre de la camera no_device, -1 si aucune
+// les touches inconnues sont ignorées : une fenetre recoit aussi les touches de fonction, fleches...
+func (commandes *Commandes) Touche(touche int, no_device int) {
+	if touche < 0 {
+		return
+	}
+	commandes.Executer(unicode.ToLower(rune(touche&0xFF)), no_device) //les bits de poids fort sont les modificateurs sous certains systemes
+}
+
+// execute une commande, no_device est la camera de la fenetre ou -1 pour la console
+// renvoie faux si la commande est inconnue
+func (commandes *Commandes) Executer(commande rune, no_device int) bool {
+	switch {
+	case commande == MODE_INITIAL || commande == MODE_LOCAL || commande == MODE_SERVEUR:
+		if ancien := commandes.mode.Swap(commande); ancien != commande {
+			slog.Info("changement de mode", "mode", string(commande), "precedent", string(rune(ancien)))
+		}
+	case commande == 's' || commande == 'd':
+		if no_device < 0 {
+			no_device = int(commandes.cible.Load())
+		}
+		commandes.ponctuelles[no_device].Store(commande) //la camera de la fenetre ou la cible existent toujours
+	case commande == 'o':
+		BasculerSuperposition()
+	case commande >= '0' && commande <= '9':
+		no := int(commande - '0')
+		if _, ok := commandes.ponctuelles[no]; !ok {
+			slog.Warn("camera non lancée, la cible ne change pas", "camera", no, "cible", commandes.cible.Load())
+			return true
+		}
+		commandes.cible.Store(int32(no))
+		slog.Info("camera visée par s et d depuis la console", "camera", no)
+	case commande == 'h' || commande == '?':
+		fmt.Println(AIDE)
+	case commande == 'q':
+		commandes.arret.Do(func() { close(commandes.fin) })
+	default:
+		return false
+	}
+	return true
+}
+
+// interprete la console ligne par ligne jusqu'a la fin de l'entrée
+// un seul lecteur pour toute la durée du programme, pour ne pas perdre ce qu'il a deja lu
+func LireConsole(entree io.Reader, commandes *Commandes) {
+	lignes := bufio.NewScanner(entree)
+	for lignes.Scan() {
+		ligne := strings.ToLower(strings.TrimSpace(lignes.Text())) //les fins de ligne \r\n de windows comprises
+		switch {
+		case ligne == "":
+		case ligne == "help" || ligne == "aide":
+			fmt.Println(AIDE)
+		case len([]rune(ligne)) == 1 && commandes.Executer([]rune(ligne)[0], -1):
+		default:
+			fmt.Printf("commande inconnue %q\n%s\n", ligne, AIDE)
+		}
+	}
+	if err := lignes.Err(); err != nil {
+		slog.Warn("lecture de la console impossible", "erreur", err)
+	}
+	slog.Info("console fermée, les commandes restent possibles au clavier des fenetres")
+}
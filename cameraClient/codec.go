@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"net"
+	"time"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+const COMMANDE_CODEC = "CODEC" //negociation du format des images, suivie de la demande en json
+
+// format de transmission des images negocié avec le serveur
+type Codec struct {
+	Format     string `json:"codec"`     //jpg, png ou webp
+	Qualite    int    `json:"quality"`   //de 1 a 100 pour jpg et webp, ignorée pour png (sans perte)
+	LargeurMax int    `json:"max_width"` //les images plus larges sont reduites avant l'envoi, 0 pour ne jamais reduire
+}
+
+// demande envoyée au serveur : formats par ordre de preference
+type DemandeCodec struct {
+	Formats    []string `json:"codecs"`
+	Qualite    int      `json:"quality"`
+	LargeurMax int      `json:"max_width"`
+}
+
+var CODEC_DEFAUT = Codec{Format: "jpg", Qualite: 95} //celui du serveur tant qu'on n'a rien negocié
+
+// compromis qualité / taille par defaut, a adapter selon le reseau avec "codec" dans la configuration
+var DEMANDE_CODEC_DEFAUT = DemandeCodec{Formats: []string{"webp", "jpg"}, Qualite: 80, LargeurMax: 0}
+
+var codecServeur = CODEC_DEFAUT //codec negocié sur la connexion principale
+
+var FORMATS = map[string]gocv.FileExt{"jpg": gocv.JPEGFileExt, "png": gocv.PNGFileExt, "webp": ".webp"}
+
+// verifie la demande avant de l'envoyer, le serveur refuserait les memes valeurs
+func (demande DemandeCodec) Valider() error {
+	var erreurs []error
+	if len(demande.Formats) == 0 {
+		erreurs = append(erreurs, errors.New("codecs: au moins un format attendu"))
+	}
+	vus := map[string]bool{}
+	for _, format := range demande.Formats {
+		if _, ok := FORMATS[format]; !ok || vus[format] {
+			erreurs = append(erreurs, fmt.Errorf("codecs: format %q inconnu ou en double, attendu jpg, png ou webp", format))
+		}
+		vus[format] = true
+	}
+	if demande.Qualite < 1 || demande.Qualite > 100 {
+		erreurs = append(erreurs, fmt.Errorf("quality: %d hors de [1, 100]", demande.Qualite))
+	}
+	if demande.LargeurMax < 0 {
+		erreurs = append(erreurs, fmt.Errorf("max_width: %d negative, 0 pour ne jamais reduire", demande.LargeurMax))
+	}
+	return errors.Join(erreurs...)
+}
+
+// propose la demande de la configuration au serveur et renvoie le codec qu'il a choisi
+// si le serveur refuse on garde CODEC_DEFAUT
+func NegocierCodec(connection net.Conn, demande DemandeCodec) (Codec, error) {
+	demande_bytes, err := json.Marshal(demande)
+	if err != nil {
+		return CODEC_DEFAUT, err
+	}
+	if _, err := connection.Write([]byte(fillString(COMMANDE_CODEC, 10))); err != nil {
+		return CODEC_DEFAUT, err
+	}
+	if err := EnvoiImage(demande_bytes, connection); err != nil { //la demande est envoyée comme une image
+		return CODEC_DEFAUT, err
+	}
+
+	reponse, err := ReceptionImage(connection)
+	if err != nil {
+		return CODEC_DEFAUT, fmt.Errorf("codec refusé par le serveur: %w", err)
+	}
+	var codec Codec
+	if err := json.Unmarshal(reponse, &codec); err != nil {
+		return CODEC_DEFAUT, fmt.Errorf("reponse du serveur illisible: %w", err)
+	}
+	if _, ok := FORMATS[codec.Format]; !ok {
+		return CODEC_DEFAUT, fmt.Errorf("format inconnu %q choisi par le serveur", codec.Format)
+	}
+	return codec, nil
+}
+
+// reduit l'image si besoin puis l'encode dans le format du codec
+func (codec Codec) Encoder(img gocv.Mat) ([]byte, error) {
+	defer latenceCodec.Duree("encode", time.Now())
+	if codec.LargeurMax > 0 && img.Cols() > codec.LargeurMax {
+		reduite := gocv.NewMat()
+		defer reduite.Close()
+		hauteur := img.Rows() * codec.LargeurMax / img.Cols()
+		gocv.Resize(img, &reduite, image.Pt(codec.LargeurMax, hauteur), 0, 0, gocv.InterpolationArea)
+		img = reduite
+	}
+
+	extension, ok := FORMATS[codec.Format]
+	if !ok {
+		return nil, fmt.Errorf("format inconnu %q", codec.Format)
+	}
+	var params []int
+	switch codec.Format {
+	case "jpg":
+		params = []int{gocv.IMWriteJpegQuality, codec.Qualite}
+	case "webp":
+		params = []int{gocv.IMWriteWebpQuality, codec.Qualite}
+	}
+
+	buffer, err := gocv.IMEncodeWithParams(extension, img, params)
+	if err != nil {
+		return nil, fmt.Errorf("encodage %s de l'image: %w", codec.Format, err)
+	}
+	defer buffer.Close()
+	return append([]byte(nil), buffer.GetBytes()...), nil //copie car GetBytes pointe dans le buffer natif libéré par Close
+}
+
+// decode une image dans n'importe quel format supporté par opencv
+func Decoder(img_bytes []byte, flags gocv.IMReadFlag) (gocv.Mat, error) {
+	defer latenceCodec.Duree("decode", time.Now())
+	img, err := gocv.IMDecode(img_bytes, flags)
+	if err != nil {
+		return img, fmt.Errorf("decodage de l'image: %w", err)
+	}
+	if img.Empty() {
+		img.Close()
+		return img, errors.New("image recue illisible")
+	}
+	return img, nil
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+// codes de sortie communs a toutes les commandes, les memes que ceux du serveur
+const (
+	SORTIE_OK            = 0
+	SORTIE_TRAITEMENT    = 1 //image illisible ou refusée par le serveur
+	SORTIE_CONFIGURATION = 2 //options ou fichier de configuration invalides
+	SORTIE_CONNEXION     = 3 //serveur injoignable ou aucune camera disponible
+)
+
+const NOM_PROGRAMME = "cameraClient"
+
+type Commande struct {
+	Nom    string
+	Resume string
+	Lancer func(args []string) int
+}
+
+// dans une fonction car l'aide fait partie des commandes
+func listeCommandes() []Commande {
+	return []Commande{
+		{"capture", "lit et floute les cameras (commande par defaut)", commandeCapture},
+		{"enroll", "ajoute ou retire un visage de la liste blanche", commandeEnroll},
+		{"devices", "liste les cameras disponibles et leurs reglages", commandeDevices},
+		{"anonymize", "fait anonymiser une image par le serveur", commandeAnonymize},
+		{"detect", "affiche en json les visages detectés par le serveur sur une image", commandeDetect},
+		{"bench", "mesure le temps d'aller retour d'une image avec le serveur", commandeBench},
+		{"help", "affiche cette aide", commandeAide},
+	}
+}
+
+// sans commande, ou avec seulement des options, on lance les cameras comme avant les sous-commandes
+func executerCommande(args []string) int {
+	if len(args) == 0 || (strings.HasPrefix(args[0], "-") && !estAide(args[0])) {
+		return commandeCapture(args)
+	}
+	if estAide(args[0]) {
+		return commandeAide(args[1:])
+	}
+	for _, commande := range listeCommandes() {
+		if commande.Nom == args[0] {
+			return commande.Lancer(args[1:])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "commande inconnue %q\n\n", args[0])
+	aide(os.Stderr)
+	return SORTIE_CONFIGURATION
+}
+
+func estAide(arg string) bool {
+	return arg == "-h" || arg == "-help" || arg == "--help"
+}
+
+func commandeAide(args []string) int {
+	aide(os.Stdout)
+	return SORTIE_OK
+}
+
+func aide(w io.Writer) {
+	fmt.Fprintf(w, "usage : %s <commande> [options]\n\ncommandes :\n", NOM_PROGRAMME)
+	for _, commande := range listeCommandes() {
+		fmt.Fprintf(w, "  %-13s %s\n", commande.Nom, commande.Resume)
+	}
+	fmt.Fprintf(w, "\n%s <commande> -help donne les options de la commande\n", NOM_PROGRAMME)
+	fmt.Fprintf(w, "codes de sortie : %d ok, %d erreur de traitement, %d erreur de configuration, %d erreur de connexion\n",
+		SORTIE_OK, SORTIE_TRAITEMENT, SORTIE_CONFIGURATION, SORTIE_CONNEXION)
+}
+
+// options de la commande, l'aide donne l'usage et la description
+func nouvellesOptions(nom, usage, description string) *flag.FlagSet {
+	options := flag.NewFlagSet(nom, flag.ContinueOnError)
+	options.Usage = func() {
+		fmt.Fprintf(options.Output(), "usage : %s %s %s\n\n%s\n\noptions :\n", NOM_PROGRAMME, nom, usage, description)
+		options.PrintDefaults()
+	}
+	return options
+}
+
+// code de sortie de l'analyse des options, -help n'est pas une erreur
+func codeAnalyse(err error) int {
+	if errors.Is(err, flag.ErrHelp) {
+		return SORTIE_OK
+	}
+	return SORTIE_CONFIGURATION
+}
+
+// options de log et de configuration communes aux commandes
+type OptionsCommunes struct {
+	niveauLogs    *string
+	formatLogs    *string
+	fichierConfig *string
+	surcharges    func(*Configuration)
+}
+
+func optionsCommunes(options *flag.FlagSet) *OptionsCommunes {
+	return &OptionsCommunes{
+		niveauLogs:    options.String("log-level", "info", "niveau des logs : debug, info, warn ou error"),
+		formatLogs:    options.String("log-format", "text", "format des logs : text ou json"),
+		fichierConfig: options.String("config", "", "fichier de configuration json, rechargé sur SIGHUP ou a sa modification par capture (valeurs par defaut si vide)"),
+		surcharges:    optionsConfiguration(options),
+	}
+}
+
+// configure les logs et charge la configuration, renvoie SORTIE_OK ou SORTIE_CONFIGURATION
+func (o *OptionsCommunes) Preparer() (*Configuration, int) {
+	if err := ConfigurerLogs(*o.niveauLogs, *o.formatLogs); err != nil {
+		fmt.Fprintln(os.Stderr, "options de log invalides :", err)
+		return nil, SORTIE_CONFIGURATION
+	}
+	surchargesCommande = o.surcharges
+	config, err := ChargerConfiguration(*o.fichierConfig)
+	if err != nil {
+		slog.Error("configuration invalide", "fichier", *o.fichierConfig, "erreur", err)
+		return nil, SORTIE_CONFIGURATION
+	}
+	configuration.Store(config)
+	return config, SORTIE_OK
+}
+
+// connexion au serveur de la configuration, avec negociation du codec et nom de la source
+func connexionServeur(config *Configuration, source string) (net.Conn, int) {
+	connection, err := net.Dial("tcp", config.AdresseServeur)
+	if err != nil {
+		slog.Error("connexion au serveur impossible", "adresse", config.AdresseServeur, "erreur", err)
+		return nil, SORTIE_CONNEXION
+	}
+	codecServeur, err = NegocierCodec(connection, config.Codec)
+	if err != nil {
+		slog.Warn("negociation du codec impossible", "codec", codecServeur.Format, "erreur", err)
+	}
+	if err := DeclarerSource(connection, source); err != nil {
+		slog.Warn("le serveur n'a pas accepté le nom de la source", "erreur", err)
+	}
+	return connection, SORTIE_OK
+}
+
+func commandeDevices(args []string) int {
+	options := nouvellesOptions("devices", "[-json] [options]",
+		"ouvre chaque camera et affiche sa resolution, ses fps et le backend de capture.\nsans -cameras, les numeros 0 a 9 sont essayés ; les options -capture-* montrent ce que chaque camera accepte.")
+	enJson := options.Bool("json", false, "resultat en json")
+	communes := optionsCommunes(options)
+	if err := options.Parse(args); err != nil {
+		return codeAnalyse(err)
+	}
+	config, code := communes.Preparer()
+	if code != SORTIE_OK {
+		return code
+	}
+
+	peripheriques := SonderPeripheriques(config.Cameras, config.Capture)
+	if *enJson {
+		json.NewEncoder(os.Stdout).Encode(peripheriques)
+	} else {
+		for _, p := range peripheriques {
+			if p.Disponible {
+				fmt.Printf("camera %d : %dx%d, %.1f fps, backend %s\n", p.No, p.Largeur, p.Hauteur, p.Fps, p.Backend)
+			} else if len(config.Cameras) > 0 {
+				fmt.Printf("camera %d : indisponible (%s)\n", p.No, p.Erreur)
+			}
+		}
+	}
+	for _, p := range peripheriques {
+		if p.Disponible {
+			return SORTIE_OK
+		}
+	}
+	if !*enJson {
+		fmt.Println("aucune camera disponible")
+	}
+	return SORTIE_CONNEXION
+}
+
+func commandeEnroll(args []string) int {
+	options := nouvellesOptions("enroll", "-name nom -in photo.jpg | -name nom -remove [options]",
+		"enrole le visage d'un employé consentant dans la liste blanche (allowlist.file) avec le modele allowlist.model :\nla photo doit contenir un seul visage. -remove retire toutes les empreintes du nom, a faire des que le consentement est retiré.")
+	nom := options.String("name", "", "nom de la personne")
+	entree := options.String("in", "", "photo de la personne, un seul visage")
+	retirer := options.Bool("remove", false, "retire la personne de la liste")
+	communes := optionsCommunes(options)
+	if err := options.Parse(args); err != nil {
+		return codeAnalyse(err)
+	}
+	if *nom == "" || (*entree != "") == *retirer {
+		fmt.Fprintln(os.Stderr, "-name est obligatoire, avec -in ou -remove")
+		options.Usage()
+		return SORTIE_CONFIGURATION
+	}
+	config, code := communes.Preparer()
+	if code != SORTIE_OK {
+		return code
+	}
+	params := config.ListeBlanche
+	if err := params.Valider(); err != nil {
+		slog.Error("configuration de la liste blanche invalide", "erreur", err)
+		return SORTIE_CONFIGURATION
+	}
+	liste, err := ChargerListeBlanche(params.Fichier)
+	if err != nil {
+		slog.Error("liste blanche illisible", "erreur", err)
+		return SORTIE_CONFIGURATION
+	}
+
+	if *retirer {
+		gardees := liste.Personnes[:0]
+		for _, personne := range liste.Personnes {
+			if personne.Nom != *nom {
+				gardees = append(gardees, personne)
+			}
+		}
+		retirees := len(liste.Personnes) - len(gardees)
+		liste.Personnes = gardees
+		if err := liste.Ecrire(params.Fichier); err != nil {
+			slog.Error("ecriture de la liste blanche impossible", "fichier", params.Fichier, "erreur", err)
+			return SORTIE_TRAITEMENT
+		}
+		fmt.Println(retirees, "empreinte(s) de", *nom, "retirée(s) de", params.Fichier)
+		return SORTIE_OK
+	}
+
+	if len(liste.Personnes) > 0 && liste.Modele != filepath.Base(params.Modele) {
+		slog.Error("la liste a ete enrolée avec un autre modele, les empreintes ne sont pas comparables", "liste", liste.Modele, "modele", params.Modele)
+		return SORTIE_CONFIGURATION
+	}
+	reconnaissance, err := ChargerReconnaissance(params)
+	if err != nil {
+		slog.Error("modele de reconnaissance inutilisable", "erreur", err)
+		return SORTIE_CONFIGURATION
+	}
+	defer reconnaissance.Fermer()
+	detection, err := NouvelleDetectionVisages(0)
+	if err != nil {
+		slog.Error("detecteur de visages inutilisable", "erreur", err)
+		return SORTIE_CONFIGURATION
+	}
+	defer detection.Fermer()
+
+	img := gocv.IMRead(*entree, gocv.IMReadColor)
+	if img.Empty() {
+		slog.Error("image illisible", "fichier", *entree)
+		return SORTIE_TRAITEMENT
+	}
+	defer img.Close()
+	trame := Trame{Image: Image{Mat: img}}
+	detection.Traiter(&trame)
+	if len(trame.Detections) != 1 { //on ne devine pas quel visage est celui de la personne
+		slog.Error("la photo doit contenir exactement un visage", "fichier", *entree, "visages", len(trame.Detections))
+		return SORTIE_TRAITEMENT
+	}
+	empreinte, err := reconnaissance.Empreinte(img, trame.Detections[0].Rect)
+	if err != nil {
+		slog.Error("empreinte impossible", "fichier", *entree, "erreur", err)
+		return SORTIE_TRAITEMENT
+	}
+
+	liste.Modele = filepath.Base(params.Modele)
+	liste.Personnes = append(liste.Personnes, PersonneEnrolee{Nom: *nom, Empreinte: empreinte, Date: time.Now().UTC()})
+	if err := liste.Ecrire(params.Fichier); err != nil {
+		slog.Error("ecriture de la liste blanche impossible", "fichier", params.Fichier, "erreur", err)
+		return SORTIE_TRAITEMENT
+	}
+	fmt.Println(*nom, "enrolé dans", params.Fichier)
+	return SORTIE_OK
+}
+
+// lit l'image et l'encode dans le codec negocié, comme une image de camera
+func lireImage(fichier string) ([]byte, int) {
+	img := gocv.IMRead(fichier, gocv.IMReadColor)
+	if img.Empty() {
+		slog.Error("image illisible", "fichier", fichier)
+		return nil, SORTIE_TRAITEMENT
+	}
+	defer img.Close()
+	img_bytes, err := codecServeur.Encoder(img)
+	if err != nil {
+		slog.Error("erreur d'encodage de l'image", "fichier", fichier, "erreur", err)
+		return nil, SORTIE_TRAITEMENT
+	}
+	return img_bytes, SORTIE_OK
+}
+
+func commandeAnonymize(args []string) int {
+	options := nouvellesOptions("anonymize", "-in image.jpg -out image_floutee.jpg [options]",
+		"envoie l'image au serveur et ecrit l'image floutée qu'il renvoie.\nle format de l'image ecrite suit l'extension de -out.")
+	entree := options.String("in", "", "image a anonymiser")
+	sortie := options.String("out", "", "image anonymisée a ecrire")
+	communes := optionsCommunes(options)
+	if err := options.Parse(args); err != nil {
+		return codeAnalyse(err)
+	}
+	if *entree == "" || *sortie == "" {
+		fmt.Fprintln(os.Stderr, "-in et -out sont obligatoires")
+		options.Usage()
+		return SORTIE_CONFIGURATION
+	}
+	config, code := communes.Preparer()
+	if code != SORTIE_OK {
+		return code
+	}
+	connection, code := connexionServeur(config, "fichier "+filepath.Base(*entree))
+	if code != SORTIE_OK {
+		return code
+	}
+	defer connection.Close()
+	defer FinConnexion(connection)
+
+	img_bytes, code := lireImage(*entree)
+	if code != SORTIE_OK {
+		return code
+	}
+	if err := EnvoiImage(img_bytes, connection); err != nil {
+		slog.Error("erreur d'envoi de l'image", "erreur", err)
+		return SORTIE_CONNEXION
+	}
+	img_blured_bytes, err := ReceptionImage(connection)
+	if err != nil {
+		slog.Error("le serveur n'a pas renvoyé d'image floutée", "erreur", err)
+		return SORTIE_TRAITEMENT
+	}
+	img_blured, err := Decoder(img_blured_bytes, gocv.IMReadColor)
+	if err != nil {
+		slog.Error("image floutée illisible", "erreur", err)
+		return SORTIE_TRAITEMENT
+	}
+	defer img_blured.Close()
+	if ok := gocv.IMWrite(*sortie, img_blured); !ok {
+		slog.Error("ecriture de l'image impossible, verifier le dossier et l'extension", "fichier", *sortie)
+		return SORTIE_TRAITEMENT
+	}
+	fmt.Println("image anonymisée par", config.AdresseServeur, "dans", *sortie)
+	return SORTIE_OK
+}
+
+func commandeDetect(args []string) int {
+	options := nouvellesOptions("detect", "-in image.jpg [options]",
+		"envoie l'image au serveur et affiche sur la sortie standard le json des visages qu'il a detectés.")
+	entree := options.String("in", "", "image a analyser")
+	communes := optionsCommunes(options)
+	if err := options.Parse(args); err != nil {
+		return codeAnalyse(err)
+	}
+	if *entree == "" {
+		fmt.Fprintln(os.Stderr, "-in est obligatoire")
+		options.Usage()
+		return SORTIE_CONFIGURATION
+	}
+	config, code := communes.Preparer()
+	if code != SORTIE_OK {
+		return code
+	}
+	connection, code := connexionServeur(config, "fichier "+filepath.Base(*entree))
+	if code != SORTIE_OK {
+		return code
+	}
+	defer connection.Close()
+	defer FinConnexion(connection)
+
+	img_bytes, code := lireImage(*entree)
+	if code != SORTIE_OK {
+		return code
+	}
+	reponse, err := DemanderDetection(img_bytes, connection)
+	if err != nil {
+		slog.Error("erreur de detection par le serveur", "erreur", err)
+		return SORTIE_TRAITEMENT
+	}
+	fmt.Println(string(reponse))
+	return SORTIE_OK
+}
+
+// resultat de bench, affiché en texte ou en json
+type ResultatBench struct {
+	Image     string  `json:"image"`
+	Serveur   string  `json:"server"`
+	Images    int     `json:"frames"`
+	Octets    int     `json:"bytes_sent"`
+	Min       float64 `json:"min_ms"`
+	Moyenne   float64 `json:"mean_ms"`
+	P95       float64 `json:"p95_ms"`
+	Max       float64 `json:"max_ms"`
+	ParSecond float64 `json:"frames_per_second"`
+}
+
+func commandeBench(args []string) int {
+	options := nouvellesOptions("bench", "-in image.jpg [-n 50] [options]",
+		"envoie plusieurs fois la meme image au serveur et affiche la durée des allers retours (envoi, floutage, reception).")
+	entree := options.String("in", "", "image a envoyer")
+	nombre := options.Int("n", 50, "nombre d'allers retours")
+	enJson := options.Bool("json", false, "resultat en json")
+	communes := optionsCommunes(options)
+	if err := options.Parse(args); err != nil {
+		return codeAnalyse(err)
+	}
+	if *entree == "" {
+		fmt.Fprintln(os.Stderr, "-in est obligatoire")
+		options.Usage()
+		return SORTIE_CONFIGURATION
+	}
+	if *nombre < 1 {
+		fmt.Fprintln(os.Stderr, "-n doit etre positif")
+		return SORTIE_CONFIGURATION
+	}
+	config, code := communes.Preparer()
+	if code != SORTIE_OK {
+		return code
+	}
+	connection, code := connexionServeur(config, "bench "+filepath.Base(*entree))
+	if code != SORTIE_OK {
+		return code
+	}
+	defer connection.Close()
+	defer FinConnexion(connection)
+
+	img_bytes, code := lireImage(*entree)
+	if code != SORTIE_OK {
+		return code
+	}
+	resultat := ResultatBench{Image: *entree, Serveur: config.AdresseServeur, Images: *nombre, Octets: len(img_bytes)}
+
+	durees := make([]time.Duration, 0, *nombre)
+	debutBench := time.Now()
+	for i := 0; i < *nombre; i++ {
+		debut := time.Now()
+		if err := EnvoiImage(img_bytes, connection); err != nil {
+			slog.Error("erreur d'envoi de l'image", "erreur", err)
+			return SORTIE_CONNEXION
+		}
+		if _, err := ReceptionImage(connection); err != nil {
+			slog.Error("le serveur n'a pas renvoyé d'image floutée", "erreur", err)
+			return SORTIE_TRAITEMENT
+		}
+		durees = append(durees, time.Since(debut))
+	}
+	total := time.Since(debutBench)
+
+	sort.Slice(durees, func(i, j int) bool { return durees[i] < durees[j] })
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	resultat.Min, resultat.Max = ms(durees[0]), ms(durees[len(durees)-1])
+	resultat.Moyenne = ms(total / time.Duration(len(durees)))
+	resultat.P95 = ms(durees[(len(durees)*95+99)/100-1])
+	resultat.ParSecond = float64(len(durees)) / total.Seconds()
+
+	if *enJson {
+		json.NewEncoder(os.Stdout).Encode(resultat)
+		return SORTIE_OK
+	}
+	fmt.Printf("%s : %d allers retours avec %s, %d octets envoyés en %s\n", filepath.Base(resultat.Image), resultat.Images, resultat.Serveur, resultat.Octets, codecServeur.Format)
+	fmt.Printf("min %.1f ms, moyenne %.1f ms, p95 %.1f ms, max %.1f ms, %.1f images/s\n", resultat.Min, resultat.Moyenne, resultat.P95, resultat.Max, resultat.ParSecond)
+	return SORTIE_OK
+}
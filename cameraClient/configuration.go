@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// configuration du client, lue au demarrage dans un fichier json (option -config)
+// chaque reglage peut etre surchargé par une variable d'environnement CAMERA_CLIENT_*, puis par une option de la ligne de commande
+// le pipeline, les zones, la politique de confidentialité et le floutage local, la detection, l'attente entre deux images et le debit du flux sont rechargés a chaud
+// sur SIGHUP ou quand le fichier change ; le serveur, les cameras, leurs reglages et les ports demandent un redemarrage
+
+const PREFIXE_ENV = "CAMERA_CLIENT_"
+const INTERVALLE_SURVEILLANCE = 2 * time.Second //verification de la date de modification du fichier
+
+const FICHIER_CASCADE = "C:\\opencv\\haar-cascade-files-master\\haarcascade_frontalface_default.xml" //modele de reconnaissance du floutage local
+const TAILLE_CARRE_DEFAUT = 64                                                                       //taille des carrés de la pixelisation locale
+const ATTENTE_TOUCHE = 10 * time.Millisecond                                                         //affichage de chaque image et attente d'une touche dans la fenetre, ne ralentit pas la capture
+
+var CAMERAS = []int{} //vide pour toutes les cameras disponibles, la premiere lancée envoie les screenshots et les detections
+
+// parametres de DetectMultiScale, les valeurs par defaut sont celles d'opencv
+type ParametresDetection struct {
+	FacteurEchelle float64 `json:"scale_factor"`  //agrandissement entre deux passes, > 1
+	VoisinsMin     int     `json:"min_neighbors"` //detections voisines necessaires pour garder un visage, plus haut = moins de fausses detections
+	TailleMin      int     `json:"min_size"`      //taille minimale d'un visage en pixels, 0 pour aucune
+}
+
+var DETECTION_DEFAUT = ParametresDetection{FacteurEchelle: 1.1, VoisinsMin: 3}
+
+type Configuration struct {
+	//structurels, lus au demarrage seulement
+	AdresseServeur string                 `json:"server_address"`
+	TailleBuffer   int64                  `json:"buffer_size"` //taille des paquets de la socket
+	FichierCascade string                 `json:"cascade_file"`
+	Cameras        []int                  `json:"cameras"`    //vide pour toutes les cameras disponibles
+	Capture        ParametresCapture      `json:"capture"`    //appliqués a l'ouverture de chaque camera
+	Pipeline       []string               `json:"pipeline"`   //etapes du floutage local, dans l'ordre ; rechargé a chaud
+	Zones          map[string]ZonesCamera `json:"zones"`      //par numero de camera, rechargées a chaud
+	Securite       ParametresSecurite     `json:"privacy"`    //politique fail_closed ou fail_open, rechargée a chaud
+	ListeBlanche   ParametresListeBlanche `json:"allowlist"`  //etape allowlist, le modele et le fichier sont lus a la construction du pipeline
+	Plaques        ParametresPlaques      `json:"plates"`     //etape plates, le modele est lu a la construction du pipeline
+	Personnes      ParametresPersonnes    `json:"persons"`    //etape persons, mode par camera rechargé a chaud
+	HoteMjpeg      string                 `json:"mjpeg_host"` //interface de la diffusion, vide pour toutes
+	PortMjpeg      string                 `json:"mjpeg_port"`
+	Codec          DemandeCodec           `json:"codec"` //negocié a chaque connexion, un rechargement vaut pour les sessions de flux suivantes
+
+	//rechargés a chaud
+	TailleCarre   int                 `json:"block_size"`
+	AttenteTouche Duree               `json:"frame_delay"`
+	FpsFlux       int                 `json:"stream_fps"`
+	Detection     ParametresDetection `json:"detection"`
+}
+
+var CONFIGURATION_DEFAUT = Configuration{
+	AdresseServeur: ADRESSE_SERVEUR,
+	TailleBuffer:   BUFFERSIZE,
+	FichierCascade: FICHIER_CASCADE,
+	Cameras:        CAMERAS,
+	Pipeline:       PIPELINE,
+	Securite:       SECURITE_DEFAUT,
+	ListeBlanche:   LISTE_BLANCHE_DEFAUT,
+	Plaques:        PLAQUES_DEFAUT,
+	Personnes:      PERSONNES_DEFAUT,
+	PortMjpeg:      PORT_MJPEG,
+	Codec:          DEMANDE_CODEC_DEFAUT,
+	TailleCarre:    TAILLE_CARRE_DEFAUT,
+	AttenteTouche:  Duree(ATTENTE_TOUCHE),
+	FpsFlux:        FPS_FLUX,
+	Detection:      DETECTION_DEFAUT,
+}
+
+var configuration atomic.Pointer[Configuration] //remplacée en bloc au rechargement, jamais modifiée
+
+var surchargesCommande = func(*Configuration) {} //options de la ligne de commande, reappliquées a chaque rechargement
+
+// configuration en cours, a relire a chaque image pour suivre les rechargements
+func ConfigActuelle() *Configuration {
+	if c := configuration.Load(); c != nil {
+		return c
+	}
+	defaut := CONFIGURATION_DEFAUT
+	return &defaut
+}
+
+// durée ecrite "30s" ou "5m" dans le json
+type Duree time.Duration
+
+func (d Duree) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duree) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duree) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durée attendue sous la forme \"30s\" ou \"5m\": %w", err)
+	}
+	duree, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duree(duree)
+	return nil
+}
+
+// verifie tous les reglages
+func (c *Configuration) Valider() error {
+	var erreurs []error
+	if _, port, err := net.SplitHostPort(c.AdresseServeur); err != nil || port == "" {
+		erreurs = append(erreurs, fmt.Errorf("server_address: adresse invalide %q, attendu hote:port", c.AdresseServeur))
+	}
+	if n, err := strconv.Atoi(c.PortMjpeg); err != nil || n < 1 || n > 65535 {
+		erreurs = append(erreurs, fmt.Errorf("mjpeg_port: port invalide %q", c.PortMjpeg))
+	}
+	if c.TailleBuffer < 1 {
+		erreurs = append(erreurs, fmt.Errorf("buffer_size: %d doit etre positif", c.TailleBuffer))
+	}
+	if c.FichierCascade == "" {
+		erreurs = append(erreurs, errors.New("cascade_file: fichier vide"))
+	}
+	vues := map[int]bool{}
+	for _, no := range c.Cameras {
+		if no < 0 || vues[no] {
+			erreurs = append(erreurs, fmt.Errorf("cameras: numero %d negatif ou en double", no))
+		}
+		vues[no] = true
+	}
+	anonymise, zones, listeBlanche, plaques, personnes := false, false, false, false, false
+	for _, nom := range c.Pipeline {
+		if _, ok := ETAPES[nom]; !ok {
+			erreurs = append(erreurs, fmt.Errorf("pipeline: etape inconnue %q, etapes possibles : %s", nom, strings.Join(nomsEtapes(), ", ")))
+		}
+		anonymise = anonymise || nom == "anonymize"
+		zones = zones || nom == "zones"
+		listeBlanche = listeBlanche || nom == "allowlist"
+		plaques = plaques || nom == "plates"
+		personnes = personnes || nom == "persons"
+	}
+	if err := c.Personnes.Valider(); err != nil {
+		erreurs = append(erreurs, fmt.Errorf("persons: %w", err))
+	}
+	if c.Personnes.Actives() && !personnes { //une camera qui doit cacher les personnes ne doit pas les diffuser sans le dire
+		erreurs = append(erreurs, errors.New("pipeline: l'etape persons est obligatoire quand persons.mode ou camera_modes n'est pas off"))
+	}
+	if plaques {
+		if err := c.Plaques.Valider(); err != nil {
+			erreurs = append(erreurs, fmt.Errorf("plates: %w", err))
+		}
+	}
+	if listeBlanche {
+		if err := c.ListeBlanche.Valider(); err != nil {
+			erreurs = append(erreurs, fmt.Errorf("allowlist: %w", err))
+		}
+	}
+	if len(c.Zones) > 0 && !zones { //les zones always_anonymize ne doivent pas etre ignorées sans le dire
+		erreurs = append(erreurs, errors.New("pipeline: l'etape zones est obligatoire quand des zones sont configurées"))
+	}
+	if !anonymise {
+		erreurs = append(erreurs, errors.New("pipeline: l'etape anonymize est obligatoire"))
+	}
+	if err := c.Securite.Valider(); err != nil {
+		erreurs = append(erreurs, fmt.Errorf("privacy: %w", err))
+	}
+	for camera, zones := range c.Zones {
+		if no, err := strconv.Atoi(camera); err != nil || no < 0 {
+			erreurs = append(erreurs, fmt.Errorf("zones: %q n'est pas un numero de camera", camera))
+		}
+		if err := zones.Valider(); err != nil {
+			erreurs = append(erreurs, fmt.Errorf("zones.%s: %w", camera, err))
+		}
+	}
+	if err := c.Codec.Valider(); err != nil {
+		erreurs = append(erreurs, fmt.Errorf("codec: %w", err))
+	}
+	if c.Capture.Largeur < 0 || c.Capture.Hauteur < 0 || c.Capture.Fps < 0 {
+		erreurs = append(erreurs, fmt.Errorf("capture: largeur %d, hauteur %d ou fps %g negatif", c.Capture.Largeur, c.Capture.Hauteur, c.Capture.Fps))
+	}
+	if c.TailleCarre < 2 || c.TailleCarre > 256 { //au dela la somme des pixels d'un carré deborde dans blurMaison
+		erreurs = append(erreurs, fmt.Errorf("block_size: %d hors de [2, 256]", c.TailleCarre))
+	}
+	if c.AttenteTouche < Duree(time.Millisecond) {
+		erreurs = append(erreurs, fmt.Errorf("frame_delay: %s inferieur a 1ms", c.AttenteTouche.Duration()))
+	}
+	if c.FpsFlux < 1 {
+		erreurs = append(erreurs, fmt.Errorf("stream_fps: %d doit etre positif", c.FpsFlux))
+	}
+	if c.Detection.FacteurEchelle <= 1 {
+		erreurs = append(erreurs, fmt.Errorf("detection.scale_factor: %g doit etre superieur a 1", c.Detection.FacteurEchelle))
+	}
+	if c.Detection.VoisinsMin < 0 {
+		erreurs = append(erreurs, fmt.Errorf("detection.min_neighbors: %d negatif", c.Detection.VoisinsMin))
+	}
+	if c.Detection.TailleMin < 0 {
+		erreurs = append(erreurs, fmt.Errorf("detection.min_size: %d negatif", c.Detection.TailleMin))
+	}
+	return errors.Join(erreurs...)
+}
+
+// valeurs par defaut, puis fichier (si chemin n'est pas vide), puis variables d'environnement, puis options
+// les champs absents du fichier gardent leur valeur par defaut, les champs inconnus sont refusés
+func ChargerConfiguration(chemin string) (*Configuration, error) {
+	config := CONFIGURATION_DEFAUT
+	config.Cameras = append([]int(nil), CAMERAS...) //le json ne doit pas ecrire dans CAMERAS
+	config.Pipeline = append([]string(nil), PIPELINE...)
+	config.Codec.Formats = append([]string(nil), DEMANDE_CODEC_DEFAUT.Formats...)
+	if chemin != "" {
+		contenu, err := os.ReadFile(chemin)
+		if err != nil {
+			return nil, err
+		}
+		decodeur := json.NewDecoder(bytes.NewReader(contenu))
+		decodeur.DisallowUnknownFields()
+		if err := decodeur.Decode(&config); err != nil {
+			return nil, fmt.Errorf("%s: %w", chemin, err)
+		}
+	}
+	if err := config.surchargesEnvironnement(); err != nil {
+		return nil, err
+	}
+	surchargesCommande(&config)
+	if err := config.Valider(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// CAMERA_CLIENT_SERVER_ADDRESS, CAMERA_CLIENT_CAMERAS=0,2... une valeur illisible est une erreur plutot qu'ignorée
+func (c *Configuration) surchargesEnvironnement() error {
+	var erreurs []error
+	envChaine(&c.AdresseServeur, "SERVER_ADDRESS")
+	erreurs = append(erreurs, envEntier64(&c.TailleBuffer, "BUFFER_SIZE"))
+	envChaine(&c.FichierCascade, "CASCADE_FILE")
+	erreurs = append(erreurs, envListeEntiers(&c.Cameras, "CAMERAS"))
+	envListeChaines(&c.Pipeline, "PIPELINE")
+	envChaine(&c.ListeBlanche.Modele, "ALLOWLIST_MODEL")
+	envChaine(&c.ListeBlanche.Fichier, "ALLOWLIST_FILE")
+	erreurs = append(erreurs, envReel(&c.ListeBlanche.Seuil, "ALLOWLIST_THRESHOLD"))
+	envChaine(&c.Plaques.FichierCascade, "PLATE_CASCADE_FILE")
+	envChaine(&c.Plaques.Methode, "PLATE_METHOD")
+	erreurs = append(erreurs, envEntier(&c.Plaques.TailleCarre, "PLATE_BLOCK_SIZE"))
+	envChaine(&c.Personnes.Mode, "PERSONS_MODE")
+	envChaine(&c.Securite.Politique, "PRIVACY_POLICY")
+	envChaine(&c.Securite.Repli, "PRIVACY_FALLBACK")
+	erreurs = append(erreurs, envReel(&c.Securite.LuminositeMin, "MIN_BRIGHTNESS"))
+	erreurs = append(erreurs, envReel(&c.Securite.NetteteMin, "MIN_SHARPNESS"))
+	erreurs = append(erreurs, envDuree(&c.Securite.DelaiMax, "DEADLINE"))
+	erreurs = append(erreurs, envEntier(&c.Capture.Largeur, "CAPTURE_WIDTH"))
+	erreurs = append(erreurs, envEntier(&c.Capture.Hauteur, "CAPTURE_HEIGHT"))
+	erreurs = append(erreurs, envReel(&c.Capture.Fps, "CAPTURE_FPS"))
+	envChaine(&c.HoteMjpeg, "MJPEG_HOST")
+	envChaine(&c.PortMjpeg, "MJPEG_PORT")
+	envListeChaines(&c.Codec.Formats, "CODECS")
+	erreurs = append(erreurs, envEntier(&c.Codec.Qualite, "QUALITY"))
+	erreurs = append(erreurs, envEntier(&c.Codec.LargeurMax, "MAX_WIDTH"))
+	erreurs = append(erreurs, envEntier(&c.TailleCarre, "BLOCK_SIZE"))
+	erreurs = append(erreurs, envDuree(&c.AttenteTouche, "FRAME_DELAY"))
+	erreurs = append(erreurs, envEntier(&c.FpsFlux, "STREAM_FPS"))
+	erreurs = append(erreurs, envReel(&c.Detection.FacteurEchelle, "SCALE_FACTOR"))
+	erreurs = append(erreurs, envEntier(&c.Detection.VoisinsMin, "MIN_NEIGHBORS"))
+	erreurs = append(erreurs, envEntier(&c.Detection.TailleMin, "MIN_SIZE"))
+	return errors.Join(erreurs...)
+}
+
+func envChaine(valeur *string, nom string) {
+	if v, ok := os.LookupEnv(PREFIXE_ENV + nom); ok {
+		*valeur = v
+	}
+}
+
+func envEntier(valeur *int, nom string) error {
+	v, ok := os.LookupEnv(PREFIXE_ENV + nom)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("%s%s: entier attendu: %w", PREFIXE_ENV, nom, err)
+	}
+	*valeur = n
+	return nil
+}
+
+func envEntier64(valeur *int64, nom string) error {
+	n := int(*valeur)
+	if err := envEntier(&n, nom); err != nil {
+		return err
+	}
+	*valeur = int64(n)
+	return nil
+}
+
+func envReel(valeur *float64, nom string) error {
+	v, ok := os.LookupEnv(PREFIXE_ENV + nom)
+	if !ok {
+		return nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fmt.Errorf("%s%s: nombre attendu: %w", PREFIXE_ENV, nom, err)
+	}
+	*valeur = f
+	return nil
+}
+
+func envDuree(valeur *Duree, nom string) error {
+	v, ok := os.LookupEnv(PREFIXE_ENV + nom)
+	if !ok {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("%s%s: durée attendue: %w", PREFIXE_ENV, nom, err)
+	}
+	*valeur = Duree(d)
+	return nil
+}
+
+// liste de noms separés par des virgules
+func envListeChaines(valeur *[]string, nom string) {
+	if v, ok := os.LookupEnv(PREFIXE_ENV + nom); ok {
+		*valeur = decouperListe(v)
+	}
+}
+
+func decouperListe(v string) []string {
+	liste := []string{}
+	for _, morceau := range strings.Split(v, ",") {
+		if morceau = strings.TrimSpace(morceau); morceau != "" {
+			liste = append(liste, morceau)
+		}
+	}
+	return liste
+}
+
+// liste de numeros separés par des virgules, vide ou "auto" pour une liste vide
+func envListeEntiers(valeur *[]int, nom string) error {
+	v, ok := os.LookupEnv(PREFIXE_ENV + nom)
+	if !ok {
+		return nil
+	}
+	liste := []int{}
+	if v == "" || v == "auto" {
+		*valeur = liste
+		return nil
+	}
+	for _, morceau := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(morceau))
+		if err != nil {
+			return fmt.Errorf("%s%s: liste d'entiers attendue: %w", PREFIXE_ENV, nom, err)
+		}
+		liste = append(liste, n)
+	}
+	*valeur = liste
+	return nil
+}
+
+// declare une option par reglage, avec la valeur par defaut de la configuration
+// la fonction renvoyée applique seulement les options données sur la ligne de commande
+func optionsConfiguration(options *flag.FlagSet) func(*Configuration) {
+	defaut := CONFIGURATION_DEFAUT
+	adresseServeur := options.String("server", defaut.AdresseServeur, "adresse hote:port du serveur")
+	tailleBuffer := options.Int64("buffer-size", defaut.TailleBuffer, "taille des paquets de la socket")
+	fichierCascade := options.String("cascade-file", defaut.FichierCascade, "modele de reconnaissance du floutage local")
+	cameras := options.String("cameras", "auto", "numeros des cameras separés par des virgules, ou auto pour toutes les cameras disponibles ; la premiere envoie les screenshots")
+	pipeline := options.String("pipeline", strings.Join(defaut.Pipeline, ","), "etapes du floutage local separées par des virgules, parmi "+strings.Join(nomsEtapes(), ", "))
+	modeleListe := options.String("allowlist-model", defaut.ListeBlanche.Modele, "modele onnx de reconnaissance des visages de l'etape allowlist")
+	fichierListe := options.String("allowlist-file", defaut.ListeBlanche.Fichier, "liste blanche des visages enrolés avec la commande enroll")
+	seuilListe := options.Float64("allowlist-threshold", defaut.ListeBlanche.Seuil, "similarité minimale pour ne pas anonymiser un visage de la liste blanche")
+	cascadePlaques := options.String("plate-cascade-file", defaut.Plaques.FichierCascade, "modele de reconnaissance des plaques de l'etape plates")
+	methodePlaques := options.String("plate-method", defaut.Plaques.Methode, "anonymisation des plaques : pixelate ou black")
+	tailleCarrePlaques := options.Int("plate-block-size", defaut.Plaques.TailleCarre, "taille des carrés de la pixelisation des plaques")
+	modePersonnes := options.String("persons-mode", defaut.Personnes.Mode, "anonymisation des personnes entieres de l'etape persons : off, pixelate, box ou silhouette")
+	politique := options.String("privacy-policy", defaut.Securite.Politique, "si le floutage local n'est pas fiable : fail_closed masque l'image entiere, fail_open la garde")
+	repli := options.String("privacy-fallback", defaut.Securite.Repli, "masquage de l'image en fail_closed : pixelate ou black")
+	luminositeMin := options.Float64("min-brightness", defaut.Securite.LuminositeMin, "luminosité moyenne minimale (0 a 255) pour un floutage fiable, 0 pour ne pas verifier")
+	netteteMin := options.Float64("min-sharpness", defaut.Securite.NetteteMin, "variance du laplacien minimale pour un floutage fiable, 0 pour ne pas verifier")
+	delaiMax := options.Duration("deadline", defaut.Securite.DelaiMax.Duration(), "delai maximal entre la capture et la fin du floutage local, 0 pour ne pas verifier")
+	largeurCapture := options.Int("capture-width", defaut.Capture.Largeur, "largeur demandée aux cameras, 0 pour celle de la camera")
+	hauteurCapture := options.Int("capture-height", defaut.Capture.Hauteur, "hauteur demandée aux cameras, 0 pour celle de la camera")
+	fpsCapture := options.Float64("capture-fps", defaut.Capture.Fps, "images par seconde demandées aux cameras, 0 pour celles de la camera")
+	hoteMjpeg := options.String("mjpeg-host", defaut.HoteMjpeg, "interface de la diffusion des cameras floutées, vide pour toutes, localhost pour le poste seul")
+	portMjpeg := options.String("mjpeg-port", defaut.PortMjpeg, "port de la diffusion des cameras floutées")
+	codecs := options.String("codecs", strings.Join(defaut.Codec.Formats, ","), "formats des images envoyées au serveur par ordre de preference, parmi jpg, png et webp")
+	qualite := options.Int("quality", defaut.Codec.Qualite, "qualité jpg ou webp des images envoyées au serveur, de 1 a 100")
+	largeurMax := options.Int("max-width", defaut.Codec.LargeurMax, "largeur au dela de laquelle les images envoyées au serveur sont reduites, 0 pour ne jamais reduire")
+	tailleCarre := options.Int("block-size", defaut.TailleCarre, "taille des carrés de la pixelisation locale")
+	attenteTouche := options.Duration("frame-delay", defaut.AttenteTouche.Duration(), "affichage de chaque image et attente d'une touche")
+	fpsFlux := options.Int("stream-fps", defaut.FpsFlux, "images par seconde envoyées au serveur en flux")
+	facteurEchelle := options.Float64("scale-factor", defaut.Detection.FacteurEchelle, "agrandissement entre deux passes de la detection")
+	voisinsMin := options.Int("min-neighbors", defaut.Detection.VoisinsMin, "detections voisines necessaires pour garder un visage")
+	tailleMin := options.Int("min-size", defaut.Detection.TailleMin, "taille minimale d'un visage en pixels")
+
+	return func(c *Configuration) {
+		options.Visit(func(option *flag.Flag) {
+			switch option.Name {
+			case "server":
+				c.AdresseServeur = *adresseServeur
+			case "buffer-size":
+				c.TailleBuffer = *tailleBuffer
+			case "cascade-file":
+				c.FichierCascade = *fichierCascade
+			case "cameras":
+				c.Cameras = []int{}
+				if *cameras == "" || *cameras == "auto" {
+					break
+				}
+				for _, morceau := range strings.Split(*cameras, ",") {
+					no, err := strconv.Atoi(strings.TrimSpace(morceau))
+					if err != nil {
+						no = -1 //refusé par Valider
+					}
+					c.Cameras = append(c.Cameras, no)
+				}
+			case "pipeline":
+				c.Pipeline = decouperListe(*pipeline)
+			case "allowlist-model":
+				c.ListeBlanche.Modele = *modeleListe
+			case "allowlist-file":
+				c.ListeBlanche.Fichier = *fichierListe
+			case "allowlist-threshold":
+				c.ListeBlanche.Seuil = *seuilListe
+			case "plate-cascade-file":
+				c.Plaques.FichierCascade = *cascadePlaques
+			case "plate-method":
+				c.Plaques.Methode = *methodePlaques
+			case "plate-block-size":
+				c.Plaques.TailleCarre = *tailleCarrePlaques
+			case "persons-mode":
+				c.Personnes.Mode = *modePersonnes
+			case "privacy-policy":
+				c.Securite.Politique = *politique
+			case "privacy-fallback":
+				c.Securite.Repli = *repli
+			case "min-brightness":
+				c.Securite.LuminositeMin = *luminositeMin
+			case "min-sharpness":
+				c.Securite.NetteteMin = *netteteMin
+			case "deadline":
+				c.Securite.DelaiMax = Duree(*delaiMax)
+			case "capture-width":
+				c.Capture.Largeur = *largeurCapture
+			case "capture-height":
+				c.Capture.Hauteur = *hauteurCapture
+			case "capture-fps":
+				c.Capture.Fps = *fpsCapture
+			case "mjpeg-host":
+				c.HoteMjpeg = *hoteMjpeg
+			case "mjpeg-port":
+				c.PortMjpeg = *portMjpeg
+			case "codecs":
+				c.Codec.Formats = decouperListe(*codecs)
+			case "quality":
+				c.Codec.Qualite = *qualite
+			case "max-width":
+				c.Codec.LargeurMax = *largeurMax
+			case "block-size":
+				c.TailleCarre = *tailleCarre
+			case "frame-delay":
+				c.AttenteTouche = Duree(*attenteTouche)
+			case "stream-fps":
+				c.FpsFlux = *fpsFlux
+			case "scale-factor":
+				c.Detection.FacteurEchelle = *facteurEchelle
+			case "min-neighbors":
+				c.Detection.VoisinsMin = *voisinsMin
+			case "min-size":
+				c.Detection.TailleMin = *tailleMin
+			}
+		})
+	}
+}
+
+// remet les reglages structurels de la configuration en cours et renvoie ceux qui avaient changé
+func (c *Configuration) garderStructure(actuelle *Configuration) []string {
+	var ignores []string
+	if c.AdresseServeur != actuelle.AdresseServeur {
+		ignores = append(ignores, "server_address")
+	}
+	if c.TailleBuffer != actuelle.TailleBuffer {
+		ignores = append(ignores, "buffer_size")
+	}
+	if c.FichierCascade != actuelle.FichierCascade {
+		ignores = append(ignores, "cascade_file")
+	}
+	if fmt.Sprint(c.Cameras) != fmt.Sprint(actuelle.Cameras) {
+		ignores = append(ignores, "cameras")
+	}
+	if c.Capture != actuelle.Capture {
+		ignores = append(ignores, "capture")
+	}
+	if c.HoteMjpeg != actuelle.HoteMjpeg {
+		ignores = append(ignores, "mjpeg_host")
+	}
+	if c.PortMjpeg != actuelle.PortMjpeg {
+		ignores = append(ignores, "mjpeg_port")
+	}
+	c.AdresseServeur, c.TailleBuffer, c.FichierCascade, c.Cameras, c.PortMjpeg = actuelle.AdresseServeur, actuelle.TailleBuffer, actuelle.FichierCascade, actuelle.Cameras, actuelle.PortMjpeg
+	c.HoteMjpeg = actuelle.HoteMjpeg
+	c.Capture = actuelle.Capture
+	return ignores
+}
+
+// recharge la configuration sur SIGHUP ou quand le fichier est modifié, jusqu'a l'annulation de ctx
+// une configuration invalide est refusée et la precedente reste en place
+func SurveillerConfiguration(ctx context.Context, chemin string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP) //n'arrive jamais sous windows, la surveillance du fichier suffit
+	defer signal.Stop(hup)
+
+	modification := dateModification(chemin)
+	ticker := time.NewTicker(INTERVALLE_SURVEILLANCE)
+	defer ticker.Stop()
+
+	for {
+		raison := "SIGHUP"
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-ticker.C:
+			date := dateModification(chemin)
+			if date.Equal(modification) {
+				continue
+			}
+			modification = date
+			raison = "fichier modifié"
+		}
+		rechargerConfiguration(chemin, raison)
+	}
+}
+
+func rechargerConfiguration(chemin, raison string) {
+	nouvelle, err := ChargerConfiguration(chemin)
+	if err != nil {
+		slog.Error("configuration invalide, la precedente est conservée", "fichier", chemin, "raison", raison, "erreur", err)
+		return
+	}
+	if ignores := nouvelle.garderStructure(ConfigActuelle()); len(ignores) > 0 {
+		slog.Warn("reglages ignorés jusqu'au prochain redemarrage", "reglages", ignores)
+	}
+	configuration.Store(nouvelle)
+	slog.Info("configuration rechargée", "fichier", chemin, "raison", raison,
+		"taille_carre", nouvelle.TailleCarre, "attente_touche", nouvelle.AttenteTouche.Duration(), "fps_flux", nouvelle.FpsFlux, "pipeline", nouvelle.Pipeline)
+}
+
+// date nulle si le fichier est illisible, sa reapparition sera vue comme une modification
+func dateModification(chemin string) time.Time {
+	info, err := os.Stat(chemin)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
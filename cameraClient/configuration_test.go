@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfigurationCodec(t *testing.T) {
+	cas := []struct {
+		nom     string
+		env     map[string]string
+		formats []string
+		qualite int
+		largeur int
+		erreur  string //debut du message attendu, vide si la configuration est valide
+	}{
+		{"par defaut", nil, DEMANDE_CODEC_DEFAUT.Formats, DEMANDE_CODEC_DEFAUT.Qualite, DEMANDE_CODEC_DEFAUT.LargeurMax, ""},
+		{"surcharges", map[string]string{"CODECS": "png, jpg", "QUALITY": "60", "MAX_WIDTH": "640"}, []string{"png", "jpg"}, 60, 640, ""},
+		{"format inconnu", map[string]string{"CODECS": "gif"}, nil, 0, 0, "codec: codecs"},
+		{"aucun format", map[string]string{"CODECS": ""}, nil, 0, 0, "codec: codecs"},
+		{"qualité hors limites", map[string]string{"QUALITY": "0"}, nil, 0, 0, "codec: quality"},
+		{"largeur negative", map[string]string{"MAX_WIDTH": "-1"}, nil, 0, 0, "codec: max_width"},
+		{"qualité illisible", map[string]string{"QUALITY": "haute"}, nil, 0, 0, PREFIXE_ENV + "QUALITY"},
+	}
+	for _, c := range cas {
+		t.Run(c.nom, func(t *testing.T) {
+			for nom, valeur := range c.env {
+				t.Setenv(PREFIXE_ENV+nom, valeur)
+			}
+			config, err := ChargerConfiguration("")
+			if c.erreur != "" {
+				if err == nil || !strings.Contains(err.Error(), c.erreur) {
+					t.Fatalf("erreur %v, attendu %q", err, c.erreur)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(config.Codec.Formats, ",") != strings.Join(c.formats, ",") || config.Codec.Qualite != c.qualite || config.Codec.LargeurMax != c.largeur {
+				t.Errorf("codec %+v, attendu %v qualité %d largeur %d", config.Codec, c.formats, c.qualite, c.largeur)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"html/template" //page d'index
+	"log/slog"      //trace
+	"net"
+	"net/http" //diffusion http
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+const PORT_MJPEG = "27003"              //port de la diffusion des cameras floutées sur le reseau local
+const FRONTIERE_MJPEG = "imagesuivante" //separateur des images dans le flux multipart
+
+// flux mjpeg d'une camera, chaque spectateur recoit la derniere image publiée
+// un spectateur trop lent perd des images au lieu de ralentir la camera
+type FluxMjpeg struct {
+	mu          sync.Mutex
+	spectateurs map[chan []byte]struct{}
+	fin         chan struct{} //fermé quand la camera s'arrete, les spectateurs sont deconnectés
+}
+
+func (flux *FluxMjpeg) Spectateurs() int {
+	flux.mu.Lock()
+	defer flux.mu.Unlock()
+	return len(flux.spectateurs)
+}
+
+// encode img en jpg et l'envoie a tous les spectateurs, img doit deja etre floutée
+// renvoie le jpg diffusé pour le sidecar, nil si l'encodage a echoué
+func (flux *FluxMjpeg) Publier(img gocv.Mat) []byte {
+	img_jpg, err := gocv.IMEncode(".jpg", img)
+	if err != nil {
+		slog.Error("erreur d'encodage pour la diffusion", "erreur", err)
+		return nil
+	}
+	jpg := append([]byte(nil), img_jpg.GetBytes()...) //copie car le buffer natif est libéré par Close
+	img_jpg.Close()
+
+	flux.mu.Lock()
+	defer flux.mu.Unlock()
+	for spectateur := range flux.spectateurs {
+		select {
+		case spectateur <- jpg:
+		default: //le spectateur n'a pas fini l'image precedente
+		}
+	}
+	return jpg
+}
+
+func (flux *FluxMjpeg) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	spectateur := make(chan []byte, 1)
+	flux.mu.Lock()
+	flux.spectateurs[spectateur] = struct{}{}
+	flux.mu.Unlock()
+	defer func() {
+		flux.mu.Lock()
+		delete(flux.spectateurs, spectateur)
+		flux.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+FRONTIERE_MJPEG)
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+
+	for {
+		select {
+		case <-r.Context().Done(): //le spectateur a fermé la page
+			return
+		case <-flux.fin:
+			return
+		case jpg := <-spectateur:
+			fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", FRONTIERE_MJPEG, len(jpg))
+			if _, err := w.Write(jpg); err != nil {
+				return
+			}
+			fmt.Fprint(w, "\r\n")
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// ensemble des cameras diffusées, une page d'index les liste
+type DiffusionCameras struct {
+	mu   sync.Mutex
+	flux map[int]*FluxMjpeg
+}
+
+var diffusion = &DiffusionCameras{flux: map[int]*FluxMjpeg{}}
+
+func (d *DiffusionCameras) Ajouter(no_device int) *FluxMjpeg {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	flux := &FluxMjpeg{spectateurs: map[chan []byte]struct{}{}, fin: make(chan struct{})}
+	d.flux[no_device] = flux
+	return flux
+}
+
+// retire la camera de la page d'index et termine les diffusions en cours
+func (d *DiffusionCameras) Retirer(no_device int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if flux, ok := d.flux[no_device]; ok {
+		close(flux.fin)
+		delete(d.flux, no_device)
+	}
+}
+
+func (d *DiffusionCameras) cameras() []int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var nos []int
+	for no := range d.flux {
+		nos = append(nos, no)
+	}
+	sort.Ints(nos)
+	return nos
+}
+
+var pageIndex = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Cameras floutées</title></head>
+<body>
+<h1>Cameras floutées</h1>
+{{range .}}<h2>Camera n° {{.}}</h2>
+<img src="/camera/{{.}}" alt="camera {{.}}">
+{{else}}<p>Aucune camera en cours de lecture.</p>
+{{end}}</body>
+</html>
+`))
+
+// GET / liste les cameras, GET /camera/<no> diffuse la camera en mjpeg
+func (d *DiffusionCameras) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		pageIndex.Execute(w, d.cameras())
+		return
+	}
+
+	no_device, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/camera/"))
+	if !strings.HasPrefix(r.URL.Path, "/camera/") || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	d.mu.Lock()
+	flux, ok := d.flux[no_device]
+	d.mu.Unlock()
+	if !ok {
+		http.Error(w, "camera inconnue", http.StatusNotFound)
+		return
+	}
+	flux.ServeHTTP(w, r)
+}
+
+// lance la diffusion sur l'interface hote (toutes si vide, pour etre visible sur le reseau local)
+// avec metriques, /metrics est servi a coté des cameras
+func ServirDiffusion(hote string, port string, avecMetriques bool) {
+	var handler http.Handler = diffusion
+	if avecMetriques {
+		routes := http.NewServeMux()
+		routes.Handle("/", diffusion)
+		routes.HandleFunc("/metrics", ServirMetriques)
+		handler = routes
+	}
+	adresse := net.JoinHostPort(hote, port)
+	slog.Info("diffusion des cameras floutées", "adresse", adresse, "metriques", avecMetriques)
+	if err := http.ListenAndServe(adresse, handler); err != nil {
+		slog.Error("diffusion des cameras impossible", "adresse", adresse, "erreur", err)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// un spectateur connecté a une camera qui s'arrete est deconnecté au lieu d'attendre une image pour toujours
+func TestDiffusionRetirerCamera(t *testing.T) {
+	cameras := &DiffusionCameras{flux: map[int]*FluxMjpeg{}}
+	flux := cameras.Ajouter(3)
+
+	termine := make(chan struct{})
+	go func() {
+		cameras.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/camera/3", nil))
+		close(termine)
+	}()
+	for debut := time.Now(); flux.Spectateurs() == 0; time.Sleep(time.Millisecond) {
+		if time.Since(debut) > time.Second {
+			t.Fatal("le spectateur ne s'est pas connecté")
+		}
+	}
+
+	cameras.Retirer(3)
+	select {
+	case <-termine:
+	case <-time.After(time.Second):
+		t.Fatal("le spectateur est resté connecté a la camera retirée")
+	}
+	if flux.Spectateurs() != 0 {
+		t.Errorf("%d spectateurs encore enregistrés", flux.Spectateurs())
+	}
+	cameras.Retirer(3) //deja retirée, ne doit pas fermer fin une deuxieme fois
+
+	reponse := httptest.NewRecorder()
+	cameras.ServeHTTP(reponse, httptest.NewRequest(http.MethodGet, "/camera/3", nil))
+	if reponse.Code != http.StatusNotFound {
+		t.Errorf("statut %d pour une camera retirée, attendu 404", reponse.Code)
+	}
+}
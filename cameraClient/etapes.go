@@ -0,0 +1,349 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"log/slog" //trace
+	"sort"
+	"strings"
+	"time"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+// etapes du traitement local d'une image, enchainées dans l'ordre de la configuration (pipeline) :
+// pretraitement -> detection (visages, plaques, personnes) -> suivi -> anonymisation -> ...
+// chaque etape lit et complete la trame ; une nouvelle etape s'ajoute dans ETAPES sans toucher a la boucle de capture
+
+var PIPELINE = []string{"faces", "zones", "anonymize"} //etapes par defaut, zones ne fait rien sans zone configurée pour la camera
+
+const IMAGES_SUIVI = 5  //images pendant lesquelles une piste sans detection reste anonymisée
+const SEUIL_SUIVI = 0.3 //recouvrement minimal entre une detection et une piste pour les associer
+
+// constructeurs des etapes, par nom dans la configuration
+var ETAPES = map[string]func(no_device int) (Etape, error){
+	"equalize":  NouvelleEgalisation,
+	"faces":     NouvelleDetectionVisages,
+	"plates":    NouvelleDetectionPlaques,
+	"persons":   NouvelleDetectionPersonnes,
+	"zones":     NouvellesZones,
+	"track":     NouveauSuivi,
+	"allowlist": NouvelleListeBlanche,
+	"anonymize": NouvelleAnonymisation,
+}
+
+func nomsEtapes() []string {
+	noms := make([]string, 0, len(ETAPES))
+	for nom := range ETAPES {
+		noms = append(noms, nom)
+	}
+	sort.Strings(noms)
+	return noms
+}
+
+type Etape interface {
+	Nom() string
+	Traiter(trame *Trame) error
+	Fermer()
+}
+
+// zone de l'image a anonymiser, trouvée par un detecteur ou imposée par la configuration
+type Detection struct {
+	Rect      image.Rectangle
+	Type      string   //face, plate, person, zone...
+	Piste     int      //numero attribué par l'etape track, 0 sans suivi
+	Polygone  Polygone //nil pour anonymiser tout Rect, sinon seulement l'interieur du polygone
+	Autorisee string   //nom de la personne de la liste blanche reconnue, le visage n'est pas anonymisé
+	Confiance *float64 //score du detecteur, nil pour les cascades de haar et le HOG qui n'en donnent pas
+}
+
+// image qui traverse les etapes, Mat est une copie de l'image capturée modifiée en place par les etapes
+type Trame struct {
+	Image
+	Analyse    *gocv.Mat //image preparée pour les detecteurs par le pretraitement, nil pour utiliser Mat
+	Detections []Detection
+	Anonymisee bool //une etape d'anonymisation a traité l'image
+}
+
+// la trame travaille sur une copie : l'image capturée reste intacte pour l'affichage et les envois au serveur
+func NouvelleTrame(img Image) Trame {
+	copie := img
+	copie.Mat = img.Mat.Clone()
+	return Trame{Image: copie}
+}
+
+// image a donner aux detecteurs
+func (trame *Trame) ImageAnalyse() gocv.Mat {
+	if trame.Analyse != nil {
+		return *trame.Analyse
+	}
+	return trame.Mat
+}
+
+// renvoie l'image traitée et libere le reste de la trame
+func (trame *Trame) Extraire() gocv.Mat {
+	if trame.Analyse != nil {
+		trame.Analyse.Close()
+		trame.Analyse = nil
+	}
+	return trame.Mat
+}
+
+func (trame *Trame) Fermer() {
+	trame.Mat.Close()
+	if trame.Analyse != nil {
+		trame.Analyse.Close()
+	}
+}
+
+// etapes d'une camera, dans l'ordre
+type Pipeline struct {
+	noms   []string
+	etapes []Etape
+}
+
+func NouveauPipeline(noms []string, no_device int) (*Pipeline, error) {
+	pipeline := &Pipeline{noms: noms}
+	for _, nom := range noms {
+		nouvelle, ok := ETAPES[nom]
+		if !ok {
+			pipeline.Fermer()
+			return nil, fmt.Errorf("etape inconnue %q", nom)
+		}
+		etape, err := nouvelle(no_device)
+		if err != nil {
+			pipeline.Fermer()
+			return nil, fmt.Errorf("etape %s: %w", nom, err)
+		}
+		pipeline.etapes = append(pipeline.etapes, etape)
+	}
+	return pipeline, nil
+}
+
+// vrai si le pipeline a ete construit avec ces etapes, pour le reconstruire apres un rechargement
+func (pipeline *Pipeline) Meme(noms []string) bool {
+	return strings.Join(pipeline.noms, ",") == strings.Join(noms, ",")
+}
+
+// fait passer la trame par toutes les etapes, la premiere erreur arrete le traitement
+// une trame qui n'est pas anonymisée a la fin est une erreur : elle ne doit pas etre diffusée
+func (pipeline *Pipeline) Traiter(trame *Trame) error {
+	for _, etape := range pipeline.etapes {
+		debut := time.Now()
+		if err := etape.Traiter(trame); err != nil {
+			return fmt.Errorf("etape %s: %w", etape.Nom(), err)
+		}
+		dureeEtape.Duree(etape.Nom(), debut)
+	}
+	if !trame.Anonymisee {
+		return errors.New("aucune etape n'a anonymisé l'image")
+	}
+	return nil
+}
+
+func (pipeline *Pipeline) Fermer() {
+	for _, etape := range pipeline.etapes {
+		etape.Fermer()
+	}
+}
+
+// pretraitement : niveaux de gris et egalisation d'histogramme, pour detecter dans les images sombres ou peu contrastées
+type Egalisation struct{}
+
+func NouvelleEgalisation(no_device int) (Etape, error) {
+	return Egalisation{}, nil
+}
+
+func (Egalisation) Nom() string { return "equalize" }
+
+func (Egalisation) Traiter(trame *Trame) error {
+	gris := gocv.NewMat()
+	gocv.CvtColor(trame.Mat, &gris, gocv.ColorBGRToGray)
+	gocv.EqualizeHist(gris, &gris)
+	if trame.Analyse != nil {
+		trame.Analyse.Close()
+	}
+	trame.Analyse = &gris
+	return nil
+}
+
+func (Egalisation) Fermer() {}
+
+// detection des visages avec le modele cascade_file de la configuration
+type DetectionVisages struct {
+	classifier gocv.CascadeClassifier
+}
+
+func NouvelleDetectionVisages(no_device int) (Etape, error) {
+	// charger le classifieur pour reconnaitre qqch à partir de gocv
+	classifier := gocv.NewCascadeClassifier()
+	//charger un modele de reconnaissance (ici visage frontal)
+	if fichier := ConfigActuelle().FichierCascade; !classifier.Load(fichier) {
+		classifier.Close()
+		return nil, fmt.Errorf("erreur chargement du fichier %s", fichier)
+	}
+	return &DetectionVisages{classifier: classifier}, nil
+}
+
+func (d *DetectionVisages) Nom() string { return "faces" }
+
+func (d *DetectionVisages) Traiter(trame *Trame) error {
+	// detection visages qui sont retournés dans une liste de rectangles
+	params := ConfigActuelle().Detection
+	tailleMin := image.Pt(params.TailleMin, params.TailleMin)
+	debut := time.Now()
+	rects := d.classifier.DetectMultiScaleWithParams(trame.ImageAnalyse(), params.FacteurEchelle, params.VoisinsMin, 0, tailleMin, image.Point{})
+	latenceDetection.Duree("face", debut)
+	visagesParImage.Observer("", float64(len(rects)))
+	for _, rect := range rects {
+		trame.Detections = append(trame.Detections, Detection{Rect: rect, Type: "face"})
+	}
+	return nil
+}
+
+func (d *DetectionVisages) Fermer() {
+	d.classifier.Close()
+}
+
+// suivi des detections d'une image a l'autre : chaque detection recoit le numero de la piste qu'elle prolonge,
+// et une piste perdue reste anonymisée IMAGES_SUIVI images pour qu'un visage manqué par le detecteur ne reapparaisse pas
+type Suivi struct {
+	pistes   []piste
+	derniere int //dernier numero de piste attribué
+}
+
+type piste struct {
+	Detection
+	manquees int //images consecutives sans detection associée
+}
+
+func NouveauSuivi(no_device int) (Etape, error) {
+	return &Suivi{}, nil
+}
+
+func (s *Suivi) Nom() string { return "track" }
+
+func (s *Suivi) Traiter(trame *Trame) error {
+	associees := make([]bool, len(s.pistes))
+	for i, detection := range trame.Detections {
+		meilleure, meilleurRecouvrement := -1, SEUIL_SUIVI
+		for j, p := range s.pistes {
+			if r := recouvrement(detection.Rect, p.Rect); !associees[j] && p.Type == detection.Type && r >= meilleurRecouvrement {
+				meilleure, meilleurRecouvrement = j, r
+			}
+		}
+		if meilleure < 0 { //nouvelle piste
+			s.derniere++
+			trame.Detections[i].Piste = s.derniere
+			s.pistes = append(s.pistes, piste{Detection: trame.Detections[i]})
+			associees = append(associees, true)
+			continue
+		}
+		trame.Detections[i].Piste = s.pistes[meilleure].Piste
+		s.pistes[meilleure] = piste{Detection: trame.Detections[i]}
+		associees[meilleure] = true
+	}
+
+	gardees := s.pistes[:0]
+	for j, p := range s.pistes {
+		if !associees[j] {
+			p.manquees++
+			if p.manquees > IMAGES_SUIVI {
+				continue
+			}
+			trame.Detections = append(trame.Detections, p.Detection) //derniere position connue
+		}
+		gardees = append(gardees, p)
+	}
+	s.pistes = gardees
+	return nil
+}
+
+func (s *Suivi) Fermer() {}
+
+// intersection sur union de deux rectangles, 0 s'ils sont disjoints
+func recouvrement(a, b image.Rectangle) float64 {
+	inter := a.Intersect(b)
+	if inter.Empty() {
+		return 0
+	}
+	aireInter := inter.Dx() * inter.Dy()
+	return float64(aireInter) / float64(a.Dx()*a.Dy()+b.Dx()*b.Dy()-aireInter)
+}
+
+// pixelisation des detections avec des carrés de block_size
+// les plaques sont pixelisées ou masquées en noir avec les parametres de plates,
+// les personnes sont remplacées selon le mode de la camera (voir remplacerPersonne)
+type Anonymisation struct{}
+
+func NouvelleAnonymisation(no_device int) (Etape, error) {
+	return Anonymisation{}, nil
+}
+
+func (Anonymisation) Nom() string { return "anonymize" }
+
+func (Anonymisation) Traiter(trame *Trame) error {
+	Img_modifiable, err := trame.Mat.ToImage() // image.ToImage est la fonction qui convertie une matrice gocv.Mat en une image.image (modifiable)
+	if err != nil {
+		return fmt.Errorf("conversion matrice gocv en image.image: %w", err)
+	}
+	Img_RGBA, ok := Img_modifiable.(*image.RGBA) //On passe finalImg en image de type RGBA qui est un sous type de image.image
+	if !ok {
+		return errors.New("image pas de type rgba, et donc non modifiable")
+	}
+
+	config := ConfigActuelle()
+	tailleCarre, plaques, modePersonnes := config.TailleCarre, config.Plaques, config.Personnes.ModeCamera(trame.Camera)
+	debut := time.Now()
+	//une detection apres l'autre : les rectangles se recouvrent souvent (visage dans une personne, piste prolongée)
+	for _, detection := range trame.Detections {
+		if detection.Autorisee != "" {
+			continue
+		}
+		switch {
+		case detection.Type == "plate" && plaques.Methode == REPLI_NOIR:
+			draw.Draw(Img_RGBA, detection.Rect, image.Black, image.Point{}, draw.Src)
+		case detection.Type == "plate":
+			blurMaison(Img_RGBA, detection.Rect, plaques.TailleCarre)
+		case detection.Type == "person":
+			remplacerPersonne(Img_RGBA, detection.Rect, modePersonnes, tailleCarre)
+		case detection.Polygone != nil:
+			blurPolygone(Img_RGBA, detection.Polygone, tailleCarre)
+		default:
+			blurMaison(Img_RGBA, detection.Rect, tailleCarre)
+		}
+	}
+	latenceAnonymisation.Duree("pixelate", debut)
+
+	newmat, err := NewMatRGB8FromImage(Img_RGBA) //fonction qui convertit image RGBA en matrice gocv
+	if err != nil {
+		return fmt.Errorf("conversion image en matrice gocv: %w", err)
+	}
+	trame.Mat.Close()
+	trame.Mat = newmat
+	trame.Anonymisee = true
+	slog.Debug("image anonymisée", "camera", trame.Camera, "image", trame.Seq, "detections", len(trame.Detections))
+	return nil
+}
+
+func (Anonymisation) Fermer() {}
+
+// pixelise le rectangle englobant dans une copie puis ne recopie que l'interieur du polygone
+func blurPolygone(imageInOut *image.RGBA, poly Polygone, TAILLE_CARRE int) {
+	bornes := poly.Bornes().Intersect(imageInOut.Bounds())
+	if bornes.Empty() {
+		return
+	}
+	copie := image.NewRGBA(bornes)
+	draw.Draw(copie, bornes, imageInOut, bornes.Min, draw.Src)
+	blurMaison(copie, bornes, TAILLE_CARRE)
+	for y := bornes.Min.Y; y < bornes.Max.Y; y++ {
+		for x := bornes.Min.X; x < bornes.Max.X; x++ {
+			if poly.Contient(image.Pt(x, y)) {
+				imageInOut.SetRGBA(x, y, copie.RGBAAt(x, y))
+			}
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"image"
+	"strings"
+	"testing"
+)
+
+const LARGEUR_TEST, HAUTEUR_TEST = 160, 120
+
+// une zone always_anonymize sur la camera 0 : le degradé ne contient aucun visage,
+// c'est elle qui garantit une detection dans les pipelines complets
+var ZONE_TEST = Polygone{{20, 20}, {100, 20}, {100, 80}, {20, 80}}
+
+func TestPipeline(t *testing.T) {
+	configTest(t, func(c *Configuration) {
+		c.Zones = map[string]ZonesCamera{"0": {Anonymiser: []Polygone{ZONE_TEST}}}
+	})
+
+	cas := []struct {
+		nom        string
+		etapes     []string
+		erreur     string //debut du message d'erreur attendu, vide si le traitement doit reussir
+		detections int
+	}{
+		{"par defaut", PIPELINE, "", 1},
+		{"complet", []string{"equalize", "faces", "track", "zones", "anonymize"}, "", 1},
+		{"sans anonymisation", []string{"equalize", "faces", "zones"}, "aucune etape n'a anonymisé", 1},
+		{"sans detection", []string{"anonymize"}, "", 0},
+	}
+	for _, c := range cas {
+		t.Run(c.nom, func(t *testing.T) {
+			pipeline, err := NouveauPipeline(c.etapes, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pipeline.Fermer()
+			if !pipeline.Meme(c.etapes) {
+				t.Error("le pipeline ne se reconnait pas")
+			}
+
+			trame := trameTest(t, LARGEUR_TEST, HAUTEUR_TEST)
+			avant := trame.Mat.Clone()
+			defer avant.Close()
+			err = pipeline.Traiter(trame)
+			if c.erreur != "" {
+				if err == nil || !strings.Contains(err.Error(), c.erreur) {
+					t.Fatalf("erreur %v, attendu %q", err, c.erreur)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(trame.Detections) != c.detections {
+				t.Fatalf("%d detections, attendu %d : %v", len(trame.Detections), c.detections, trame.Detections)
+			}
+			anonymisee := image.Rectangle{} //sans detection aucun pixel ne doit changer
+			if c.detections > 0 {
+				anonymisee = ZONE_TEST.Bornes()
+			}
+			dedans, dehors := pixelsModifies(avant, trame.Mat, anonymisee)
+			if c.detections > 0 && dedans == 0 {
+				t.Error("la zone n'a pas été anonymisée")
+			}
+			if dehors > 0 {
+				t.Errorf("%d pixels modifiés hors des detections", dehors)
+			}
+		})
+	}
+}
+
+func TestPipelineEtapeInconnue(t *testing.T) {
+	if _, err := NouveauPipeline([]string{"equalize", "sepia"}, 0); err == nil || !strings.Contains(err.Error(), "sepia") {
+		t.Errorf("erreur %v, attendu l'etape inconnue sepia", err)
+	}
+}
+
+func TestEgalisation(t *testing.T) {
+	trame := trameTest(t, LARGEUR_TEST, HAUTEUR_TEST)
+	avant := trame.Mat.Clone()
+	defer avant.Close()
+	for i := 0; i < 2; i++ { //la deuxieme passe remplace l'image d'analyse de la premiere
+		if err := (Egalisation{}).Traiter(trame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	analyse := trame.ImageAnalyse()
+	if trame.Analyse == nil || analyse.Channels() != 1 || analyse.Cols() != LARGEUR_TEST || analyse.Rows() != HAUTEUR_TEST {
+		t.Fatalf("image d'analyse de %dx%d sur %d canaux", analyse.Cols(), analyse.Rows(), analyse.Channels())
+	}
+	if _, dehors := pixelsModifies(avant, trame.Mat, image.Rectangle{}); dehors > 0 {
+		t.Errorf("l'egalisation a modifié %d pixels de l'image diffusée", dehors)
+	}
+}
+
+func TestSuivi(t *testing.T) {
+	a, aDeplace := image.Rect(10, 10, 50, 50), image.Rect(14, 12, 54, 52)
+	b := image.Rect(100, 10, 140, 50)
+	visage := func(rect image.Rectangle) Detection { return Detection{Rect: rect, Type: "face"} }
+
+	type imageSuivie struct {
+		detections []Detection
+		pistes     []int //numeros de piste attendus apres le suivi, les pistes perdues a la fin
+	}
+	images := []imageSuivie{
+		{[]Detection{visage(a)}, []int{1}},
+		{[]Detection{visage(aDeplace), visage(b)}, []int{1, 2}}, //a a bougé, b est nouveau
+		{[]Detection{visage(b)}, []int{2, 1}},                   //a est perdu mais reste anonymisé
+		{[]Detection{{Rect: b, Type: "plate"}}, []int{3, 1, 2}}, //meme rectangle, autre type : nouvelle piste
+	}
+	for i := 0; i < IMAGES_SUIVI-2; i++ { //a reste jusqu'a IMAGES_SUIVI images manquées
+		images = append(images, imageSuivie{[]Detection{visage(b)}, []int{2, 1, 3}})
+	}
+	images = append(images, imageSuivie{[]Detection{visage(b)}, []int{2, 3}}) //puis disparait
+
+	etape, _ := NouveauSuivi(0)
+	for n, img := range images {
+		trame := &Trame{Detections: img.detections}
+		if err := etape.Traiter(trame); err != nil {
+			t.Fatal(err)
+		}
+		var pistes []int
+		for _, detection := range trame.Detections {
+			pistes = append(pistes, detection.Piste)
+		}
+		if len(pistes) != len(img.pistes) {
+			t.Fatalf("image %d : pistes %v, attendu %v", n, pistes, img.pistes)
+		}
+		for i := range pistes {
+			if pistes[i] != img.pistes[i] {
+				t.Fatalf("image %d : pistes %v, attendu %v", n, pistes, img.pistes)
+			}
+		}
+		if n == 2 && trame.Detections[1].Rect != aDeplace {
+			t.Errorf("piste perdue a %v, attendu sa derniere position %v", trame.Detections[1].Rect, aDeplace)
+		}
+	}
+}
+
+func TestAnonymisation(t *testing.T) {
+	rect := image.Rect(32, 32, 96, 80)
+	cas := []struct {
+		nom       string
+		detection Detection
+		plaques   string //methode des plaques
+		personnes string //mode des personnes de la camera 0
+		noir      bool   //tout le rectangle doit etre noir
+		modifie   bool   //des pixels du rectangle doivent changer
+	}{
+		{"visage", Detection{Rect: rect, Type: "face"}, REPLI_NOIR, PERSONNES_PIXEL, false, true},
+		{"plaque en noir", Detection{Rect: rect, Type: "plate"}, REPLI_NOIR, PERSONNES_PIXEL, true, true},
+		{"plaque pixelisée", Detection{Rect: rect, Type: "plate"}, REPLI_PIXEL, PERSONNES_PIXEL, false, true},
+		{"personne en boite", Detection{Rect: rect, Type: "person"}, REPLI_NOIR, PERSONNES_BOITE, true, true},
+		{"personne en silhouette", Detection{Rect: rect, Type: "person"}, REPLI_NOIR, PERSONNES_SILHOUETTE, false, true},
+		{"personne autorisée", Detection{Rect: rect, Type: "face", Autorisee: "alice"}, REPLI_NOIR, PERSONNES_PIXEL, false, false},
+		{"zone", Detection{Rect: rect, Type: "zone", Polygone: Polygone{{32, 32}, {95, 32}, {32, 79}}}, REPLI_NOIR, PERSONNES_PIXEL, false, true},
+		{"hors de l'image", Detection{Rect: image.Rect(140, 100, 200, 160), Type: "face"}, REPLI_NOIR, PERSONNES_PIXEL, false, true},
+	}
+	for _, c := range cas {
+		t.Run(c.nom, func(t *testing.T) {
+			configTest(t, func(config *Configuration) {
+				config.Plaques.Methode = c.plaques
+				config.Personnes.Mode = c.personnes
+			})
+			trame := trameTest(t, LARGEUR_TEST, HAUTEUR_TEST)
+			trame.Detections = []Detection{c.detection}
+			avant := trame.Mat.Clone()
+			defer avant.Close()
+
+			if err := (Anonymisation{}).Traiter(trame); err != nil {
+				t.Fatal(err)
+			}
+			if !trame.Anonymisee {
+				t.Error("trame non marquée anonymisée")
+			}
+			dedans, dehors := pixelsModifies(avant, trame.Mat, c.detection.Rect)
+			if dehors > 0 {
+				t.Errorf("%d pixels modifiés hors du rectangle", dehors)
+			}
+			if c.modifie && dedans == 0 || !c.modifie && dedans > 0 {
+				t.Errorf("%d pixels modifiés dans le rectangle", dedans)
+			}
+			if c.noir {
+				for y := rect.Min.Y; y < rect.Max.Y; y++ {
+					for x := rect.Min.X; x < rect.Max.X; x++ {
+						if pixel := pixelTest(trame.Mat, x, y); pixel != [3]uint8{} {
+							t.Fatalf("pixel %d,%d %v, attendu noir", x, y, pixel)
+						}
+					}
+				}
+			}
+			if c.detection.Polygone != nil { //le coin du rectangle hors du triangle reste intact
+				if pixelTest(avant, 90, 75) != pixelTest(trame.Mat, 90, 75) {
+					t.Error("pixel hors du polygone modifié")
+				}
+			}
+		})
+	}
+}
@@ -1,5 +1,5 @@
 module cameraClient
 
-go 1.17
+go 1.21
 
 require gocv.io/x/gocv v0.29.0
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"log/slog" //logs structurés
+	"os"
+	"strings"
+)
+
+// configure le logger par defaut
+// niveau : debug, info, warn ou error ; format : text ou json
+func ConfigurerLogs(niveau string, format string) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(niveau)); err != nil {
+		return fmt.Errorf("niveau de log inconnu %q", niveau)
+	}
+	options := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("format de log inconnu %q", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"log/slog" //trace
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+// liste blanche des employés consentants : leur visage n'est pas anonymisé
+// un modele de reconnaissance onnx (par exemple SFace) calcule l'empreinte de chaque visage detecté,
+// comparée par similarité cosinus aux empreintes enrolées avec la commande enroll
+// garanties : seuls les visages detectés peuvent etre exemptés, jamais les zones ; un visage trop petit,
+// une erreur du modele ou une liste illisible laissent le visage anonymisé ; un retrait de la liste
+// est pris en compte en quelques secondes, sans redemarrer
+
+const SEUIL_RECONNAISSANCE_MIN = 0.3 //en dessous, des inconnus ressemblants seraient exemptés
+const TAILLE_RECONNAISSANCE_MIN = 48 //visage trop petit pour une reconnaissance fiable, en pixels
+
+type ParametresListeBlanche struct {
+	Modele       string  `json:"model"`      //fichier onnx du modele de reconnaissance
+	Fichier      string  `json:"file"`       //liste des empreintes enrolées
+	Seuil        float64 `json:"threshold"`  //similarité cosinus minimale pour exempter un visage
+	TailleEntree int     `json:"input_size"` //cote de l'image carrée attendue par le modele
+	Echelle      float64 `json:"scale"`      //multiplie les pixels avant le modele
+}
+
+var LISTE_BLANCHE_DEFAUT = ParametresListeBlanche{Seuil: 0.6, TailleEntree: 112, Echelle: 1}
+
+func (p ParametresListeBlanche) Valider() error {
+	var erreurs []error
+	if p.Modele == "" || p.Fichier == "" {
+		erreurs = append(erreurs, errors.New("model et file sont obligatoires avec l'etape allowlist"))
+	}
+	if p.Seuil < SEUIL_RECONNAISSANCE_MIN || p.Seuil > 1 {
+		erreurs = append(erreurs, fmt.Errorf("threshold: %g hors de [%g, 1]", p.Seuil, SEUIL_RECONNAISSANCE_MIN))
+	}
+	if p.TailleEntree < 1 || p.Echelle <= 0 {
+		erreurs = append(erreurs, fmt.Errorf("input_size %d et scale %g doivent etre positifs", p.TailleEntree, p.Echelle))
+	}
+	return errors.Join(erreurs...)
+}
+
+type PersonneEnrolee struct {
+	Nom       string    `json:"name"`
+	Empreinte []float32 `json:"embedding"` //normalisée
+	Date      time.Time `json:"enrolled_at"`
+}
+
+// fichier de la liste blanche, les empreintes ne sont comparables qu'avec le modele qui les a calculées
+type ListeBlanche struct {
+	Modele    string            `json:"model"`
+	Personnes []PersonneEnrolee `json:"people"`
+}
+
+// liste vide si le fichier n'existe pas encore
+func ChargerListeBlanche(chemin string) (*ListeBlanche, error) {
+	contenu, err := os.ReadFile(chemin)
+	if errors.Is(err, os.ErrNotExist) {
+		return &ListeBlanche{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var liste ListeBlanche
+	if err := json.Unmarshal(contenu, &liste); err != nil {
+		return nil, fmt.Errorf("%s: %w", chemin, err)
+	}
+	return &liste, nil
+}
+
+// ecrit dans un fichier temporaire puis le renomme, les cameras ne lisent jamais une liste incomplete
+func (liste *ListeBlanche) Ecrire(chemin string) error {
+	contenu, err := json.MarshalIndent(liste, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(chemin+".tmp", contenu, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(chemin+".tmp", chemin)
+}
+
+// personne la plus proche et sa similarité, "" si la liste est vide
+func (liste *ListeBlanche) Reconnaitre(empreinte []float32) (string, float64) {
+	nom, meilleure := "", -1.0
+	for _, personne := range liste.Personnes {
+		if len(personne.Empreinte) != len(empreinte) {
+			continue
+		}
+		var similarite float64
+		for i := range empreinte {
+			similarite += float64(empreinte[i]) * float64(personne.Empreinte[i])
+		}
+		if similarite > meilleure {
+			nom, meilleure = personne.Nom, similarite
+		}
+	}
+	return nom, meilleure
+}
+
+// modele de reconnaissance, a n'utiliser que depuis une seule go routine
+type Reconnaissance struct {
+	net    gocv.Net
+	params ParametresListeBlanche
+}
+
+func ChargerReconnaissance(params ParametresListeBlanche) (*Reconnaissance, error) {
+	if _, err := os.Stat(params.Modele); err != nil { //readNet arrete le programme si le fichier manque
+		return nil, err
+	}
+	net := gocv.ReadNet(params.Modele, "")
+	if net.Empty() {
+		net.Close()
+		return nil, fmt.Errorf("modele de reconnaissance illisible %s", params.Modele)
+	}
+	return &Reconnaissance{net: net, params: params}, nil
+}
+
+// empreinte normalisée du visage rect de img
+func (r *Reconnaissance) Empreinte(img gocv.Mat, rect image.Rectangle) ([]float32, error) {
+	rect = rect.Intersect(image.Rect(0, 0, img.Cols(), img.Rows()))
+	if rect.Dx() < TAILLE_RECONNAISSANCE_MIN || rect.Dy() < TAILLE_RECONNAISSANCE_MIN {
+		return nil, fmt.Errorf("visage de %dx%d trop petit", rect.Dx(), rect.Dy())
+	}
+	visage := img.Region(rect)
+	defer visage.Close()
+	taille := image.Pt(r.params.TailleEntree, r.params.TailleEntree)
+	blob := gocv.BlobFromImage(visage, r.params.Echelle, taille, gocv.NewScalar(0, 0, 0, 0), true, false)
+	defer blob.Close()
+
+	debut := time.Now()
+	r.net.SetInput(blob, "")
+	sortie := r.net.Forward("")
+	defer sortie.Close()
+	latenceReconnaissance.Duree("", debut)
+
+	valeurs, err := sortie.DataPtrFloat32()
+	if err != nil || len(valeurs) == 0 {
+		return nil, fmt.Errorf("sortie du modele inutilisable: %v", err)
+	}
+	var norme float64
+	for _, v := range valeurs {
+		norme += float64(v) * float64(v)
+	}
+	norme = math.Sqrt(norme)
+	if norme == 0 || math.IsNaN(norme) {
+		return nil, errors.New("empreinte nulle")
+	}
+	empreinte := make([]float32, len(valeurs)) //copie car valeurs pointe dans la memoire de sortie
+	for i, v := range valeurs {
+		empreinte[i] = float32(float64(v) / norme)
+	}
+	return empreinte, nil
+}
+
+func (r *Reconnaissance) Fermer() {
+	r.net.Close()
+}
+
+// etape allowlist : a placer apres les detecteurs (et le suivi) et avant anonymize
+type EtapeListeBlanche struct {
+	reconnaissance *Reconnaissance
+	liste          *ListeBlanche
+	fichier        string
+	date           time.Time //date de modification du fichier chargé
+	verification   time.Time
+	logger         *slog.Logger
+}
+
+func NouvelleListeBlanche(no_device int) (Etape, error) {
+	params := ConfigActuelle().ListeBlanche
+	reconnaissance, err := ChargerReconnaissance(params)
+	if err != nil {
+		return nil, err
+	}
+	etape := &EtapeListeBlanche{reconnaissance: reconnaissance, fichier: params.Fichier, logger: slog.With("camera", no_device, "etape", "allowlist")}
+	etape.recharger()
+	return etape, nil
+}
+
+func (*EtapeListeBlanche) Nom() string { return "allowlist" }
+
+// relit la liste si le fichier a changé ; une liste illisible ou d'un autre modele est remplacée par une liste vide
+func (e *EtapeListeBlanche) recharger() {
+	e.verification = time.Now()
+	date := dateModification(e.fichier)
+	if e.liste != nil && date.Equal(e.date) {
+		return
+	}
+	e.date = date
+	liste, err := ChargerListeBlanche(e.fichier)
+	if err == nil && len(liste.Personnes) > 0 && liste.Modele != filepath.Base(e.reconnaissance.params.Modele) {
+		err = fmt.Errorf("liste enrolée avec le modele %s", liste.Modele)
+	}
+	if err != nil {
+		e.logger.Error("liste blanche inutilisable, tous les visages sont anonymisés", "fichier", e.fichier, "erreur", err)
+		erreurs.Ajouter("allowlist", 1)
+		liste = &ListeBlanche{}
+	}
+	e.liste = liste
+	e.logger.Info("liste blanche chargée", "fichier", e.fichier, "personnes", len(liste.Personnes))
+}
+
+func (e *EtapeListeBlanche) Traiter(trame *Trame) error {
+	if time.Since(e.verification) >= INTERVALLE_SURVEILLANCE {
+		e.recharger()
+	}
+	if len(e.liste.Personnes) == 0 {
+		return nil
+	}
+	seuil := ConfigActuelle().ListeBlanche.Seuil
+	for i := range trame.Detections {
+		detection := &trame.Detections[i]
+		if detection.Type != "face" {
+			continue
+		}
+		empreinte, err := e.reconnaissance.Empreinte(trame.Mat, detection.Rect)
+		if err != nil {
+			e.logger.Debug("visage non reconnu, anonymisé", "image", trame.Seq, "erreur", err)
+			continue
+		}
+		if nom, similarite := e.liste.Reconnaitre(empreinte); similarite >= seuil {
+			detection.Autorisee = nom
+			visagesAutorises.Ajouter("", 1)
+		}
+	}
+	return nil
+}
+
+func (e *EtapeListeBlanche) Fermer() {
+	e.reconnaissance.Fermer()
+}
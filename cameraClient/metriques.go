@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metriques au format texte de prometheus, exposées sur /metrics de la diffusion avec l'option -metrics
+// chaque metrique a au plus une etiquette (camera, detecteur, type d'erreur...), ce qui suffit ici
+
+const PREFIXE_METRIQUES = "camera_client_"
+
+var LATENCES = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5} //en secondes
+var NOMBRES_VISAGES = []float64{0, 1, 2, 3, 5, 10, 20}
+
+var metriques []metrique //dans l'ordre de creation, pour /metrics
+
+var (
+	imagesTraitees        = NouveauCompteur("frames_processed_total", "images lues, par camera", "camera")
+	latenceDetection      = NouvelHistogramme("detection_duration_seconds", "durée de la detection des visages, par detecteur", "detector", LATENCES)
+	latenceAnonymisation  = NouvelHistogramme("anonymization_duration_seconds", "durée du floutage local des visages detectés, par methode", "method", LATENCES)
+	latenceCodec          = NouvelHistogramme("codec_duration_seconds", "durée d'encodage et de decodage des images", "operation", LATENCES)
+	visagesParImage       = NouvelHistogramme("faces_per_frame", "nombre de visages detectés par image", "", NOMBRES_VISAGES)
+	plaquesParImage       = NouvelHistogramme("plates_per_frame", "nombre de plaques detectées par image, avec l'etape plates", "", NOMBRES_VISAGES)
+	personnesParImage     = NouvelHistogramme("persons_per_frame", "nombre de personnes detectées par image, avec l'etape persons", "", NOMBRES_VISAGES)
+	octetsEnvoyes         = NouveauCompteur("bytes_sent_total", "octets d'images envoyés, par transport", "transport")
+	octetsRecus           = NouveauCompteur("bytes_received_total", "octets d'images recus, par transport", "transport")
+	connexionsActives     = NouvelleJauge("active_connections", "connexions au serveur en cours", "")
+	erreurs               = NouveauCompteur("errors_total", "erreurs, par type", "type")
+	imagesEtape           = NouveauCompteur("pipeline_frames_total", "images sorties de chaque etape du pipeline des cameras", "stage")
+	imagesPerdues         = NouveauCompteur("pipeline_frames_dropped_total", "images remplacées par une plus recente avant d'entrer dans l'etape", "stage")
+	latenceEtape          = NouvelHistogramme("pipeline_latency_seconds", "temps entre la capture d'une image et la fin de chaque etape", "stage", LATENCES)
+	imagesMasquees        = NouveauCompteur("frames_masked_total", "images masquées entierement par la politique fail_closed, par raison", "reason")
+	visagesAutorises      = NouveauCompteur("faces_allowlisted_total", "visages reconnus dans la liste blanche et non anonymisés", "")
+	latenceReconnaissance = NouvelHistogramme("recognition_duration_seconds", "durée du calcul de l'empreinte d'un visage", "", LATENCES)
+	dureeEtape            = NouvelHistogramme("processing_stage_duration_seconds", "durée de chaque etape du floutage local", "stage", LATENCES)
+)
+
+type metrique interface {
+	ecrire(w io.Writer)
+}
+
+// compteur ou jauge, avec une valeur par valeur de l'etiquette
+type Compteur struct {
+	nom       string
+	aide      string
+	genre     string //counter ou gauge
+	etiquette string //vide si la metrique n'a pas d'etiquette
+	mu        sync.Mutex
+	valeurs   map[string]float64
+}
+
+func NouveauCompteur(nom, aide, etiquette string) *Compteur {
+	return nouveauCompteur(nom, aide, "counter", etiquette)
+}
+
+// une jauge est un compteur qui peut aussi diminuer
+func NouvelleJauge(nom, aide, etiquette string) *Compteur {
+	return nouveauCompteur(nom, aide, "gauge", etiquette)
+}
+
+func nouveauCompteur(nom, aide, genre, etiquette string) *Compteur {
+	c := &Compteur{nom: PREFIXE_METRIQUES + nom, aide: aide, genre: genre, etiquette: etiquette, valeurs: map[string]float64{}}
+	if etiquette == "" {
+		c.valeurs[""] = 0 //toujours exposée, meme avant la premiere mesure
+	}
+	metriques = append(metriques, c)
+	return c
+}
+
+func (c *Compteur) Ajouter(valeurEtiquette string, n float64) {
+	c.mu.Lock()
+	c.valeurs[valeurEtiquette] += n
+	c.mu.Unlock()
+}
+
+func (c *Compteur) ecrire(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", c.nom, c.aide, c.nom, c.genre)
+	for _, v := range valeursTriees(c.valeurs) {
+		fmt.Fprintf(w, "%s%s %s\n", c.nom, etiquettes(c.etiquette, v), formatValeur(c.valeurs[v]))
+	}
+}
+
+// histogramme cumulatif, une serie par valeur de l'etiquette
+type Histogramme struct {
+	nom       string
+	aide      string
+	etiquette string
+	limites   []float64
+	mu        sync.Mutex
+	series    map[string]*serieHistogramme
+}
+
+type serieHistogramme struct {
+	comptes []uint64 //nombre d'observations <= limites[i], non cumulé
+	somme   float64
+	total   uint64
+}
+
+func NouvelHistogramme(nom, aide, etiquette string, limites []float64) *Histogramme {
+	h := &Histogramme{nom: PREFIXE_METRIQUES + nom, aide: aide, etiquette: etiquette, limites: limites, series: map[string]*serieHistogramme{}}
+	if etiquette == "" {
+		h.series[""] = &serieHistogramme{comptes: make([]uint64, len(limites))}
+	}
+	metriques = append(metriques, h)
+	return h
+}
+
+func (h *Histogramme) Observer(valeurEtiquette string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	serie, ok := h.series[valeurEtiquette]
+	if !ok {
+		serie = &serieHistogramme{comptes: make([]uint64, len(h.limites))}
+		h.series[valeurEtiquette] = serie
+	}
+	if i := sort.SearchFloat64s(h.limites, v); i < len(h.limites) {
+		serie.comptes[i]++
+	}
+	serie.somme += v
+	serie.total++
+}
+
+// observe le temps écoulé depuis debut, en secondes
+func (h *Histogramme) Duree(valeurEtiquette string, debut time.Time) {
+	h.Observer(valeurEtiquette, time.Since(debut).Seconds())
+}
+
+func (h *Histogramme) ecrire(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.nom, h.aide, h.nom)
+	valeurs := make([]string, 0, len(h.series))
+	for v := range h.series {
+		valeurs = append(valeurs, v)
+	}
+	sort.Strings(valeurs)
+	for _, v := range valeurs {
+		serie := h.series[v]
+		var cumul uint64
+		for i, limite := range h.limites {
+			cumul += serie.comptes[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.nom, etiquettes(h.etiquette, v, "le", formatValeur(limite)), cumul)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.nom, etiquettes(h.etiquette, v, "le", "+Inf"), serie.total)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.nom, etiquettes(h.etiquette, v), formatValeur(serie.somme))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.nom, etiquettes(h.etiquette, v), serie.total)
+	}
+}
+
+var echappementEtiquette = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// {etiquette="valeur",le="0.5"}, les paires dont le nom est vide sont ignorées
+func etiquettes(paires ...string) string {
+	var morceaux []string
+	for i := 0; i+1 < len(paires); i += 2 {
+		if paires[i] != "" {
+			morceaux = append(morceaux, paires[i]+`="`+echappementEtiquette.Replace(paires[i+1])+`"`)
+		}
+	}
+	if len(morceaux) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(morceaux, ",") + "}"
+}
+
+func valeursTriees(valeurs map[string]float64) []string {
+	triees := make([]string, 0, len(valeurs))
+	for v := range valeurs {
+		triees = append(triees, v)
+	}
+	sort.Strings(triees)
+	return triees
+}
+
+func formatValeur(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// GET /metrics
+func ServirMetriques(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metriques {
+		m.ecrire(w)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+// outils communs aux tests des etapes : configuration temporaire, trames et comparaison de pixels
+
+const FICHIER_CASCADE_TEST = "testdata/haarcascade_frontalface_default.xml"
+
+// remplace la configuration le temps du test, comme un rechargement a chaud
+func configTest(t *testing.T, modifier func(c *Configuration)) {
+	t.Helper()
+	ancienne := configuration.Load()
+	c := *ConfigActuelle()
+	c.FichierCascade = FICHIER_CASCADE_TEST
+	modifier(&c)
+	configuration.Store(&c)
+	t.Cleanup(func() { configuration.Store(ancienne) })
+}
+
+// degradé de couleurs : la pixelisation le modifie, contrairement a une image unie
+func degradeTest(largeur, hauteur int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, largeur, hauteur))
+	for y := 0; y < hauteur; y++ {
+		for x := 0; x < largeur; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x * 255 / largeur), G: uint8(y * 255 / hauteur), B: uint8((x*7 + y*13) % 256), A: 255})
+		}
+	}
+	return img
+}
+
+// trame de la camera 0 sur un degradé, fermée a la fin du test
+func trameTest(t *testing.T, largeur, hauteur int) *Trame {
+	t.Helper()
+	mat, err := gocv.ImageToMatRGB(degradeTest(largeur, hauteur))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mat.Close()
+	trame := NouvelleTrame(Image{Mat: mat})
+	t.Cleanup(trame.Fermer)
+	return &trame
+}
+
+// pixel bgr, la matrice peut avoir 3 canaux (capture) ou 4 (sortie de l'anonymisation)
+func pixelTest(mat gocv.Mat, x, y int) [3]uint8 {
+	canaux := mat.Channels()
+	return [3]uint8{mat.GetUCharAt(y, x*canaux), mat.GetUCharAt(y, x*canaux+1), mat.GetUCharAt(y, x*canaux+2)}
+}
+
+// nombre de pixels modifiés dans le rectangle et en dehors
+func pixelsModifies(avant, apres gocv.Mat, rect image.Rectangle) (dedans, dehors int) {
+	for y := 0; y < avant.Rows(); y++ {
+		for x := 0; x < avant.Cols(); x++ {
+			if pixelTest(avant, x, y) == pixelTest(apres, x, y) {
+				continue
+			}
+			if image.Pt(x, y).In(rect) {
+				dedans++
+			} else {
+				dehors++
+			}
+		}
+	}
+	return dedans, dehors
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log/slog" //trace
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+const NB_PERIPHERIQUES_SONDES = 10 //numeros de camera essayés par la detection automatique, de 0 a 9
+
+// reglages demandés a la camera a l'ouverture, 0 garde la valeur de la camera
+type ParametresCapture struct {
+	Largeur int     `json:"width"`
+	Hauteur int     `json:"height"`
+	Fps     float64 `json:"fps"`
+}
+
+// camera trouvée par SonderPeripherique, avec les reglages qu'elle a acceptés
+type Peripherique struct {
+	No         int     `json:"device"`
+	Disponible bool    `json:"available"`
+	Largeur    int     `json:"width,omitempty"`
+	Hauteur    int     `json:"height,omitempty"`
+	Fps        float64 `json:"fps,omitempty"`
+	Backend    string  `json:"backend,omitempty"`
+	Erreur     string  `json:"error,omitempty"`
+}
+
+// ouvre la camera no_device et applique les reglages avec VideoCapture.Set
+// la camera peut arrondir ou ignorer un reglage, les valeurs obtenues sont relues par Caracteristiques
+func OuvrirPeripherique(no_device int, params ParametresCapture) (*gocv.VideoCapture, error) {
+	webcam, err := gocv.VideoCaptureDevice(no_device)
+	if err != nil {
+		return nil, err
+	}
+	if !webcam.IsOpened() {
+		webcam.Close()
+		return nil, fmt.Errorf("camera %d absente ou deja utilisée", no_device)
+	}
+	if params.Largeur > 0 {
+		webcam.Set(gocv.VideoCaptureFrameWidth, float64(params.Largeur))
+	}
+	if params.Hauteur > 0 {
+		webcam.Set(gocv.VideoCaptureFrameHeight, float64(params.Hauteur))
+	}
+	if params.Fps > 0 {
+		webcam.Set(gocv.VideoCaptureFPS, params.Fps)
+	}
+	return webcam, nil
+}
+
+// reglages effectifs de la camera ouverte
+func Caracteristiques(no_device int, webcam *gocv.VideoCapture) Peripherique {
+	return Peripherique{
+		No:         no_device,
+		Disponible: true,
+		Largeur:    int(webcam.Get(gocv.VideoCaptureFrameWidth)),
+		Hauteur:    int(webcam.Get(gocv.VideoCaptureFrameHeight)),
+		Fps:        webcam.Get(gocv.VideoCaptureFPS),
+		Backend:    gocv.VideoCaptureAPI(int(webcam.Get(gocv.VideoCaptureBackend))).String(),
+	}
+}
+
+// ouvre la camera, lit une image pour verifier qu'elle fonctionne et la referme
+func SonderPeripherique(no_device int, params ParametresCapture) Peripherique {
+	webcam, err := OuvrirPeripherique(no_device, params)
+	if err != nil {
+		return Peripherique{No: no_device, Erreur: err.Error()}
+	}
+	defer webcam.Close()
+
+	img := gocv.NewMat()
+	defer img.Close()
+	if ok := webcam.Read(&img); !ok || img.Empty() {
+		return Peripherique{No: no_device, Erreur: "aucune image lue"}
+	}
+	return Caracteristiques(no_device, webcam)
+}
+
+// sonde les cameras donnees, ou les numeros 0 a NB_PERIPHERIQUES_SONDES-1 si la liste est vide
+func SonderPeripheriques(nos []int, params ParametresCapture) []Peripherique {
+	if len(nos) == 0 {
+		for no := 0; no < NB_PERIPHERIQUES_SONDES; no++ {
+			nos = append(nos, no)
+		}
+	}
+	peripheriques := make([]Peripherique, 0, len(nos))
+	for _, no := range nos {
+		peripherique := SonderPeripherique(no, params)
+		slog.Debug("camera sondée", "camera", no, "disponible", peripherique.Disponible, "erreur", peripherique.Erreur)
+		peripheriques = append(peripheriques, peripherique)
+	}
+	return peripheriques
+}
+
+// numeros des cameras a lancer : toutes les cameras disponibles si la configuration n'en choisit aucune,
+// sinon celles choisies qui repondent, dans l'ordre de la configuration
+func CamerasDisponibles(config *Configuration) []int {
+	var nos []int
+	for _, peripherique := range SonderPeripheriques(config.Cameras, config.Capture) {
+		if peripherique.Disponible {
+			nos = append(nos, peripherique.No)
+		} else if len(config.Cameras) > 0 { //une camera choisie qui manque est signalée, pas un numero essayé au hasard
+			slog.Warn("camera indisponible, ignorée", "camera", peripherique.No, "erreur", peripherique.Erreur)
+		}
+	}
+	return nos
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"time"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+// etape persons : detection des personnes entieres (HOG avec le detecteur de personnes par defaut d'opencv),
+// pour les zones ou il faut cacher les gens et pas seulement leur visage ; le mode est choisi par camera :
+// off ne detecte rien, pixelate pixelise la personne comme un visage, box la remplace par un rectangle noir,
+// silhouette par une silhouette grise sur un fond fortement pixelisé
+
+const PERSONNES_OFF = "off"
+const PERSONNES_PIXEL = "pixelate"
+const PERSONNES_BOITE = "box"
+const PERSONNES_SILHOUETTE = "silhouette"
+
+var COULEUR_SILHOUETTE = color.RGBA{R: 128, G: 128, B: 128, A: 255}
+
+type ParametresPersonnes struct {
+	Mode        string            `json:"mode"`          //off, pixelate, box ou silhouette
+	ModeCameras map[string]string `json:"camera_modes"`  //par numero de camera, remplace mode
+	LargeurMax  int               `json:"max_width"`     //l'image est reduite a cette largeur pour la detection, 0 pour la garder
+	Seuil       float64           `json:"hit_threshold"` //distance minimale a l'hyperplan du svm, plus haut = moins de fausses detections
+	Echelle     float64           `json:"scale"`         //agrandissement entre deux passes, > 1
+}
+
+// le HOG est lent : sur une image reduite a 640 pixels de large, la detection reste sous la centaine de millisecondes
+var PERSONNES_DEFAUT = ParametresPersonnes{Mode: PERSONNES_OFF, LargeurMax: 640, Echelle: 1.05}
+
+func (p ParametresPersonnes) ModeCamera(no_device int) string {
+	if mode, ok := p.ModeCameras[strconv.Itoa(no_device)]; ok {
+		return mode
+	}
+	return p.Mode
+}
+
+// vrai si au moins une camera anonymise les personnes
+func (p ParametresPersonnes) Actives() bool {
+	if p.Mode != PERSONNES_OFF {
+		return true
+	}
+	for _, mode := range p.ModeCameras {
+		if mode != PERSONNES_OFF {
+			return true
+		}
+	}
+	return false
+}
+
+func (p ParametresPersonnes) Valider() error {
+	var erreurs []error
+	if !modePersonnesValide(p.Mode) {
+		erreurs = append(erreurs, fmt.Errorf("mode: %q, attendu %s, %s, %s ou %s", p.Mode, PERSONNES_OFF, PERSONNES_PIXEL, PERSONNES_BOITE, PERSONNES_SILHOUETTE))
+	}
+	for camera, mode := range p.ModeCameras {
+		if no, err := strconv.Atoi(camera); err != nil || no < 0 {
+			erreurs = append(erreurs, fmt.Errorf("camera_modes: %q n'est pas un numero de camera", camera))
+		}
+		if !modePersonnesValide(mode) {
+			erreurs = append(erreurs, fmt.Errorf("camera_modes.%s: mode inconnu %q", camera, mode))
+		}
+	}
+	if p.LargeurMax < 0 {
+		erreurs = append(erreurs, fmt.Errorf("max_width: %d negatif", p.LargeurMax))
+	}
+	if p.Echelle <= 1 {
+		erreurs = append(erreurs, fmt.Errorf("scale: %g doit etre superieur a 1", p.Echelle))
+	}
+	return errors.Join(erreurs...)
+}
+
+func modePersonnesValide(mode string) bool {
+	switch mode {
+	case PERSONNES_OFF, PERSONNES_PIXEL, PERSONNES_BOITE, PERSONNES_SILHOUETTE:
+		return true
+	}
+	return false
+}
+
+type DetectionPersonnes struct {
+	hog    gocv.HOGDescriptor
+	camera int
+}
+
+func NouvelleDetectionPersonnes(no_device int) (Etape, error) {
+	hog := gocv.NewHOGDescriptor()
+	svm := gocv.HOGDefaultPeopleDetector()
+	defer svm.Close() //le descripteur garde sa propre copie
+	hog.SetSVMDetector(svm)
+	return &DetectionPersonnes{hog: hog, camera: no_device}, nil
+}
+
+func (d *DetectionPersonnes) Nom() string { return "persons" }
+
+func (d *DetectionPersonnes) Traiter(trame *Trame) error {
+	params := ConfigActuelle().Personnes //relus a chaque image, le mode peut changer sans reconstruire le pipeline
+	if params.ModeCamera(d.camera) == PERSONNES_OFF {
+		return nil
+	}
+
+	img := trame.ImageAnalyse()
+	facteur := 1.0
+	if params.LargeurMax > 0 && img.Cols() > params.LargeurMax {
+		facteur = float64(img.Cols()) / float64(params.LargeurMax)
+		reduite := gocv.NewMat()
+		defer reduite.Close()
+		gocv.Resize(img, &reduite, image.Pt(params.LargeurMax, int(float64(img.Rows())/facteur)), 0, 0, gocv.InterpolationArea)
+		img = reduite
+	}
+
+	debut := time.Now()
+	rects := d.hog.DetectMultiScaleWithParams(img, params.Seuil, image.Point{}, image.Point{}, params.Echelle, 2, false) //pas et marge par defaut d'opencv
+	latenceDetection.Duree("person", debut)
+	personnesParImage.Observer("", float64(len(rects)))
+	for _, rect := range rects {
+		rect = image.Rect(int(float64(rect.Min.X)*facteur), int(float64(rect.Min.Y)*facteur), int(float64(rect.Max.X)*facteur), int(float64(rect.Max.Y)*facteur))
+		trame.Detections = append(trame.Detections, Detection{Rect: rect, Type: "person"})
+	}
+	return nil
+}
+
+func (d *DetectionPersonnes) Fermer() {
+	d.hog.Close()
+}
+
+// remplace une personne detectée selon le mode de sa camera, appelé par Anonymisation
+// un mode off (rechargé depuis la detection) garde la pixelisation : une personne detectée n'est jamais diffusée en clair
+func remplacerPersonne(imageInOut *image.RGBA, rect image.Rectangle, mode string, TAILLE_CARRE int) {
+	switch mode {
+	case PERSONNES_BOITE:
+		draw.Draw(imageInOut, rect, image.Black, image.Point{}, draw.Src)
+	case PERSONNES_SILHOUETTE:
+		silhouette(imageInOut, rect, TAILLE_CARRE)
+	default:
+		blurMaison(imageInOut, rect, TAILLE_CARRE)
+	}
+}
+
+// fond pixelisé en gros carrés pour garder l'ambiance de la scene, puis silhouette unie (tete, cou et corps)
+// aux proportions d'une fenetre du detecteur HOG, ou la personne occupe le milieu du rectangle
+func silhouette(imageInOut *image.RGBA, rect image.Rectangle, TAILLE_CARRE int) {
+	bornes := rect.Intersect(imageInOut.Bounds())
+	if bornes.Empty() {
+		return
+	}
+	fond := rect.Dx() / 4 //quatre carrés en largeur, la personne n'est pas reconnaissable
+	if fond < TAILLE_CARRE {
+		fond = TAILLE_CARRE
+	}
+	if fond > 256 { //limite de blurMaison
+		fond = 256
+	}
+	blurMaison(imageInOut, bornes, fond)
+
+	largeur, hauteur := float64(rect.Dx()), float64(rect.Dy())
+	for y := bornes.Min.Y; y < bornes.Max.Y; y++ {
+		v := float64(y-rect.Min.Y) / hauteur
+		for x := bornes.Min.X; x < bornes.Max.X; x++ {
+			u := float64(x-rect.Min.X)/largeur - 0.5 //0 au milieu du rectangle
+			tete := (u/0.13)*(u/0.13)+((v-0.2)/0.09)*((v-0.2)/0.09) <= 1
+			cou := v >= 0.27 && v < 0.32 && u >= -0.06 && u <= 0.06
+			corps := v >= 0.3 && v <= 0.95 && u >= -0.22 && u <= 0.22
+			if tete || cou || corps {
+				imageInOut.SetRGBA(x, y, COULEUR_SILHOUETTE)
+			}
+		}
+	}
+}
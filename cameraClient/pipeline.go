@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log/slog" //trace
+	"sync/atomic"
+	"time"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+// pipeline d'une camera : capture -> traitement -> affichage et diffusion, chaque etape dans sa go routine
+// les etapes sont reliées par des files bornées : si l'etape suivante est en retard, l'image qui attend
+// est remplacée par la plus recente, pour qu'une etape lente perde des images au lieu d'accumuler du retard
+
+const TAILLE_FILE = 1                       //images en attente entre deux etapes
+const INTERVALLE_RAPPORT = 10 * time.Second //frequence des logs de fps et de latence de chaque etape
+
+// image de camera numerotée et datée a la capture
+// Capture vient de time.Now et garde l'horloge monotone : les latences ne sautent pas si l'heure du poste change
+type Image struct {
+	Mat     gocv.Mat
+	Camera  int
+	Seq     uint64 //numero de l'image depuis l'ouverture de la camera, les trous sont des images perdues
+	Capture time.Time
+}
+
+func (img Image) Fermer() {
+	img.Mat.Close()
+}
+
+// image a afficher, et sa version floutée pour la diffusion si Mat ne l'est pas
+type ImageTraitee struct {
+	Image
+	Floutee         bool        //Mat a ete anonymisée, elle peut etre diffusée telle quelle
+	Serveur         bool        //Mat a ete floutée par la session de flux du serveur
+	EmpreinteEntree string      //sha256 des pixels capturés pour le sidecar, calculée seulement si l'image est diffusée avec les sidecars
+	Diffusee        *gocv.Mat   //nil si Mat est floutée ou si personne ne regarde la diffusion
+	Detections      []Detection //trouvées par le floutage local, pour la superposition de debogage
+}
+
+func (img ImageTraitee) Fermer() {
+	img.Mat.Close()
+	if img.Diffusee != nil {
+		img.Diffusee.Close()
+	}
+}
+
+type fermable interface {
+	Fermer()
+}
+
+// pose img dans file ; si une image attend deja, elle est fermée et comptée comme perdue par l'etape suivante
+// chaque file n'a qu'un producteur, donc la boucle se termine
+func deposer[T fermable](file chan T, img T, suivante *MesureEtape) {
+	for {
+		select {
+		case file <- img:
+			return
+		default:
+		}
+		select {
+		case ancienne := <-file:
+			ancienne.Fermer()
+			suivante.Perdue()
+		default: //l'etape suivante vient de prendre l'image
+		}
+	}
+}
+
+// fps et latence depuis la capture d'une etape, pour une camera
+// Traitee n'est appelée que par la go routine de l'etape, Perdue par celle de l'etape precedente
+type MesureEtape struct {
+	nom     string
+	logger  *slog.Logger
+	images  int           //depuis le dernier rapport
+	latence time.Duration //cumulée depuis le dernier rapport
+	debut   time.Time
+	perdues atomic.Int64 //depuis le dernier rapport
+}
+
+func NouvelleMesure(nom string, no_device int) *MesureEtape {
+	return &MesureEtape{nom: nom, logger: slog.With("camera", no_device, "etape", nom), debut: time.Now()}
+}
+
+func (m *MesureEtape) Traitee(img Image) {
+	latence := time.Since(img.Capture)
+	imagesEtape.Ajouter(m.nom, 1)
+	latenceEtape.Observer(m.nom, latence.Seconds())
+
+	m.images++
+	m.latence += latence
+	if ecoule := time.Since(m.debut); ecoule >= INTERVALLE_RAPPORT {
+		m.logger.Debug("etape du pipeline", "fps", float64(m.images)/ecoule.Seconds(), "latence_moyenne", m.latence/time.Duration(m.images),
+			"perdues", m.perdues.Swap(0), "derniere_image", img.Seq)
+		m.images, m.latence, m.debut = 0, 0, time.Now()
+	}
+}
+
+func (m *MesureEtape) Perdue() {
+	imagesPerdues.Ajouter(m.nom, 1)
+	m.perdues.Add(1)
+}
+
+// lit la camera aussi vite qu'elle produit des images, jusqu'a une erreur de lecture
+func capturer(no_device int, webcam *gocv.VideoCapture, sortie chan Image, suivante *MesureEtape, logger *slog.Logger) {
+	defer close(sortie)
+	mesure := NouvelleMesure("capture", no_device)
+	var seq uint64
+	for {
+		mat := gocv.NewMat()
+		if ok := webcam.Read(&mat); !ok || mat.Empty() { //lire une image de la camera et affecte cette image dans la matrice mat (référencée par son adresse)
+			mat.Close()
+			logger.Error("ne peut pas lire la camera, arret de la camera")
+			erreurs.Ajouter("capture", 1)
+			return
+		}
+		seq++
+		img := Image{Mat: mat, Camera: no_device, Seq: seq, Capture: time.Now()}
+		mesure.Traitee(img)
+		deposer(sortie, img, suivante)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"time"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+// etape plates : detection des plaques d'immatriculation, une classe a part des visages
+// avec son propre modele, ses parametres de DetectMultiScale et sa methode d'anonymisation (voir Anonymisation)
+// a placer avant zones pour que les zones ignore et detect_only filtrent aussi les plaques
+
+const FICHIER_CASCADE_PLAQUES = "C:\\opencv\\haar-cascade-files-master\\haarcascade_russian_plate_number.xml"
+
+type ParametresPlaques struct {
+	FichierCascade string              `json:"cascade_file"` //lu a la construction du pipeline
+	Methode        string              `json:"method"`       //pixelate ou black
+	TailleCarre    int                 `json:"block_size"`   //taille des carrés de la pixelisation
+	Detection      ParametresDetection `json:"detection"`
+}
+
+// une plaque est petite et allongée, on la masque en noir plutot que de la pixeliser
+var PLAQUES_DEFAUT = ParametresPlaques{FichierCascade: FICHIER_CASCADE_PLAQUES, Methode: REPLI_NOIR, TailleCarre: 16, Detection: DETECTION_DEFAUT}
+
+func (p ParametresPlaques) Valider() error {
+	var erreurs []error
+	if p.FichierCascade == "" {
+		erreurs = append(erreurs, errors.New("cascade_file: fichier vide"))
+	}
+	if p.Methode != REPLI_PIXEL && p.Methode != REPLI_NOIR {
+		erreurs = append(erreurs, fmt.Errorf("method: %q, attendu %s ou %s", p.Methode, REPLI_PIXEL, REPLI_NOIR))
+	}
+	if p.TailleCarre < 2 || p.TailleCarre > 256 { //meme limite que block_size
+		erreurs = append(erreurs, fmt.Errorf("block_size: %d hors de [2, 256]", p.TailleCarre))
+	}
+	if p.Detection.FacteurEchelle <= 1 || p.Detection.VoisinsMin < 0 || p.Detection.TailleMin < 0 {
+		erreurs = append(erreurs, fmt.Errorf("detection: scale_factor %g doit etre superieur a 1, min_neighbors %d et min_size %d positifs",
+			p.Detection.FacteurEchelle, p.Detection.VoisinsMin, p.Detection.TailleMin))
+	}
+	return errors.Join(erreurs...)
+}
+
+type DetectionPlaques struct {
+	classifier gocv.CascadeClassifier
+}
+
+func NouvelleDetectionPlaques(no_device int) (Etape, error) {
+	classifier := gocv.NewCascadeClassifier()
+	if fichier := ConfigActuelle().Plaques.FichierCascade; !classifier.Load(fichier) {
+		classifier.Close()
+		return nil, fmt.Errorf("erreur chargement du fichier %s", fichier)
+	}
+	return &DetectionPlaques{classifier: classifier}, nil
+}
+
+func (d *DetectionPlaques) Nom() string { return "plates" }
+
+func (d *DetectionPlaques) Traiter(trame *Trame) error {
+	params := ConfigActuelle().Plaques.Detection
+	tailleMin := image.Pt(params.TailleMin, params.TailleMin)
+	debut := time.Now()
+	rects := d.classifier.DetectMultiScaleWithParams(trame.ImageAnalyse(), params.FacteurEchelle, params.VoisinsMin, 0, tailleMin, image.Point{})
+	latenceDetection.Duree("plate", debut)
+	plaquesParImage.Observer("", float64(len(rects)))
+	for _, rect := range rects {
+		trame.Detections = append(trame.Detections, Detection{Rect: rect, Type: "plate"})
+	}
+	return nil
+}
+
+func (d *DetectionPlaques) Fermer() {
+	d.classifier.Close()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"log/slog" //trace
+	"math"
+	"strconv"
+	"time"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+// politique de confidentialité du floutage local, quand le detecteur echoue, que l'image est trop sombre ou trop floue
+// pour que la detection soit fiable, ou que le traitement depasse son delai :
+// fail_closed masque l'image entiere (pixelisation grossiere ou noir), fail_open garde le resultat du pipeline
+// meme en fail_open une image que le pipeline n'a pas pu anonymiser n'est jamais diffusée
+
+const FAIL_CLOSED = "fail_closed"
+const FAIL_OPEN = "fail_open"
+const REPLI_PIXEL = "pixelate"
+const REPLI_NOIR = "black"
+const COLONNES_REPLI = 16 //l'image masquée par pixelisation garde 16 carrés en largeur, trop peu pour reconnaitre un visage
+
+type ParametresSecurite struct {
+	Politique        string            `json:"policy"`          //fail_closed ou fail_open
+	PolitiqueCameras map[string]string `json:"camera_policies"` //par numero de camera, remplace policy
+	Repli            string            `json:"fallback"`        //pixelate ou black
+	LuminositeMin    float64           `json:"min_brightness"`  //moyenne des niveaux de gris de 0 a 255, 0 pour ne pas verifier
+	NetteteMin       float64           `json:"min_sharpness"`   //variance du laplacien, 0 pour ne pas verifier
+	DelaiMax         Duree             `json:"deadline"`        //entre la capture et la fin du floutage, 0 pour ne pas verifier
+}
+
+var SECURITE_DEFAUT = ParametresSecurite{Politique: FAIL_CLOSED, Repli: REPLI_PIXEL, LuminositeMin: 20, NetteteMin: 10, DelaiMax: Duree(time.Second)}
+
+func (s ParametresSecurite) PolitiqueCamera(no_device int) string {
+	if politique, ok := s.PolitiqueCameras[strconv.Itoa(no_device)]; ok {
+		return politique
+	}
+	return s.Politique
+}
+
+func (s ParametresSecurite) Valider() error {
+	var erreurs []error
+	if s.Politique != FAIL_CLOSED && s.Politique != FAIL_OPEN {
+		erreurs = append(erreurs, fmt.Errorf("policy: %q, attendu %s ou %s", s.Politique, FAIL_CLOSED, FAIL_OPEN))
+	}
+	for camera, politique := range s.PolitiqueCameras {
+		if no, err := strconv.Atoi(camera); err != nil || no < 0 {
+			erreurs = append(erreurs, fmt.Errorf("camera_policies: %q n'est pas un numero de camera", camera))
+		}
+		if politique != FAIL_CLOSED && politique != FAIL_OPEN {
+			erreurs = append(erreurs, fmt.Errorf("camera_policies.%s: %q, attendu %s ou %s", camera, politique, FAIL_CLOSED, FAIL_OPEN))
+		}
+	}
+	if s.Repli != REPLI_PIXEL && s.Repli != REPLI_NOIR {
+		erreurs = append(erreurs, fmt.Errorf("fallback: %q, attendu %s ou %s", s.Repli, REPLI_PIXEL, REPLI_NOIR))
+	}
+	if s.LuminositeMin < 0 || s.NetteteMin < 0 || s.DelaiMax < 0 {
+		erreurs = append(erreurs, errors.New("min_brightness, min_sharpness et deadline ne peuvent pas etre negatifs"))
+	}
+	return errors.Join(erreurs...)
+}
+
+// raison pour laquelle le floutage n'est pas fiable, etiquette de la metrique frames_masked_total
+type Defaillance struct {
+	Raison string //error, dark, blurry ou deadline
+	Err    error
+}
+
+func (d *Defaillance) Error() string { return d.Raison + ": " + d.Err.Error() }
+func (d *Defaillance) Unwrap() error { return d.Err }
+
+// luminosité moyenne et nettete (variance du laplacien) de l'image en niveaux de gris
+func MesurerQualite(img gocv.Mat) (luminosite float64, nettete float64) {
+	gris := gocv.NewMat()
+	defer gris.Close()
+	if img.Channels() == 4 {
+		gocv.CvtColor(img, &gris, gocv.ColorBGRAToGray)
+	} else if img.Channels() == 3 {
+		gocv.CvtColor(img, &gris, gocv.ColorBGRToGray)
+	} else {
+		img.CopyTo(&gris)
+	}
+	luminosite = gris.Mean().Val1
+
+	laplacien, moyenne, ecart := gocv.NewMat(), gocv.NewMat(), gocv.NewMat()
+	defer laplacien.Close()
+	defer moyenne.Close()
+	defer ecart.Close()
+	gocv.Laplacian(gris, &laplacien, gocv.MatTypeCV64F, 1, 1, 0, gocv.BorderDefault)
+	gocv.MeanStdDev(laplacien, &moyenne, &ecart)
+	nettete = math.Pow(ecart.GetDoubleAt(0, 0), 2)
+	return luminosite, nettete
+}
+
+// verifie la qualité de l'image capturée et le delai, apres le pipeline
+func (s ParametresSecurite) Verifier(img Image) *Defaillance {
+	if s.LuminositeMin > 0 || s.NetteteMin > 0 {
+		luminosite, nettete := MesurerQualite(img.Mat)
+		if luminosite < s.LuminositeMin {
+			return &Defaillance{"dark", fmt.Errorf("luminosité %.1f inferieure a %g", luminosite, s.LuminositeMin)}
+		}
+		if nettete < s.NetteteMin {
+			return &Defaillance{"blurry", fmt.Errorf("nettete %.1f inferieure a %g", nettete, s.NetteteMin)}
+		}
+	}
+	if ecoule := time.Since(img.Capture); s.DelaiMax > 0 && ecoule > s.DelaiMax.Duration() {
+		return &Defaillance{"deadline", fmt.Errorf("traitement en %s, delai %s", ecoule.Round(time.Millisecond), s.DelaiMax.Duration())}
+	}
+	return nil
+}
+
+// image entiere masquée : pixelisation grossiere ou noir
+func MasquerImage(img gocv.Mat, repli string) gocv.Mat {
+	if repli == REPLI_NOIR {
+		return gocv.Zeros(img.Rows(), img.Cols(), img.Type())
+	}
+	lignes := int(math.Max(1, math.Round(float64(COLONNES_REPLI*img.Rows())/float64(img.Cols()))))
+	petite := gocv.NewMat()
+	defer petite.Close()
+	gocv.Resize(img, &petite, image.Pt(COLONNES_REPLI, lignes), 0, 0, gocv.InterpolationArea)
+	masquee := gocv.NewMat()
+	gocv.Resize(petite, &masquee, image.Pt(img.Cols(), img.Rows()), 0, 0, gocv.InterpolationNearestNeighbor)
+	return masquee
+}
+
+// floutage local d'une image par le pipeline, avec la politique de la camera
+// renvoie l'image a afficher ou diffuser, ok est faux si aucune image sure n'est disponible (fail_open et pipeline en erreur)
+func FloutageLocal(pipeline *Pipeline, img Image, logger *slog.Logger) (floutee gocv.Mat, detections []Detection, ok bool) {
+	securite := ConfigActuelle().Securite
+	trame := NouvelleTrame(img)
+
+	var defaillance *Defaillance
+	if err := pipeline.Traiter(&trame); err != nil {
+		erreurs.Ajouter("pipeline", 1)
+		defaillance = &Defaillance{"error", err}
+	} else {
+		defaillance = securite.Verifier(img)
+	}
+	if defaillance == nil {
+		return trame.Extraire(), trame.Detections, true
+	}
+
+	politique := securite.PolitiqueCamera(img.Camera)
+	if politique == FAIL_OPEN {
+		logger.Warn("floutage local non fiable, image gardée (fail_open)", "image", img.Seq, "raison", defaillance.Raison, "erreur", defaillance.Err)
+		if trame.Anonymisee {
+			return trame.Extraire(), trame.Detections, true
+		}
+		trame.Fermer()
+		return gocv.Mat{}, nil, false
+	}
+
+	trame.Fermer()
+	imagesMasquees.Ajouter(defaillance.Raison, 1)
+	logger.Warn("floutage local non fiable, image masquée (fail_closed)", "image", img.Seq, "raison", defaillance.Raison, "erreur", defaillance.Err, "repli", securite.Repli)
+	return MasquerImage(img.Mat, securite.Repli), nil, true
+}
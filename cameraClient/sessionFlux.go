@@ -0,0 +1,190 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+const COMMANDE_FLUX = "FLUX" //ouvre une session ou on envoie les images en continu au serveur
+const FPS_FLUX = 10          //nombre maximum d'images envoyées par seconde par defaut (stream_fps)
+const IMAGES_EN_VOL_MAX = 2  //au dela on abandonne les nouvelles images au lieu de prendre du retard
+
+// session de floutage en continu par le serveur, sur une connexion dediée a une camera
+// on envoie le numero de l'image puis l'image, le serveur renvoie le numero puis l'image floutée (vide si abandonnée)
+type SessionFlux struct {
+	connection   net.Conn
+	codec        Codec
+	logger       *slog.Logger
+	envois       chan []byte
+	termine      chan struct{}
+	dernierEnvoi time.Time
+
+	mu          sync.Mutex
+	enVol       int    //images envoyées dont on attend la reponse
+	derniere    []byte //derniere image floutée recue, encodée avec le codec
+	nouvelle    bool   //derniere n'a pas encore ete decodée
+	envoyees    int
+	abandonnees int //par le client ou le serveur
+}
+
+// source est le nom de la camera, repris dans les sidecars du serveur
+func OuvrirSessionFlux(adresse string, source string, logger *slog.Logger) (*SessionFlux, error) {
+	connection, err := net.Dial("tcp", adresse)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := NegocierCodec(connection, ConfigActuelle().Codec) //relue a chaque session, suit les rechargements
+	if err != nil {
+		logger.Warn("negociation du codec de la session impossible", "codec", codec.Format, "erreur", err)
+	}
+	if err := DeclarerSource(connection, source); err != nil {
+		connection.Close()
+		return nil, err
+	}
+	if _, err := connection.Write([]byte(fillString(COMMANDE_FLUX, 10))); err != nil {
+		connection.Close()
+		return nil, err
+	}
+
+	session := &SessionFlux{
+		connection: connection,
+		codec:      codec,
+		logger:     logger,
+		envois:     make(chan []byte, IMAGES_EN_VOL_MAX),
+		termine:    make(chan struct{}),
+	}
+	connexionsActives.Ajouter("", 1)
+	go session.envoyer()
+	go session.recevoir()
+	return session, nil
+}
+
+// propose une image au serveur, elle est abandonnée si on depasse FPS_FLUX ou si le serveur est en retard
+func (session *SessionFlux) Soumettre(img gocv.Mat) {
+	if time.Since(session.dernierEnvoi) < time.Second/time.Duration(ConfigActuelle().FpsFlux) {
+		return
+	}
+
+	session.mu.Lock()
+	if session.enVol >= IMAGES_EN_VOL_MAX {
+		session.abandonnees++
+		session.mu.Unlock()
+		return
+	}
+	session.enVol++
+	session.mu.Unlock()
+
+	img_bytes, err := session.codec.Encoder(img)
+	if err != nil {
+		session.logger.Error("erreur d'encodage de l'image du flux", "erreur", err)
+		erreurs.Ajouter("session_flux", 1)
+		session.mu.Lock()
+		session.enVol--
+		session.mu.Unlock()
+		return
+	}
+	session.envois <- img_bytes //ne bloque pas, il y a au plus IMAGES_EN_VOL_MAX images en vol
+	session.dernierEnvoi = time.Now()
+}
+
+// renvoie la derniere image floutée par le serveur, ok est faux si on n'en a encore recu aucune
+// img n'est remplacée que si une nouvelle image est arrivée
+func (session *SessionFlux) DerniereImage(img *gocv.Mat) (ok bool) {
+	session.mu.Lock()
+	img_bytes, nouvelle := session.derniere, session.nouvelle
+	session.nouvelle = false
+	session.mu.Unlock()
+
+	if nouvelle {
+		decodee, err := Decoder(img_bytes, gocv.IMReadColor)
+		if err != nil {
+			session.logger.Error("image du flux illisible", "erreur", err)
+			erreurs.Ajouter("session_flux", 1)
+		} else {
+			img.Close()
+			*img = decodee
+		}
+	}
+	return !img.Empty()
+}
+
+// termine la session, le serveur renvoie les images en cours avant de fermer la connexion
+func (session *SessionFlux) Fermer() {
+	close(session.envois)
+	select {
+	case <-session.termine:
+	case <-time.After(5 * time.Second):
+		session.connection.Close()
+		<-session.termine
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.logger.Info("fin de session de flux", "envoyees", session.envoyees, "abandonnees", session.abandonnees)
+}
+
+// vrai si la connexion de la session a ete fermée (serveur arreté ou erreur)
+func (session *SessionFlux) Terminee() bool {
+	select {
+	case <-session.termine:
+		return true
+	default:
+		return false
+	}
+}
+
+func (session *SessionFlux) envoyer() {
+	seq := 0
+	for img_bytes := range session.envois {
+		seq++
+		_, err := session.connection.Write([]byte(fillString(strconv.Itoa(seq), 10)))
+		if err == nil {
+			err = EnvoiImage(img_bytes, session.connection)
+		}
+		if err != nil {
+			session.logger.Error("erreur d'envoi dans la session de flux", "erreur", err)
+			erreurs.Ajouter("session_flux", 1)
+			session.connection.Close() //debloque la reception
+			for range session.envois {
+			}
+			return
+		}
+		session.mu.Lock()
+		session.envoyees++
+		session.mu.Unlock()
+	}
+	FinConnexion(session.connection) //le serveur fermera la connexion apres les dernieres reponses
+}
+
+func (session *SessionFlux) recevoir() {
+	defer close(session.termine)
+	defer connexionsActives.Ajouter("", -1)
+	defer session.connection.Close()
+	for {
+		_, err := LectureEntete(session.connection) //numero de l'image, les reponses arrivent dans l'ordre de traitement
+		var entete string
+		if err == nil {
+			entete, err = LectureEntete(session.connection)
+		}
+		var img_bytes []byte
+		if err == nil && entete != "0" { //taille 0 = image abandonnée par le serveur
+			img_bytes, err = ReceptionCorps(session.connection, entete)
+		}
+		if err != nil {
+			return //fin de session ou connexion perdue
+		}
+
+		session.mu.Lock()
+		session.enVol--
+		if img_bytes == nil {
+			session.abandonnees++
+		} else {
+			session.derniere, session.nouvelle = img_bytes, true
+		}
+		session.mu.Unlock()
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+// trace des images diffusées en mjpeg, pour prouver que chaque image publiée a ete anonymisée
+// meme dossier que les sidecars du serveur : un fichier json par segment d'images consecutives d'une camera
+
+const IMAGES_PAR_SEGMENT = 100         //nombre d'images publiées regroupées dans un meme sidecar
+const DUREE_SEGMENT = 10 * time.Second //un segment commencé est ecrit au plus tard apres cette durée
+
+const ANONYMISEUR_LOCAL = "local"    //pipeline du client
+const ANONYMISEUR_SERVEUR = "server" //session de flux, le serveur ecrit aussi ses propres sidecars
+
+// detection anonymisée dans l'image publiée, le nom d'une personne de la liste blanche n'est jamais ecrit
+type DetectionPubliee struct {
+	Type      string `json:"type"`
+	X         int    `json:"x"`
+	Y         int    `json:"y"`
+	Largeur   int    `json:"width"`
+	Hauteur   int    `json:"height"`
+	Piste     int    `json:"track,omitempty"`
+	Autorisee bool   `json:"allowlisted,omitempty"` //laissée en clair par la liste blanche
+}
+
+type SidecarImage struct {
+	Seq          uint64             `json:"frame"` //numero de capture de la camera
+	Capture      time.Time          `json:"captured"`
+	Horodatage   time.Time          `json:"timestamp"`
+	Anonymiseur  string             `json:"anonymized_by"`      //ANONYMISEUR_LOCAL ou ANONYMISEUR_SERVEUR
+	Pipeline     []string           `json:"pipeline,omitempty"` //etapes du floutage local
+	TailleCarre  int                `json:"block_size,omitempty"`
+	Largeur      int                `json:"image_width"`
+	Hauteur      int                `json:"image_height"`
+	Detections   []DetectionPubliee `json:"detections"`
+	Sha256Entree string             `json:"input_sha256,omitempty"` //des pixels bgr bruts de l'image capturée, absente pour une image du serveur (voir son sidecar)
+	Sha256Sortie string             `json:"output_sha256"`          //du jpeg envoyé aux spectateurs
+}
+
+// sidecar d'un segment : les images publiées consecutives d'une camera
+type SidecarSegment struct {
+	Source        string         `json:"source"`
+	Debut         time.Time      `json:"start"`
+	Fin           time.Time      `json:"end"`
+	VersionOpenCV string         `json:"opencv_version"`
+	VersionGocv   string         `json:"gocv_version"`
+	Images        []SidecarImage `json:"frames"`
+}
+
+// img est l'image affichée, jpg ce qui a ete diffusé
+func NouveauSidecarImage(img ImageTraitee, jpg []byte) SidecarImage {
+	sidecar := SidecarImage{
+		Seq:          img.Seq,
+		Capture:      img.Capture.UTC(),
+		Horodatage:   time.Now().UTC(),
+		Anonymiseur:  ANONYMISEUR_LOCAL,
+		Largeur:      img.Mat.Cols(),
+		Hauteur:      img.Mat.Rows(),
+		Detections:   []DetectionPubliee{},
+		Sha256Entree: img.EmpreinteEntree,
+		Sha256Sortie: empreinte(jpg),
+	}
+	if img.Serveur { //l'image revenue du serveur vient d'une capture precedente, pas de celle de img
+		sidecar.Anonymiseur, sidecar.Sha256Entree = ANONYMISEUR_SERVEUR, ""
+		return sidecar
+	}
+	config := ConfigActuelle()
+	sidecar.Pipeline, sidecar.TailleCarre = config.Pipeline, config.TailleCarre
+	for _, detection := range img.Detections {
+		rect := detection.Rect
+		sidecar.Detections = append(sidecar.Detections, DetectionPubliee{Type: detection.Type, X: rect.Min.X, Y: rect.Min.Y, Largeur: rect.Dx(), Hauteur: rect.Dy(),
+			Piste: detection.Piste, Autorisee: detection.Autorisee != ""})
+	}
+	return sidecar
+}
+
+func empreinte(donnees []byte) string {
+	somme := sha256.Sum256(donnees)
+	return hex.EncodeToString(somme[:])
+}
+
+// ecrit les sidecars en json dans un dossier, un fichier par segment
+type JournalSidecars struct {
+	dossier  string
+	mu       sync.Mutex
+	compteur int
+	segments map[*Segment]struct{} //segments des cameras en cours, ecrits par Fermer a la fin du programme
+}
+
+var sidecars *JournalSidecars //nil si les sidecars sont desactivés
+
+func NouveauJournalSidecars(dossier string) (*JournalSidecars, error) {
+	if err := os.MkdirAll(dossier, 0o750); err != nil {
+		return nil, err
+	}
+	return &JournalSidecars{dossier: dossier, segments: map[*Segment]struct{}{}}, nil
+}
+
+// ecrit v dans un nouveau fichier, ne fait rien si les sidecars sont desactivés
+func (journal *JournalSidecars) Ecrire(v interface{}) error {
+	if journal == nil {
+		return nil
+	}
+	contenu, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	journal.mu.Lock()
+	journal.compteur++
+	nom := fmt.Sprintf("%s_%06d.json", time.Now().UTC().Format("20060102T150405.000"), journal.compteur)
+	journal.mu.Unlock()
+
+	//on ecrit dans un fichier temporaire puis on le renomme pour ne jamais laisser un sidecar incomplet
+	chemin := filepath.Join(journal.dossier, nom)
+	if err := os.WriteFile(chemin+".tmp", contenu, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(chemin+".tmp", chemin)
+}
+
+// ecrit les segments en attente de toutes les cameras, le programme s'arrete sans attendre leurs go routines
+func (journal *JournalSidecars) Fermer() error {
+	if journal == nil {
+		return nil
+	}
+	journal.mu.Lock()
+	segments := make([]*Segment, 0, len(journal.segments))
+	for segment := range journal.segments {
+		segments = append(segments, segment)
+	}
+	journal.mu.Unlock()
+	var err error
+	for _, segment := range segments {
+		if e := segment.Fermer(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// regroupe les sidecars des images publiées d'une camera, ecrit tous les IMAGES_PAR_SEGMENT images,
+// apres DUREE_SEGMENT et a la fin
+type Segment struct {
+	journal *JournalSidecars
+	mu      sync.Mutex //Ajouter par la camera, Fermer aussi par la fin du programme
+	courant SidecarSegment
+}
+
+func (journal *JournalSidecars) NouveauSegment(source string) *Segment {
+	segment := &Segment{journal: journal, courant: SidecarSegment{Source: source, VersionOpenCV: gocv.OpenCVVersion(), VersionGocv: gocv.Version()}}
+	if journal != nil {
+		journal.mu.Lock()
+		journal.segments[segment] = struct{}{}
+		journal.mu.Unlock()
+	}
+	return segment
+}
+
+func (segment *Segment) Ajouter(sidecar SidecarImage) error {
+	if segment.journal == nil {
+		return nil
+	}
+	segment.mu.Lock()
+	defer segment.mu.Unlock()
+	if len(segment.courant.Images) == 0 {
+		segment.courant.Debut = sidecar.Horodatage
+	}
+	segment.courant.Fin = sidecar.Horodatage
+	segment.courant.Images = append(segment.courant.Images, sidecar)
+	if len(segment.courant.Images) >= IMAGES_PAR_SEGMENT || segment.courant.Fin.Sub(segment.courant.Debut) >= DUREE_SEGMENT {
+		return segment.ecrire()
+	}
+	return nil
+}
+
+// ecrit les images en attente, a l'arret de la camera ou du programme
+func (segment *Segment) Fermer() error {
+	if segment.journal == nil {
+		return nil
+	}
+	segment.mu.Lock()
+	err := segment.ecrire()
+	segment.mu.Unlock()
+
+	segment.journal.mu.Lock()
+	delete(segment.journal.segments, segment)
+	segment.journal.mu.Unlock()
+	return err
+}
+
+func (segment *Segment) ecrire() error {
+	if len(segment.courant.Images) == 0 {
+		return nil
+	}
+	err := segment.journal.Ecrire(segment.courant)
+	segment.courant.Images = nil
+	return err
+}
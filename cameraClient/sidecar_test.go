@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+func TestSidecarsSegment(t *testing.T) {
+	dossier := t.TempDir()
+	journal, err := NouveauJournalSidecars(dossier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mat := gocv.NewMatWithSize(48, 64, gocv.MatTypeCV8UC3)
+	defer mat.Close()
+
+	segment := journal.NouveauSegment("camera 0")
+	for seq := uint64(1); seq <= 3; seq++ {
+		img := ImageTraitee{Image: Image{Mat: mat, Seq: seq}, Floutee: true, EmpreinteEntree: empreinte(mat.ToBytes()),
+			Detections: []Detection{{Type: "face", Piste: 1, Autorisee: "alice"}}}
+		if err := segment.Ajouter(NouveauSidecarImage(img, []byte("jpeg"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	serveur := ImageTraitee{Image: Image{Mat: mat, Seq: 4}, Floutee: true, Serveur: true, EmpreinteEntree: "ignorée"}
+	segment.Ajouter(NouveauSidecarImage(serveur, []byte("jpeg")))
+	if err := segment.Fermer(); err != nil {
+		t.Fatal(err)
+	}
+	if len(journal.segments) != 0 {
+		t.Errorf("%d segments encore suivis apres l'arret de la camera", len(journal.segments))
+	}
+
+	fichiers, _ := filepath.Glob(filepath.Join(dossier, "*.json"))
+	if len(fichiers) != 1 {
+		t.Fatalf("%d sidecars ecrits, attendu 1", len(fichiers))
+	}
+	contenu, _ := os.ReadFile(fichiers[0])
+	var lu SidecarSegment
+	if err := json.Unmarshal(contenu, &lu); err != nil {
+		t.Fatal(err)
+	}
+	if lu.Source != "camera 0" || len(lu.Images) != 4 {
+		t.Fatalf("segment %s de %d images", lu.Source, len(lu.Images))
+	}
+	premiere, derniere := lu.Images[0], lu.Images[3]
+	if premiere.Sha256Entree != empreinte(mat.ToBytes()) || premiere.Sha256Sortie != empreinte([]byte("jpeg")) {
+		t.Errorf("empreintes %s -> %s", premiere.Sha256Entree, premiere.Sha256Sortie)
+	}
+	if premiere.Anonymiseur != ANONYMISEUR_LOCAL || len(premiere.Detections) != 1 || !premiere.Detections[0].Autorisee {
+		t.Errorf("image locale %+v", premiere)
+	}
+	if derniere.Anonymiseur != ANONYMISEUR_SERVEUR || derniere.Sha256Entree != "" {
+		t.Errorf("image du serveur %+v", derniere)
+	}
+	if bytes.Contains(contenu, []byte("alice")) {
+		t.Error("le nom de la liste blanche est ecrit dans le sidecar")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"log/slog" //trace
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+// superposition de debogage pour regler les detecteurs : rectangles, pistes, confiance, fps et nom de la camera
+// dessinés sur l'image de la fenetre et de la diffusion mjpeg
+// reservée aux operateurs : elle ne s'active qu'au clavier du poste (touche 'o'), jamais par la configuration,
+// et sur la diffusion elle n'est dessinée que sur l'image deja anonymisée, avec seulement le type et la piste :
+// les noms de la liste blanche ne quittent pas la fenetre du poste
+
+var superposition atomic.Bool //desactivée au demarrage
+
+var COULEUR_TEXTE = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+var COULEUR_DETECTION_DEFAUT = color.RGBA{R: 255, G: 0, B: 255, A: 255}
+
+// couleur des rectangles par type de detection
+var COULEURS_DETECTIONS = map[string]color.RGBA{
+	"face":   {R: 0, G: 255, B: 0, A: 255},
+	"plate":  {R: 255, G: 255, B: 0, A: 255},
+	"person": {R: 0, G: 128, B: 255, A: 255},
+	"zone":   {R: 255, G: 0, B: 0, A: 255},
+}
+
+// bascule la superposition de toutes les cameras
+func BasculerSuperposition() {
+	active := !superposition.Load()
+	superposition.Store(active)
+	slog.Info("superposition de debogage", "active", active)
+}
+
+// superposition d'une camera, les fps sont ceux de l'affichage
+type Superposition struct {
+	camera   string
+	derniere time.Time
+	fps      float64 //moyenne glissante
+}
+
+func NouvelleSuperposition(no_device int) *Superposition {
+	return &Superposition{camera: "camera " + strconv.Itoa(no_device)}
+}
+
+// a appeler a chaque image affichée, meme desactivée, pour que les fps soient justes des l'activation
+func (s *Superposition) Mesurer() {
+	maintenant := time.Now()
+	if !s.derniere.IsZero() {
+		if ecart := maintenant.Sub(s.derniere).Seconds(); ecart > 0 {
+			s.fps = 0.9*s.fps + 0.1/ecart
+		}
+	}
+	s.derniere = maintenant
+}
+
+// dessine les detections et l'entete sur img si la superposition est active
+// diffusion : img part sur le flux mjpeg, les etiquettes sont reduites (voir etiquette)
+func (s *Superposition) Dessiner(img *gocv.Mat, detections []Detection, diffusion bool) {
+	if !superposition.Load() || img.Empty() {
+		return
+	}
+	for _, detection := range detections {
+		couleur, ok := COULEURS_DETECTIONS[detection.Type]
+		if !ok {
+			couleur = COULEUR_DETECTION_DEFAUT
+		}
+		gocv.Rectangle(img, detection.Rect, couleur, 2)
+		texteLisible(img, etiquette(detection, diffusion), image.Pt(detection.Rect.Min.X, detection.Rect.Min.Y-5), couleur)
+	}
+	entete := fmt.Sprintf("%s  %.1f fps  %d detection(s)", s.camera, s.fps, len(detections))
+	texteLisible(img, entete, image.Pt(10, 20), COULEUR_TEXTE)
+}
+
+// type, piste, confiance et personne de la liste blanche d'une detection
+// seulement le type et la piste pour la diffusion
+func etiquette(detection Detection, diffusion bool) string {
+	texte := detection.Type
+	if detection.Piste > 0 {
+		texte += " #" + strconv.Itoa(detection.Piste)
+	}
+	if diffusion {
+		return texte
+	}
+	if detection.Confiance != nil {
+		texte += fmt.Sprintf(" %.2f", *detection.Confiance)
+	}
+	if detection.Autorisee != "" {
+		texte += " (" + detection.Autorisee + ")"
+	}
+	return texte
+}
+
+// texte avec un contour noir, lisible sur une image claire comme sombre
+func texteLisible(img *gocv.Mat, texte string, position image.Point, couleur color.RGBA) {
+	if position.Y < 12 { //rectangle en haut de l'image, le texte passe a l'interieur
+		position.Y = 12
+	}
+	gocv.PutText(img, texte, position, gocv.FontHersheySimplex, 0.45, color.RGBA{A: 255}, 3)
+	gocv.PutText(img, texte, position, gocv.FontHersheySimplex, 0.45, couleur, 1)
+}
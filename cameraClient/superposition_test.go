@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEtiquette(t *testing.T) {
+	confiance := 0.87
+	cas := []struct {
+		nom       string
+		detection Detection
+		fenetre   string
+		diffusion string
+	}{
+		{"visage", Detection{Type: "face"}, "face", "face"},
+		{"piste", Detection{Type: "face", Piste: 4}, "face #4", "face #4"},
+		{"confiance", Detection{Type: "person", Piste: 2, Confiance: &confiance}, "person #2 0.87", "person #2"},
+		{"liste blanche", Detection{Type: "face", Piste: 7, Autorisee: "alice"}, "face #7 (alice)", "face #7"},
+	}
+	for _, c := range cas {
+		if texte := etiquette(c.detection, false); texte != c.fenetre {
+			t.Errorf("%s : fenetre %q, attendu %q", c.nom, texte, c.fenetre)
+		}
+		if texte := etiquette(c.detection, true); texte != c.diffusion {
+			t.Errorf("%s : diffusion %q, attendu %q", c.nom, texte, c.diffusion)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"strconv"
+)
+
+// zones d'une camera, en pixels de l'image de la camera, modifiables dans le fichier de configuration et rechargées a chaud
+// "zones": {"0": {"always_anonymize": [[[0,0],[200,0],[200,120],[0,120]]], "ignore": [...], "detect_only": [...]}}
+type ZonesCamera struct {
+	Anonymiser []Polygone `json:"always_anonymize"` //toujours anonymisées, qu'un visage y soit detecté ou non
+	Ignorer    []Polygone `json:"ignore"`           //affiches, ecrans : les detections dont le centre y est sont ignorées
+	DetectOnly []Polygone `json:"detect_only"`      //si non vide, seules les detections dont le centre est dans une de ces zones sont gardées
+}
+
+// polygone fermé, liste de points [x, y]
+type Polygone [][2]int
+
+func (poly Polygone) Valider() error {
+	if len(poly) < 3 {
+		return fmt.Errorf("%d points, au moins 3 attendus", len(poly))
+	}
+	for _, p := range poly {
+		if p[0] < 0 || p[1] < 0 {
+			return fmt.Errorf("point %v negatif", p)
+		}
+	}
+	return nil
+}
+
+// rectangle englobant
+func (poly Polygone) Bornes() image.Rectangle {
+	var bornes image.Rectangle
+	for i, p := range poly {
+		point := image.Rect(p[0], p[1], p[0]+1, p[1]+1)
+		if i == 0 {
+			bornes = point
+		} else {
+			bornes = bornes.Union(point)
+		}
+	}
+	return bornes
+}
+
+// test du point dans le polygone par le nombre de croisements d'une demi droite horizontale
+func (poly Polygone) Contient(pt image.Point) bool {
+	dedans := false
+	for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+		xi, yi, xj, yj := poly[i][0], poly[i][1], poly[j][0], poly[j][1]
+		if (yi > pt.Y) != (yj > pt.Y) && pt.X < xi+(pt.Y-yi)*(xj-xi)/(yj-yi) {
+			dedans = !dedans
+		}
+	}
+	return dedans
+}
+
+func dansUnPolygone(polys []Polygone, pt image.Point) bool {
+	for _, poly := range polys {
+		if poly.Contient(pt) {
+			return true
+		}
+	}
+	return false
+}
+
+func (zones ZonesCamera) Valider() error {
+	var erreurs []error
+	for nom, polys := range map[string][]Polygone{"always_anonymize": zones.Anonymiser, "ignore": zones.Ignorer, "detect_only": zones.DetectOnly} {
+		for i, poly := range polys {
+			if err := poly.Valider(); err != nil {
+				erreurs = append(erreurs, fmt.Errorf("%s[%d]: %w", nom, i, err))
+			}
+		}
+	}
+	return errors.Join(erreurs...)
+}
+
+// etape zones : filtre les detections avec les zones ignore et detect_only de la camera,
+// puis ajoute les zones always_anonymize ; a placer apres les detecteurs et avant anonymize
+type EtapeZones struct {
+	camera string //clé de la camera dans zones
+}
+
+func NouvellesZones(no_device int) (Etape, error) {
+	return EtapeZones{camera: strconv.Itoa(no_device)}, nil
+}
+
+func (EtapeZones) Nom() string { return "zones" }
+
+func (e EtapeZones) Traiter(trame *Trame) error {
+	zones, ok := ConfigActuelle().Zones[e.camera] //relues a chaque image pour suivre les modifications du fichier
+	if !ok {
+		return nil
+	}
+
+	gardees := trame.Detections[:0]
+	for _, detection := range trame.Detections {
+		centre := detection.Rect.Min.Add(detection.Rect.Max).Div(2)
+		if dansUnPolygone(zones.Ignorer, centre) {
+			continue
+		}
+		if len(zones.DetectOnly) > 0 && !dansUnPolygone(zones.DetectOnly, centre) {
+			continue
+		}
+		gardees = append(gardees, detection)
+	}
+	trame.Detections = gardees
+
+	for _, poly := range zones.Anonymiser {
+		trame.Detections = append(trame.Detections, Detection{Rect: poly.Bornes(), Type: "zone", Polygone: poly})
+	}
+	return nil
+}
+
+func (EtapeZones) Fermer() {}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func TestZones(t *testing.T) {
+	gauche, droite := Polygone{{0, 0}, {80, 0}, {80, 120}, {0, 120}}, Polygone{{80, 0}, {160, 0}, {160, 120}, {80, 120}}
+	aGauche, aDroite := image.Rect(10, 10, 50, 50), image.Rect(100, 10, 140, 50)
+
+	cas := []struct {
+		nom    string
+		zones  map[string]ZonesCamera
+		gardes []image.Rectangle //rectangles des detections apres l'etape, dans l'ordre
+	}{
+		{"sans zone", nil, []image.Rectangle{aGauche, aDroite}},
+		{"zones d'une autre camera", map[string]ZonesCamera{"1": {Ignorer: []Polygone{gauche}}}, []image.Rectangle{aGauche, aDroite}},
+		{"ignore", map[string]ZonesCamera{"0": {Ignorer: []Polygone{gauche}}}, []image.Rectangle{aDroite}},
+		{"detect_only", map[string]ZonesCamera{"0": {DetectOnly: []Polygone{gauche}}}, []image.Rectangle{aGauche}},
+		{"ignore prioritaire", map[string]ZonesCamera{"0": {Ignorer: []Polygone{gauche}, DetectOnly: []Polygone{gauche, droite}}}, []image.Rectangle{aDroite}},
+		{"always_anonymize", map[string]ZonesCamera{"0": {Anonymiser: []Polygone{ZONE_TEST}}}, []image.Rectangle{aGauche, aDroite, ZONE_TEST.Bornes()}},
+		{"always_anonymize dans ignore", map[string]ZonesCamera{"0": {Ignorer: []Polygone{gauche, droite}, Anonymiser: []Polygone{ZONE_TEST}}}, []image.Rectangle{ZONE_TEST.Bornes()}},
+	}
+	for _, c := range cas {
+		t.Run(c.nom, func(t *testing.T) {
+			configTest(t, func(config *Configuration) { config.Zones = c.zones })
+			etape, _ := NouvellesZones(0)
+			trame := &Trame{Detections: []Detection{{Rect: aGauche, Type: "face"}, {Rect: aDroite, Type: "face"}}}
+			if err := etape.Traiter(trame); err != nil {
+				t.Fatal(err)
+			}
+			if len(trame.Detections) != len(c.gardes) {
+				t.Fatalf("detections %v, attendu %v", trame.Detections, c.gardes)
+			}
+			for i, detection := range trame.Detections {
+				if detection.Rect != c.gardes[i] {
+					t.Errorf("detection %d a %v, attendu %v", i, detection.Rect, c.gardes[i])
+				}
+				if detection.Type == "zone" && detection.Polygone == nil {
+					t.Error("zone sans polygone, tout son rectangle serait anonymisé")
+				}
+			}
+		})
+	}
+}
+
+func TestPolygoneContient(t *testing.T) {
+	triangle := Polygone{{0, 0}, {100, 0}, {0, 100}}
+	cas := []struct {
+		point  image.Point
+		dedans bool
+	}{
+		{image.Pt(10, 10), true},
+		{image.Pt(60, 30), true},
+		{image.Pt(60, 60), false},
+		{image.Pt(150, 10), false},
+		{image.Pt(-1, 10), false},
+	}
+	for _, c := range cas {
+		if triangle.Contient(c.point) != c.dedans {
+			t.Errorf("Contient(%v) = %v, attendu %v", c.point, !c.dedans, c.dedans)
+		}
+	}
+	if triangle.Bornes() != image.Rect(0, 0, 101, 101) {
+		t.Errorf("bornes %v", triangle.Bornes())
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http" //api http
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+const PORT_HTTP = "27002"
+const HOTE_HTTP = "localhost"    //par defaut l'api n'est joignable que depuis le poste, http_host l'ouvre au reseau
+const TAILLE_MAX_HTTP = 20 << 20 //taille maximale d'une image envoyée sur l'api (20 Mo)
+
+var compteurRequetesHttp atomic.Uint64 //pour donner un identifiant aux requetes qui n'en ont pas
+
+// api http qui donne acces au meme traitement que la socket (DetectionVisageFloutage)
+type ApiHttp struct {
+	detecteurs Detecteurs
+	routes     *http.ServeMux
+}
+
+func NouvelleApiHttp(detecteurs Detecteurs) *ApiHttp {
+	api := &ApiHttp{detecteurs: detecteurs, routes: http.NewServeMux()}
+	api.routes.HandleFunc("/v1/anonymize", api.anonymiser)
+	api.routes.HandleFunc("/v1/detect", api.detecter)
+	return api
+}
+
+// chaque requete recoit un identifiant et est journalisée dans les logs et l'audit avec sa reponse
+func (api *ApiHttp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	debut := time.Now()
+	id := r.Header.Get("X-Request-ID")
+	if id == "" {
+		id = "http-" + strconv.FormatUint(compteurRequetesHttp.Add(1), 10)
+		r.Header.Set("X-Request-ID", id)
+	}
+	w.Header().Set("X-Request-ID", id)
+
+	suivi := &reponseSuivie{ResponseWriter: w, statut: http.StatusOK}
+	api.routes.ServeHTTP(suivi, r)
+
+	octetsEnvoyes.Ajouter("http", float64(suivi.taille))
+	if r.ContentLength > 0 {
+		octetsRecus.Ajouter("http", float64(r.ContentLength))
+	}
+	if suivi.statut >= http.StatusBadRequest {
+		erreurs.Ajouter("http_"+strconv.Itoa(suivi.statut), 1)
+	}
+
+	slog.Info("requete http", "remote", r.RemoteAddr, "requete", id, "methode", r.Method, "chemin", r.URL.Path,
+		"statut", suivi.statut, "taille_reponse", suivi.taille, "visages", w.Header().Get("X-Faces-Detected"), "duree", time.Since(debut))
+
+	details := map[string]interface{}{"requete": id, "methode": r.Method, "chemin": r.URL.Path, "parametres": r.URL.RawQuery, "statut": suivi.statut, "taille_reponse": suivi.taille}
+	if visages, err := strconv.Atoi(w.Header().Get("X-Faces-Detected")); err == nil {
+		details["visages"] = visages
+	}
+	audit.Ecrire("requete_http", r.RemoteAddr, details)
+}
+
+// garde le code et la taille de la reponse pour le journal d'audit
+type reponseSuivie struct {
+	http.ResponseWriter
+	statut int
+	taille int
+}
+
+func (reponse *reponseSuivie) WriteHeader(statut int) {
+	reponse.statut = statut
+	reponse.ResponseWriter.WriteHeader(statut)
+}
+
+func (reponse *reponseSuivie) Write(b []byte) (int, error) {
+	n, err := reponse.ResponseWriter.Write(b)
+	reponse.taille += n
+	return n, err
+}
+
+// lance le serveur http jusqu'a l'annulation de ctx, les requetes en cours ont DELAI_ARRET pour finir
+func ServirHttp(ctx context.Context, adresse string, handler http.Handler) {
+	serveur := &http.Server{Addr: adresse, Handler: handler}
+
+	erreur := make(chan error, 1)
+	go func() {
+		erreur <- serveur.ListenAndServe()
+	}()
+	slog.Info("api http en attente", "adresse", adresse)
+
+	select {
+	case err := <-erreur:
+		slog.Error("erreur de l'api http, elle est desactivée", "adresse", adresse, "erreur", err)
+		return
+	case <-ctx.Done():
+	}
+
+	arret, annuler := context.WithTimeout(context.Background(), DELAI_ARRET)
+	defer annuler()
+	if err := serveur.Shutdown(arret); err != nil {
+		slog.Warn("arret de l'api http", "erreur", err)
+	}
+}
+
+// POST /v1/anonymize?method=pixelate&block_size=16&detector=face&camera=entree
+// le corps est une image jpeg ou png, brute ou dans le champ "image" d'un formulaire multipart
+// on renvoie l'image anonymisée dans le meme format, sans aucune metadonnee (exif, xmp, iptc)
+func (api *ApiHttp) anonymiser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "methode non autorisée, utiliser POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params, err := parametresRequete(r.URL.Query())
+	if err == nil {
+		err = params.Valider(api.detecteurs)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	img_bytes, typeImage, code, err := lectureImageHttp(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	img, meta, err := DecoderSansMetadonnees(img_bytes, gocv.IMReadColor)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	defer img.Close()
+
+	plaques := ConfigActuelle().Plaques
+	img_blured_mat, regions, err := DetectionVisageFloutage(img, api.detecteurs, params, plaques)
+	defer img_blured_mat.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	extension := ".jpg"
+	if typeImage == "image/png" {
+		extension = ".png"
+	}
+	debutEncodage := time.Now()
+	img_blured_NBB, err := gocv.IMEncode(gocv.FileExt(extension), img_blured_mat)
+	latenceCodec.Duree("encode", debutEncodage)
+	if err != nil {
+		http.Error(w, "encodage de l'image: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer img_blured_NBB.Close()
+
+	sidecar := NouveauSidecar(api.detecteurs, params, plaques, img, regions, img_bytes, img_blured_NBB.GetBytes())
+	if err := sidecar.Chiffrer(img, regions.Toutes()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sidecar.Source = r.URL.Query().Get("camera")
+	if sidecar.Source == "" {
+		sidecar.Source = "http " + r.RemoteAddr
+	}
+	camera := r.URL.Query().Get("camera")
+	if camera == "" {
+		camera = "http" //pas l'adresse du client pour ne pas creer une serie par connexion
+	}
+	imagesTraitees.Ajouter(camera, 1)
+	if err := sidecars.Ecrire(sidecar); err != nil {
+		slog.Error("erreur d'ecriture du sidecar", "requete", r.Header.Get("X-Request-ID"), "erreur", err)
+		erreurs.Ajouter("sidecar", 1)
+	}
+
+	w.Header().Set("Content-Type", typeImage)
+	w.Header().Set("X-Faces-Detected", strconv.Itoa(len(regions.Visages)))
+	if plaques.Active {
+		w.Header().Set("X-Plates-Detected", strconv.Itoa(len(regions.Plaques)))
+	}
+	if len(meta.Retirees) > 0 {
+		w.Header().Set("X-Metadata-Removed", strings.Join(meta.Retirees, ","))
+	}
+	w.Write(img_blured_NBB.GetBytes())
+}
+
+// POST /v1/detect?detector=face
+// meme corps que /v1/anonymize, on renvoie seulement les rectangles en json
+// les cascades de haar ne donnent pas de score : confidence vaut null et confidence_available false
+func (api *ApiHttp) detecter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "methode non autorisée, utiliser POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params, err := parametresRequete(r.URL.Query())
+	if err == nil {
+		err = params.Valider(api.detecteurs)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	img_bytes, _, code, err := lectureImageHttp(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	resultat, visages, err := traitementDetection(img_bytes, api.detecteurs, params.Detecteur)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Faces-Detected", strconv.Itoa(visages))
+	w.Write(resultat)
+}
+
+// lit method, block_size et detector, les parametres absents gardent la valeur de la configuration
+func parametresRequete(query url.Values) (ParametresFloutage, error) {
+	params := ConfigActuelle().Floutage
+	if methode := query.Get("method"); methode != "" {
+		params.Methode = methode
+	}
+	if taille := query.Get("block_size"); taille != "" {
+		t, err := strconv.Atoi(taille)
+		if err != nil {
+			return params, fmt.Errorf("block_size invalide %q", taille)
+		}
+		params.TailleCarre = t
+	}
+	if detecteur := query.Get("detector"); detecteur != "" {
+		params.Detecteur = detecteur
+	}
+	return params, nil
+}
+
+// recupere l'image de la requete et son type (image/jpeg ou image/png)
+// en cas d'erreur on renvoie aussi le code http a repondre
+func lectureImageHttp(w http.ResponseWriter, r *http.Request) ([]byte, string, int, error) {
+	var corps io.Reader = r.Body
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		r.Body = http.MaxBytesReader(w, r.Body, TAILLE_MAX_HTTP)
+		fichier, _, err := r.FormFile("image")
+		if err != nil {
+			return nil, "", http.StatusBadRequest, fmt.Errorf("champ \"image\" absent ou trop volumineux: %w", err)
+		}
+		defer fichier.Close()
+		corps = fichier
+	}
+
+	img_bytes, err := io.ReadAll(io.LimitReader(corps, TAILLE_MAX_HTTP+1))
+	if err != nil {
+		return nil, "", http.StatusBadRequest, err
+	}
+	if len(img_bytes) > TAILLE_MAX_HTTP {
+		return nil, "", http.StatusRequestEntityTooLarge, fmt.Errorf("image trop volumineuse (max %d octets)", TAILLE_MAX_HTTP)
+	}
+	if len(img_bytes) == 0 {
+		return nil, "", http.StatusBadRequest, errors.New("image absente")
+	}
+
+	typeImage := http.DetectContentType(img_bytes) //on se fie au contenu plutot qu'a l'entete
+	if typeImage != "image/jpeg" && typeImage != "image/png" {
+		return nil, "", http.StatusUnsupportedMediaType, fmt.Errorf("type d'image non supporté %q, seuls jpeg et png sont acceptés", typeImage)
+	}
+	return img_bytes, typeImage, 0, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func multipartTest(t *testing.T, champ string, contenu []byte) ([]byte, string) {
+	t.Helper()
+	var corps bytes.Buffer
+	formulaire := multipart.NewWriter(&corps)
+	fichier, err := formulaire.CreateFormFile(champ, "photo.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fichier.Write(contenu)
+	if err := formulaire.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return corps.Bytes(), formulaire.FormDataContentType()
+}
+
+func TestApiAnonymiser(t *testing.T) {
+	api := NouvelleApiHttp(detecteursTest(t))
+	jpg, png := jpegTest(t, 80, 60), pngTest(t, 80, 60)
+	formulaire, typeFormulaire := multipartTest(t, "image", jpg)
+	sansChamp, typeSansChamp := multipartTest(t, "photo", jpg)
+
+	cas := []struct {
+		nom         string
+		methode     string
+		parametres  string
+		corps       []byte
+		contentType string
+		statut      int
+		typeImage   string //type de la reponse si statut vaut 200
+	}{
+		{"jpeg brut", http.MethodPost, "", jpg, "image/jpeg", http.StatusOK, "image/jpeg"},
+		{"png brut", http.MethodPost, "", png, "image/png", http.StatusOK, "image/png"},
+		{"formulaire multipart", http.MethodPost, "", formulaire, typeFormulaire, http.StatusOK, "image/jpeg"},
+		{"flou", http.MethodPost, "?method=blur&block_size=9", jpg, "image/jpeg", http.StatusOK, "image/jpeg"},
+		{"rectangle noir", http.MethodPost, "?method=fill", jpg, "image/jpeg", http.StatusOK, "image/jpeg"},
+		{"pixelisation et detecteur", http.MethodPost, "?method=pixelate&block_size=8&detector=face", png, "image/png", http.StatusOK, "image/png"},
+		{"methode inconnue", http.MethodPost, "?method=sepia", jpg, "image/jpeg", http.StatusBadRequest, ""},
+		{"taille de carré illisible", http.MethodPost, "?block_size=grand", jpg, "image/jpeg", http.StatusBadRequest, ""},
+		{"taille de carré trop petite", http.MethodPost, "?block_size=1", jpg, "image/jpeg", http.StatusBadRequest, ""},
+		{"detecteur inconnu", http.MethodPost, "?detector=chat", jpg, "image/jpeg", http.StatusBadRequest, ""},
+		{"detecteur de plaques", http.MethodPost, "?detector=plate", jpg, "image/jpeg", http.StatusBadRequest, ""},
+		{"corps vide", http.MethodPost, "", nil, "image/jpeg", http.StatusBadRequest, ""},
+		{"corps texte", http.MethodPost, "", []byte("pas une image"), "image/jpeg", http.StatusUnsupportedMediaType, ""},
+		{"formulaire sans champ image", http.MethodPost, "", sansChamp, typeSansChamp, http.StatusBadRequest, ""},
+		{"methode GET", http.MethodGet, "", nil, "", http.StatusMethodNotAllowed, ""},
+	}
+	for _, c := range cas {
+		t.Run(c.nom, func(t *testing.T) {
+			requete := httptest.NewRequest(c.methode, "/v1/anonymize"+c.parametres, bytes.NewReader(c.corps))
+			if c.contentType != "" {
+				requete.Header.Set("Content-Type", c.contentType)
+			}
+			reponse := httptest.NewRecorder()
+			api.ServeHTTP(reponse, requete)
+
+			if reponse.Code != c.statut {
+				t.Fatalf("statut %d, attendu %d : %s", reponse.Code, c.statut, reponse.Body.String())
+			}
+			if reponse.Header().Get("X-Request-ID") == "" {
+				t.Error("X-Request-ID absent")
+			}
+			if c.statut != http.StatusOK {
+				return
+			}
+			if typeImage := reponse.Header().Get("Content-Type"); typeImage != c.typeImage {
+				t.Errorf("Content-Type %q, attendu %q", typeImage, c.typeImage)
+			}
+			if reponse.Header().Get("X-Faces-Detected") != "0" { //le degradé ne contient aucun visage
+				t.Errorf("X-Faces-Detected %q, attendu 0", reponse.Header().Get("X-Faces-Detected"))
+			}
+			config, _, err := image.DecodeConfig(reponse.Body)
+			if err != nil {
+				t.Fatalf("image renvoyée illisible: %v", err)
+			}
+			if config.Width != 80 || config.Height != 60 {
+				t.Errorf("image renvoyée de %dx%d, attendu 80x60", config.Width, config.Height)
+			}
+		})
+	}
+}
+
+func TestApiDetecter(t *testing.T) {
+	api := NouvelleApiHttp(detecteursTest(t))
+	requete := httptest.NewRequest(http.MethodPost, "/v1/detect?detector=face", bytes.NewReader(jpegTest(t, 80, 60)))
+	reponse := httptest.NewRecorder()
+	api.ServeHTTP(reponse, requete)
+
+	if reponse.Code != http.StatusOK {
+		t.Fatalf("statut %d : %s", reponse.Code, reponse.Body.String())
+	}
+	if typeReponse := reponse.Header().Get("Content-Type"); typeReponse != "application/json" {
+		t.Errorf("Content-Type %q, attendu application/json", typeReponse)
+	}
+	var resultat ResultatDetection
+	if err := json.Unmarshal(reponse.Body.Bytes(), &resultat); err != nil {
+		t.Fatalf("json illisible %s: %v", reponse.Body.String(), err)
+	}
+	if resultat.Largeur != 80 || resultat.Hauteur != 60 || len(resultat.Visages) != 0 {
+		t.Errorf("resultat inattendu %s", reponse.Body.String())
+	}
+	if !bytes.Contains(reponse.Body.Bytes(), []byte(`"confidence_available":false`)) {
+		t.Errorf("confidence_available absent : %s", reponse.Body.String())
+	}
+}
+
+// ecart moyen par canal entre deux images dans zone, de 0 a 255
+func ecartMoyen(a, b image.Image, zone image.Rectangle) float64 {
+	total, n := 0.0, 0.0
+	for y := zone.Min.Y; y < zone.Max.Y; y++ {
+		for x := zone.Min.X; x < zone.Max.X; x++ {
+			ra, ga, ba, _ := a.At(x, y).RGBA()
+			rb, gb, bb, _ := b.At(x, y).RGBA()
+			for _, d := range []float64{float64(ra>>8) - float64(rb>>8), float64(ga>>8) - float64(gb>>8), float64(ba>>8) - float64(bb>>8)} {
+				total += math.Abs(d)
+				n++
+			}
+		}
+	}
+	return total / n
+}
+
+func requeteApi(t *testing.T, api *ApiHttp, route string, corps []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	requete := httptest.NewRequest(http.MethodPost, route, bytes.NewReader(corps))
+	requete.Header.Set("Content-Type", "image/jpeg")
+	reponse := httptest.NewRecorder()
+	api.ServeHTTP(reponse, requete)
+	if reponse.Code != http.StatusOK {
+		t.Fatalf("%s: statut %d : %s", route, reponse.Code, reponse.Body.String())
+	}
+	return reponse
+}
+
+// testdata/visage.jpg est l'image de test de gocv (images/face.jpg), un visage frontal en 640x480
+func TestApiVisage(t *testing.T) {
+	api := NouvelleApiHttp(detecteursTest(t))
+	jpg, err := os.ReadFile(filepath.Join("testdata", "visage.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entree, _, err := image.Decode(bytes.NewReader(jpg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resultat ResultatDetection
+	if err := json.Unmarshal(requeteApi(t, api, "/v1/detect?detector=face", jpg).Body.Bytes(), &resultat); err != nil {
+		t.Fatal(err)
+	}
+	if len(resultat.Visages) == 0 {
+		t.Fatal("aucun visage detecté")
+	}
+	boite := resultat.Visages[0]
+	visage := image.Rect(boite.X, boite.Y, boite.X+boite.Largeur, boite.Y+boite.Hauteur)
+	fond := image.Rect(0, 0, 200, 120) //mur en haut a gauche, jamais anonymisé
+	for _, b := range resultat.Visages {
+		if fond.Overlaps(image.Rect(b.X, b.Y, b.X+b.Largeur, b.Y+b.Hauteur)) {
+			t.Fatalf("visage detecté dans le fond %+v", b)
+		}
+	}
+
+	parametres := []string{"?method=pixelate&block_size=8&detector=face", "?method=pixelate&block_size=32", "?method=blur&block_size=25", "?method=fill"}
+	sorties := make([]image.Image, len(parametres))
+	ecarts := make([]float64, len(parametres))
+	for i, p := range parametres {
+		reponse := requeteApi(t, api, "/v1/anonymize"+p, jpg)
+		if visages, _ := strconv.Atoi(reponse.Header().Get("X-Faces-Detected")); visages < 1 {
+			t.Fatalf("%s: X-Faces-Detected %q", p, reponse.Header().Get("X-Faces-Detected"))
+		}
+		if sorties[i], _, err = image.Decode(reponse.Body); err != nil {
+			t.Fatalf("%s: image renvoyée illisible: %v", p, err)
+		}
+		ecarts[i] = ecartMoyen(entree, sorties[i], visage)
+		if ecarts[i] < 6 {
+			t.Errorf("%s: visage presque inchangé, ecart moyen %.1f", p, ecarts[i])
+		}
+		if ecart := ecartMoyen(entree, sorties[i], fond); ecart > 3 { //seulement le reencodage jpeg
+			t.Errorf("%s: fond modifié, ecart moyen %.1f", p, ecart)
+		}
+	}
+	if ecarts[1] <= ecarts[0] {
+		t.Errorf("des carrés de 32 pixels (ecart %.1f) doivent plus modifier le visage que des carrés de 8 (ecart %.1f)", ecarts[1], ecarts[0])
+	}
+	for i := range sorties {
+		for j := i + 1; j < len(sorties); j++ {
+			if ecart := ecartMoyen(sorties[i], sorties[j], visage); ecart < 3 {
+				t.Errorf("%s et %s donnent le meme visage (ecart moyen %.1f)", parametres[i], parametres[j], ecart)
+			}
+		}
+	}
+
+	//les parametres de detection comptent aussi : un visage plus petit que min_size n'est pas anonymisé
+	configTest(t, func(c *Configuration) { c.Detection.TailleMin = 1000 })
+	reponse := requeteApi(t, api, "/v1/anonymize", jpg)
+	if reponse.Header().Get("X-Faces-Detected") != "0" {
+		t.Errorf("X-Faces-Detected %q avec min_size 1000", reponse.Header().Get("X-Faces-Detected"))
+	}
+	sortie, _, err := image.Decode(reponse.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ecart := ecartMoyen(entree, sortie, visage); ecart > 3 {
+		t.Errorf("visage modifié sans detection, ecart moyen %.1f", ecart)
+	}
+}
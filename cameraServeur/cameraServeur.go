@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"     //annulation des goroutines a l'arret
+	"errors"      //erreurs de la connexion
 	"fmt"         //print
 	"image"       //image
 	"image/color" //couleur des pixels
-	"log"         //trace
+	"image/draw"  //remplissage des rectangles
+	"io"          //lecture complete de la socket
+	"log/slog"    //trace
 	"net"         //socket
-	"strconv"     //conversion avec des string
+	"net/http"    //metriques
+	"os"
+	"os/signal" //interception de ctrl+c et SIGTERM
+	"strconv"   //conversion avec des string
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"gocv.io/x/gocv" //librairie gocv
 )
@@ -17,58 +27,151 @@ import (
 const PORT = "27001" //port choisi aléatoirement
 const BUFFERSIZE = 1024
 
+const FIN_CONNEXION = "FIN"              //message envoyé a la place de la taille de l'image quand le client se deconnecte
+const COMMANDE_DETECTION = "DETECT"      //envoyé avant la taille de l'image pour ne recevoir que les rectangles en json
+const DELAI_INACTIVITE = 5 * time.Minute //on ferme une connexion qui n'envoie plus rien depuis ce delai
+const DELAI_ARRET = 30 * time.Second     //temps laissé aux traitements en cours pour finir a l'arret du serveur
+
+var ErrFinConnexion = errors.New("le client a annoncé sa déconnexion")
+
+const METHODE_PIXEL = "pixelate" //pixelisation par carrés (blurMaison)
+const METHODE_FLOU = "blur"      //flou gaussien de gocv
+const METHODE_NOIR = "fill"      //rectangle noir
+
+const TAILLE_CARRE_MIN = 2
+const TAILLE_CARRE_MAX = 256
+
+// parametres de l'anonymisation demandés par le client
+type ParametresFloutage struct {
+	Methode     string `json:"method"`     //METHODE_PIXEL, METHODE_FLOU ou METHODE_NOIR
+	TailleCarre int    `json:"block_size"` //taille des carrés de la pixelisation ou du noyau du flou
+	Detecteur   string `json:"detector"`   //nom du detecteur dans CASCADES
+}
+
+var PARAMETRES_DEFAUT = ParametresFloutage{Methode: METHODE_PIXEL, TailleCarre: 16, Detecteur: DETECTEUR_DEFAUT}
+
+func (p ParametresFloutage) Valider(detecteurs Detecteurs) error {
+	if err := p.valider(); err != nil {
+		return err
+	}
+	if p.Detecteur == DETECTEUR_PLAQUES {
+		return fmt.Errorf("%q detecte les plaques, pas les visages", p.Detecteur)
+	}
+	if _, ok := detecteurs[p.Detecteur]; !ok {
+		return fmt.Errorf("detecteur inconnu %q", p.Detecteur)
+	}
+	return nil
+}
+
+// methode et taille, communes aux visages et aux plaques
+func (p ParametresFloutage) valider() error {
+	switch p.Methode {
+	case METHODE_PIXEL, METHODE_FLOU, METHODE_NOIR:
+	default:
+		return fmt.Errorf("methode inconnue %q", p.Methode)
+	}
+	if p.TailleCarre < TAILLE_CARRE_MIN || p.TailleCarre > TAILLE_CARRE_MAX {
+		return fmt.Errorf("taille de carré %d hors de [%d, %d]", p.TailleCarre, TAILLE_CARRE_MIN, TAILLE_CARRE_MAX)
+	}
+	return nil
+}
+
 //fonction qui detecte les visages, convertit l'image, la floute , la reconvertit
-func DetectionVisageFloutage(img gocv.Mat, classifier gocv.CascadeClassifier) gocv.Mat {
+//les plaques sont detectées et anonymisées ensuite avec leurs propres parametres, si elles sont activées
+func DetectionVisageFloutage(img gocv.Mat, detecteurs Detecteurs, params ParametresFloutage, paramsPlaques ParametresPlaques) (gocv.Mat, Regions, error) {
+	detecteur, ok := detecteurs[params.Detecteur]
+	if !ok {
+		return gocv.NewMat(), Regions{}, fmt.Errorf("detecteur inconnu %q", params.Detecteur)
+	}
+
+	// detection visages qui sont retournés dans une liste de rectangles
+	regions := Regions{Visages: detecteur.Detecter(img, ConfigActuelle().Detection)}
+	visagesParImage.Observer("", float64(len(regions.Visages)))
+	plaques, err := DetecterPlaques(img, detecteurs, paramsPlaques)
+	if err != nil {
+		return gocv.NewMat(), regions, err
+	}
+	regions.Plaques = plaques
+
+	newmat, err := Anonymiser(img, regions.Visages, params)
+	if err != nil || len(regions.Plaques) == 0 {
+		return newmat, regions, err
+	}
+	defer newmat.Close()
+	finale, err := Anonymiser(newmat, regions.Plaques, paramsPlaques.Floutage())
+	return finale, regions, err
+}
+
+// anonymise chaque rectangle de img avec la methode demandée, img n'est pas modifiée
+func Anonymiser(img gocv.Mat, rects []image.Rectangle, params ParametresFloutage) (gocv.Mat, error) {
+	defer latenceAnonymisation.Duree(params.Methode, time.Now())
+	if params.Methode == METHODE_FLOU { //le flou se fait directement sur la matrice gocv
+		newmat := img.Clone()
+		noyau := params.TailleCarre | 1 //la taille du noyau doit etre impaire
+		for _, rect := range rects {
+			rect = rect.Intersect(image.Rect(0, 0, newmat.Cols(), newmat.Rows()))
+			if rect.Empty() {
+				continue
+			}
+			region := newmat.Region(rect) //la region partage les pixels de newmat
+			gocv.GaussianBlur(region, &region, image.Pt(noyau, noyau), 0, 0, gocv.BorderDefault)
+			region.Close()
+		}
+		return newmat, nil
+	}
+
 	Img_modifiable, err := img.ToImage() // image.ToImage est la fonction qui convertie une matrice gocv.Mat en une image.image (modifiable)
 	if err != nil {
-		log.Fatal("erreur conversion matricegocv en image.image ", err)
+		return gocv.NewMat(), fmt.Errorf("erreur conversion matricegocv en image.image: %w", err)
 	}
 
 	Img_RGBA, ok := Img_modifiable.(*image.RGBA) //On passe finalImg en image de type RGBA qui est un sous type de image.image
 	if !ok {
-		log.Fatal("Image pas de type rgba, et donc non modifiable")
+		return gocv.NewMat(), errors.New("image pas de type rgba, et donc non modifiable")
 	}
 
-	// detection visages qui sont retournés dans une liste de rectangles
-	rects := classifier.DetectMultiScale(img)
-
 	// pour chaque rectangle (visage)
+	var floutages sync.WaitGroup //on attend la fin de tous les floutages avant de reconvertir l'image
 	for _, rect := range rects { // _ recupere l'indice dont on n'a pas besoin et rect recupere l'elmt de la liste
-		go blurMaison(Img_RGBA, rect) //on crée une goroutine sans attendre sa fin pour flouter l'interieur d'un rectangle dans Img_RGBA
-		//gocv.GaussianBlur(imgFace, &imgFace, image.Pt(75, 75), 0, 0, gocv.BorderDefault) on aurait pu utiliser cette fonction de flouttage
+		floutages.Add(1)
+		go func(rect image.Rectangle) { //on crée une goroutine pour flouter l'interieur d'un rectangle dans Img_RGBA
+			defer floutages.Done()
+			if params.Methode == METHODE_NOIR {
+				draw.Draw(Img_RGBA, rect, image.Black, image.Point{}, draw.Src)
+			} else {
+				blurMaison(Img_RGBA, rect, params.TailleCarre)
+			}
+		}(rect)
 	}
+	floutages.Wait()
 
-	newmat, err := NewMatRGB8FromImage(Img_RGBA) //fonction qui convertit image RGBA en matrice gocv
-	if err != nil {
-		log.Fatal(err)
-	}
-	return newmat
+	return NewMatRGB8FromImage(Img_RGBA) //fonction qui convertit image RGBA en matrice gocv
 
 }
 
 // flouter l'interieur d'un rectangle dans Img_RGBA
-// on divise le rectangle en carrés de 16 x 16 bits
+// on divise le rectangle en carrés de TAILLE_CARRE x TAILLE_CARRE pixels
 // on calcule la moyenne de chaque couleurs d'un carré et on affecte cette couleur a tout le carré
-func blurMaison(imageInOut *image.RGBA, rectangle image.Rectangle) { //on retourne la meme image qu'en entrée mais modifiée
-
-	TAILLE_CARRE := 16 //on fait des carrés de ce nombre de pixels
-	SURFACE_CARRE := uint32(TAILLE_CARRE * TAILLE_CARRE)
+func blurMaison(imageInOut *image.RGBA, rectangle image.Rectangle, TAILLE_CARRE int) { //on retourne la meme image qu'en entrée mais modifiée
 
-	bounds := rectangle.Bounds() //on recupere les contours du rectangle
-	min := bounds.Min            // point min, en haut a gauche
-	max := bounds.Max            // point max, en bas a droite
+	bounds := rectangle.Intersect(imageInOut.Bounds()) //on recupere les contours du rectangle, sans deborder de l'image
+	min := bounds.Min                                  // point min, en haut a gauche
+	max := bounds.Max                                  // point max, en bas a droite
 
 	for y := min.Y; y < max.Y; y += TAILLE_CARRE { //on boucle sur chaque carré en y et en x
 		for x := min.X; x < max.X; x += TAILLE_CARRE {
+			carre := image.Rect(x, y, x+TAILLE_CARRE, y+TAILLE_CARRE).Intersect(bounds) //les carrés du bord sont coupés
+			SURFACE_CARRE := uint32(carre.Dx() * carre.Dy())
+
 			//a chaque nouveau carré initialisation des totaux rgba en 32bits
 			rtot := uint32(0)
 			gtot := uint32(0)
 			btot := uint32(0)
 			atot := uint32(0)
 
-			for yy := 0; yy < TAILLE_CARRE; yy++ { //on boucle sur l'interieur de chaque carré (on commence en haut a gauche)
-				for xx := 0; xx < TAILLE_CARRE; xx++ {
-					r, g, b, a := imageInOut.At(x+xx, y+yy).RGBA() //on recupere les valeurs rgba actuelles d'un pixel de l'image en 32 bits
+			for yy := carre.Min.Y; yy < carre.Max.Y; yy++ { //on boucle sur l'interieur de chaque carré (on commence en haut a gauche)
+				for xx := carre.Min.X; xx < carre.Max.X; xx++ {
+					r, g, b, a := imageInOut.At(xx, yy).RGBA() //on recupere les valeurs rgba actuelles d'un pixel de l'image en 32 bits
 					rtot += r
 					gtot += g
 					btot += b
@@ -86,9 +189,9 @@ func blurMaison(imageInOut *image.RGBA, rectangle image.Rectangle) { //on retour
 			bmoy8 := uint8(bmoy32 >> 8)
 			amoy8 := uint8(amoy32 >> 8)
 
-			for yy := 0; yy < TAILLE_CARRE; yy++ { //on boucle sur l'interieur de chaque carré (on commence en haut a gauche)
-				for xx := 0; xx < TAILLE_CARRE; xx++ {
-					imageInOut.Set(x+xx, y+yy, color.RGBA{rmoy8, gmoy8, bmoy8, amoy8}) //on affecte les memes valeurs rgba a tous les pixels du carré
+			for yy := carre.Min.Y; yy < carre.Max.Y; yy++ { //on boucle sur l'interieur de chaque carré (on commence en haut a gauche)
+				for xx := carre.Min.X; xx < carre.Max.X; xx++ {
+					imageInOut.Set(xx, yy, color.RGBA{rmoy8, gmoy8, bmoy8, amoy8}) //on affecte les memes valeurs rgba a tous les pixels du carré
 				}
 			}
 		}
@@ -114,93 +217,277 @@ func NewMatRGB8FromImage(img image.Image) (gocv.Mat, error) { //return renvoie 2
 }
 
 //traitement screenshot
-func screenshotserveur(connection net.Conn, classifier gocv.CascadeClassifier) {
+// on traite les images du client jusqu'a sa deconnexion, son inactivité ou l'arret du serveur (ctx)
+// logger porte l'adresse et le numero de la connexion
+func screenshotserveur(ctx context.Context, connection net.Conn, detecteurs Detecteurs, logger *slog.Logger) {
+	defer connection.Close()
+	adresse := connection.RemoteAddr().String()
+	codec := CODEC_DEFAUT         //jusqu'a ce que le client en negocie un autre
+	source := "socket " + adresse //jusqu'a ce que le client donne le nom de sa camera
+
+	//a l'arret du serveur on debloque la lecture en attente, un traitement deja commencé va jusqu'au bout
+	fini := make(chan struct{})
+	defer close(fini)
+	go func() {
+		select {
+		case <-ctx.Done():
+			connection.SetReadDeadline(time.Now())
+		case <-fini:
+		}
+	}()
+
+	for noRequete := 1; ; noRequete++ { //permet de recevoir plusieurs screenshot
+		connection.SetReadDeadline(time.Now().Add(ConfigActuelle().DelaiInactivite.Duration())) //on repousse le delai d'inactivité avant chaque image
+		if ctx.Err() != nil {                                                                   //verifié apres le delai pour ne pas ecraser celui posé a l'arret
+			logger.Info("arret du serveur, fermeture de la connexion")
+			audit.Ecrire("deconnexion", adresse, map[string]interface{}{"raison": "arret du serveur"})
+			return
+		}
+
+		logger.Debug("en attente de reception de l'image a flouter")
+
+		//l'entete est soit une commande suivie de la taille de l'image, soit directement la taille (floutage)
+		entete, err := LectureEntete(connection)
+		commande := entete
+		if err == nil && commande == COMMANDE_FLUX { //la connexion reste en flux jusqu'a sa fin
+			fermetureConnexion(ctx, logger, adresse, sessionFlux(ctx, connection, detecteurs, codec, source, logger))
+			return
+		}
+		if err == nil && (commande == COMMANDE_DETECTION || commande == COMMANDE_CODEC || commande == COMMANDE_SOURCE) { //la commande est suivie de son contenu
+			entete, err = LectureEntete(connection)
+		}
+		var img_bytes []byte
+		if err == nil {
+			img_bytes, err = ReceptionCorps(connection, entete)
+		}
+		if err != nil {
+			fermetureConnexion(ctx, logger, adresse, err)
+			return
+		}
+
+		debut := time.Now()
+		logRequete := logger.With("requete", noRequete, "source", source) //la requete est identifiée par la connexion et son numero
+		var reponse []byte
+		nomCommande, visages := commande, -1 //nombre de visages inconnu pour les commandes sans detection
+		switch commande {
+		case COMMANDE_DETECTION:
+			reponse, visages, err = traitementDetection(img_bytes, detecteurs, ConfigActuelle().Floutage.Detecteur)
+		case COMMANDE_CODEC:
+			var negocie Codec
+			negocie, reponse, err = reponseNegociationCodec(img_bytes)
+			if err == nil {
+				codec = negocie
+				logRequete.Info("codec negocié", "codec", codec.Format, "qualite", codec.Qualite, "largeur_max", codec.LargeurMax)
+			}
+		case COMMANDE_SOURCE:
+			source = string(img_bytes)
+			reponse = img_bytes //on confirme la source
+		default:
+			nomCommande = "FLOUTAGE"
+			var sidecar Sidecar
+			reponse, sidecar, err = traitementImage(img_bytes, detecteurs, codec)
+			if err == nil {
+				visages = len(sidecar.Visages)
+				imagesTraitees.Ajouter(source, 1)
+				sidecar.Source = source
+				if err := sidecars.Ecrire(sidecar); err != nil {
+					logRequete.Error("erreur d'ecriture du sidecar", "erreur", err)
+					erreurs.Ajouter("sidecar", 1)
+				}
+			}
+		}
+		if err != nil {
+			logRequete.Error("erreur de traitement de l'image", "commande", nomCommande, "erreur", err)
+			erreurs.Ajouter("traitement", 1)
+			reponse = nil //on renvoie une reponse vide pour que le client ne reste pas en attente
+		} else {
+			logRequete.Info("requete traitée", "commande", nomCommande, "taille_requete", len(img_bytes), "taille_reponse", len(reponse), "visages", visages, "duree", time.Since(debut))
+		}
+
+		details := map[string]interface{}{"commande": nomCommande, "source": source, "taille_requete": len(img_bytes), "taille_reponse": len(reponse)}
+		if visages >= 0 {
+			details["visages"] = visages
+		}
+		if err != nil {
+			details["erreur"] = err.Error()
+		}
+		audit.Ecrire("requete", adresse, details)
 
-	for { //permet de recevoir plusieurs screenshot
-		img_bytes := ReceptionImage(connection)
+		if err := EnvoiImage(reponse, connection); err != nil {
+			logRequete.Error("erreur d'envoi, fermeture de la connexion", "erreur", err)
+			erreurs.Ajouter("envoi", 1)
+			audit.Ecrire("deconnexion", adresse, map[string]interface{}{"raison": "erreur d'envoi", "erreur": err.Error()})
+			return
+		}
+	}
 
-		img_screenshot, _ := gocv.IMDecode(img_bytes, 1) //on decode des bytes au format jpg (1) pr avoir une gocv.Mat
+}
 
-		img_blured_mat := DetectionVisageFloutage(img_screenshot, classifier)
+// affiche et journalise la raison de la fin de la connexion a partir de l'erreur de reception
+func fermetureConnexion(ctx context.Context, logger *slog.Logger, adresse string, err error) {
+	var netErr net.Error
+	details := map[string]interface{}{}
+	switch {
+	case errors.Is(err, ErrFinConnexion):
+		logger.Info("client déconnecté")
+		details["raison"] = "client déconnecté"
+	case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed):
+		logger.Info("connexion fermée par le client")
+		details["raison"] = "connexion fermée par le client"
+	case errors.As(err, &netErr) && netErr.Timeout() && ctx.Err() != nil:
+		logger.Info("arret du serveur, fermeture de la connexion")
+		details["raison"] = "arret du serveur"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		logger.Info("client inactif, fermeture de la connexion", "delai", ConfigActuelle().DelaiInactivite.Duration())
+		details["raison"] = "inactivité"
+	default:
+		logger.Warn("erreur de reception, fermeture de la connexion", "erreur", err)
+		details["raison"] = "erreur de reception"
+		erreurs.Ajouter("reception", 1)
+		details["erreur"] = err.Error()
+	}
+	audit.Ecrire("deconnexion", adresse, details)
+}
 
-		img_blured_NBB, _ := gocv.IMEncode(".jpg", img_blured_mat) //gocv.Mat to *gocvNativeByteBuffer en utilisant le format jpg
+// decode l'image recue, floute les visages et la reencode avec le codec de la connexion
+// le sidecar decrit le traitement, sans sa source
+func traitementImage(img_bytes []byte, detecteurs Detecteurs, codec Codec) ([]byte, Sidecar, error) {
+	config := ConfigActuelle()                                                    //les memes parametres pour toute l'image meme si la configuration est rechargée
+	img_screenshot, _, err := DecoderSansMetadonnees(img_bytes, gocv.IMReadColor) //on decode des bytes pr avoir une gocv.Mat
+	if err != nil {
+		return nil, Sidecar{}, err
+	}
+	defer img_screenshot.Close()
 
-		EnvoiImage(img_blured_NBB.GetBytes(), connection) //getBytes = from *gocvNativeByteBuffer to bytes
+	img_blured_mat, regions, err := DetectionVisageFloutage(img_screenshot, detecteurs, config.Floutage, config.Plaques)
+	defer img_blured_mat.Close()
+	if err != nil {
+		return nil, Sidecar{}, err
 	}
 
+	img_blured_bytes, err := codec.Encoder(img_blured_mat) //gocv.Mat to bytes dans le format negocié
+	if err != nil {
+		return nil, Sidecar{}, err
+	}
+	sidecar := NouveauSidecar(detecteurs, config.Floutage, config.Plaques, img_screenshot, regions, img_bytes, img_blured_bytes)
+	if err := sidecar.Chiffrer(img_screenshot, regions.Toutes()); err != nil {
+		return nil, Sidecar{}, err
+	}
+	return img_blured_bytes, sidecar, nil
 }
 
-func EnvoiImage(img_bytes []byte, connection net.Conn) {
+func EnvoiImage(img_bytes []byte, connection net.Conn) error {
+	tailleBuffer := ConfigActuelle().TailleBuffer //lue une fois pour toute l'image
 
 	//envoie de la taille de l'image au serveur
 	//fillString = comble une chaine a 10 caracteres (Le second 10)
 	//FormatInt = transforme un int en string en utlisant la base 10
 	Img_size := fillString(strconv.FormatInt(int64(len(img_bytes)), 10), 10) //bufSize = string
-	fmt.Println("taille image =", len(img_bytes), " buff=", Img_size)
-	connection.Write([]byte(Img_size)) //.write = envoie de bytes dans un socket //[]byte = cast string en bytes
+	slog.Debug("envoi de l'image", "remote", connection.RemoteAddr().String(), "taille", len(img_bytes))
+	if _, err := connection.Write([]byte(Img_size)); err != nil { //.write = envoie de bytes dans un socket //[]byte = cast string en bytes
+		return err
+	}
 
 	var sentBytes int64
 	sentBytes = 0
-	fmt.Println("Start sending image")
 
 	for { //on divise l'image en paquets de bytes de lataille du buffersize (1024 bytes)
-		if (int64(len(img_bytes)) - sentBytes) <= BUFFERSIZE { //dernier envoie de paquet
+		if (int64(len(img_bytes)) - sentBytes) <= tailleBuffer { //dernier envoie de paquet
 
 			sendBuffer := img_bytes[sentBytes:int64(len(img_bytes))] //sendBuffer = dernier paquet de l'image bytes
-			connection.Write(sendBuffer)
+			if _, err := connection.Write(sendBuffer); err != nil {
+				return err
+			}
 			//fmt.Println("Image envoyé de l'index", sentBytes, " à:", int64(len(img_bytes)))
 
 			break
 		}
 
 		//cas classique de paquet de 1024 bytes
-		sendBuffer := img_bytes[sentBytes : sentBytes+BUFFERSIZE]
-		connection.Write(sendBuffer)
+		sendBuffer := img_bytes[sentBytes : sentBytes+tailleBuffer]
+		if _, err := connection.Write(sendBuffer); err != nil {
+			return err
+		}
 		//fmt.Println("keep sending image:", noimg, "from index:", sentBytes, " to:", sentBytes+BUFFERSIZE)
 
-		sentBytes += BUFFERSIZE
+		sentBytes += tailleBuffer
 	}
-	fmt.Println("Fin envoi de l'image")
+	octetsEnvoyes.Ajouter("socket", float64(len(img_bytes)))
+	slog.Debug("fin envoi de l'image", "remote", connection.RemoteAddr().String())
+	return nil
 }
 
-func ReceptionImage(connection net.Conn) []byte {
+// renvoie io.EOF si le client a fermé la connexion entre deux images et ErrFinConnexion s'il l'a annoncé
+func ReceptionImage(connection net.Conn) ([]byte, error) {
+	entete, err := LectureEntete(connection)
+	if err != nil {
+		return nil, err
+	}
+	return ReceptionCorps(connection, entete)
+}
 
-	var buffImage []byte //buffer qui va contenir l'image complete
+// lit les 10 octets d'entete (taille de l'image ou commande) sans les ":" de remplissage
+func LectureEntete(connection net.Conn) (string, error) {
+	bufferImageSize := make([]byte, 10) //creation du buffer de taille 10 bytes contenant la taille de l'image
 
-	fmt.Println("En attente de reception de l'image a flouter ")
+	if _, err := io.ReadFull(connection, bufferImageSize); err != nil { //lit le msg contenant la taille de l'image
+		return "", err
+	}
+	return strings.Trim(string(bufferImageSize), ":"), nil //on enleve les ":" a la chaine pour avoir uniquement la taille de l'image
+}
 
-	bufferImageSize := make([]byte, 10) //creation du buffer de taille 10 bytes contenant la taille de l'image
+// lit l'image dont la taille a ete lue dans l'entete cut_buffer
+func ReceptionCorps(connection net.Conn, cut_buffer string) ([]byte, error) {
+
+	var buffImage []byte                          //buffer qui va contenir l'image complete
+	tailleBuffer := ConfigActuelle().TailleBuffer //lue une fois pour toute l'image
 
-	connection.Read(bufferImageSize)                         //lit le msg contenant la taille de l'image
-	cut_buffer := strings.Trim(string(bufferImageSize), ":") //on enleve les ":" a la chaine pour avoir uniquement la taille de l'image
-	imageSize, _ := strconv.ParseInt(cut_buffer, 10, 64)     //conversion from string to int64 en base 10
+	if cut_buffer == FIN_CONNEXION {
+		return nil, ErrFinConnexion
+	}
+	imageSize, err := strconv.ParseInt(cut_buffer, 10, 64) //conversion from string to int64 en base 10
+	if err != nil {
+		return nil, fmt.Errorf("taille d'image illisible %q: %w", cut_buffer, err)
+	}
 
 	//fmt.Println("Image size:", imageSize, " bufsize:", bufferImageSize, "   ", string(bufferImageSize))
 
-	if imageSize == 0 { //pb dans la transmission de la taille
-		fmt.Println("Image size is zero")
-		return buffImage //retourne un buffer vide
+	if imageSize <= 0 { //pb dans la transmission de la taille
+		return nil, errors.New("image size is zero")
 	}
 
 	var receivedBytes int64 = 0
 
 	for { //on lit les paquets de 1024 bytes pour reconstituer l'image //on boucle sur chaque paquets
-		if (imageSize - receivedBytes) < BUFFERSIZE { //cas du dernier paquet
+		if (imageSize - receivedBytes) < tailleBuffer { //cas du dernier paquet
 
-			buffPartImage := make([]byte, imageSize-receivedBytes) //creation d'un buffer uniquement pour le dernier paquet
-			connection.Read(buffPartImage)                         //on lit le dernier paquet
-			buffImage = append(buffImage, buffPartImage...)        //on rajoute le dernier paquet dans le buffimage
+			buffPartImage := make([]byte, imageSize-receivedBytes)            //creation d'un buffer uniquement pour le dernier paquet
+			if _, err := io.ReadFull(connection, buffPartImage); err != nil { //on lit le dernier paquet
+				return nil, noEOF(err)
+			}
+			buffImage = append(buffImage, buffPartImage...) //on rajoute le dernier paquet dans le buffimage
 			break
 		}
-		buffPartImage := make([]byte, BUFFERSIZE)
-		connection.Read(buffPartImage)
+		buffPartImage := make([]byte, tailleBuffer)
+		if _, err := io.ReadFull(connection, buffPartImage); err != nil {
+			return nil, noEOF(err)
+		}
 		buffImage = append(buffImage, buffPartImage...) //on rajoute un paquet dans le buffimage
 		//fmt.Println("Keep receiving image:", noimg, " index:", receivedBytes)
-		receivedBytes += BUFFERSIZE //on passe au prochain paquet
+		receivedBytes += tailleBuffer //on passe au prochain paquet
 	}
-	fmt.Println("On a recu l'image complete de taille :", imageSize)
+	octetsRecus.Ajouter("socket", float64(imageSize))
+	slog.Debug("image complete recue", "remote", connection.RemoteAddr().String(), "taille", imageSize)
 
-	return buffImage //en byte
+	return buffImage, nil //en byte
+}
+
+// une fin de connexion au milieu d'une image n'est pas une deconnexion normale
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
 }
 
 func fillString(returnString string, toLength int) string { //comble le msg de 10 octet
@@ -216,40 +503,173 @@ func fillString(returnString string, toLength int) string { //comble le msg de 1
 }
 
 func main() {
+	os.Exit(executerCommande(os.Args[1:]))
+}
+
+// serveur socket et api http jusqu'a ctrl+c ou SIGTERM
+func commandeServe(args []string) int {
+
+	options := nouvellesOptions("serve", "[options]", "lance le serveur socket et l'api http, jusqu'a ctrl+c ou SIGTERM.")
+	dossierSidecars := options.String("sidecars", "", "dossier ou ecrire un sidecar json pour chaque image anonymisée (desactivé si vide)")
+	fichierAudit := options.String("audit", "", "fichier du journal d'audit chainé (desactivé si vide)")
+	cleAudit := options.String("audit-key", "", "fichier de la clé hmac du journal d'audit, 32 octets ou 64 caracteres hexadecimaux (obligatoire avec -audit)")
+	verifierAudit := options.String("verifier-audit", "", "verifie la chaine du journal d'audit donné puis quitte (comme verify-audit)")
+	avecMetriques := options.Bool("metrics", false, "expose les metriques prometheus sur /metrics de l'api http")
+	communes := optionsCommunes(options)
+	if err := options.Parse(args); err != nil {
+		return codeAnalyse(err)
+	}
+
+	if *verifierAudit != "" {
+		return commandeVerifierAudit(*verifierAudit, *cleAudit)
+	}
+
+	config, code := communes.Preparer()
+	if code != SORTIE_OK {
+		return code
+	}
+	fichierConfig := communes.fichierConfig
+
+	slog.Info("début programme serveur")
+
+	serveurip := "localhost:" + config.Port
+
+	//ctx est annulé a la reception de ctrl+c ou SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// charger les classifieurs pour reconnaitre qqch à partir de gocv (au moins le visage frontal)
+	detecteurs, code := chargerDetecteursConfig(config)
+	if code != SORTIE_OK {
+		return code
+	}
+	arretForce := false
+	defer func() {
+		//apres un arret forcé des traitements utilisent encore les classifieurs, ils sont liberés avec le processus
+		if !arretForce {
+			detecteurs.Close()
+		}
+	}()
 
-	fmt.Println("Début programme Serveur")
+	var err error
+	if code := chargerCleConfig(config); code != SORTIE_OK {
+		return code
+	}
+	if cleRedaction != nil && *dossierSidecars == "" {
+		slog.Error("la redaction reversible garde les regions chiffrées dans les sidecars, -sidecars est obligatoire")
+		return SORTIE_CONFIGURATION
+	}
+	if *dossierSidecars != "" {
+		sidecars, err = NouveauJournalSidecars(*dossierSidecars)
+		if err != nil {
+			slog.Error("erreur sur le dossier des sidecars", "dossier", *dossierSidecars, "erreur", err)
+			return SORTIE_CONFIGURATION
+		}
+		slog.Info("sidecars activés", "dossier", *dossierSidecars)
+	}
 
-	serveurip := "localhost:" + PORT
+	if code := ouvrirAudit(*fichierAudit, *cleAudit); code != SORTIE_OK {
+		return code
+	}
+	if audit != nil {
+		defer audit.Close() //apres un arret forcé les evenements des connexions encore en cours sont ignorés ; les sidecars n'ont rien a fermer
+		slog.Info("journal d'audit activé", "fichier", *fichierAudit)
+	}
+	audit.Ecrire("demarrage", "", map[string]interface{}{"port": config.Port, "port_http": config.PortHttp, "opencv_version": gocv.OpenCVVersion(), "configuration": *fichierConfig})
 
-	// charger le classifieur pour reconnaitre qqch à partir de gocv
-	classifier := gocv.NewCascadeClassifier()
-	defer classifier.Close()
+	if *fichierConfig != "" {
+		go SurveillerConfiguration(ctx, *fichierConfig, func(c *Configuration) error {
+			return c.ValiderDetecteurs(detecteurs) //les detecteurs doivent faire partie de ceux chargés au demarrage
+		})
+	}
 
-	//charger un modele de reconnaissance (ici visage frontal)
-	if !classifier.Load("C:\\opencv\\haar-cascade-files-master\\haarcascade_frontalface_default.xml") {
-		log.Fatal("Erreur chargement du fichier: data/haarcascade_frontalface_default.xml")
+	var clients sync.WaitGroup //connexions en cours, attendues avant de quitter
+	sante := NouvelleSante(detecteurs, serveurip)
+
+	//api http pour les clients qui ne parlent pas le protocole de la socket
+	//demarrée avant l'auto test pour que /readyz reponde pendant le demarrage
+	clients.Add(1)
+	go func() {
+		defer clients.Done()
+		routes := http.NewServeMux() //sante et metriques en dehors de l'api pour que les sondes ne remplissent pas les logs et l'audit
+		routes.Handle("/", NouvelleApiHttp(detecteurs))
+		routes.HandleFunc("/healthz", sante.Vivant)
+		routes.HandleFunc("/readyz", sante.Pret)
+		adresse := net.JoinHostPort(config.HoteHttp, config.PortHttp)
+		if *avecMetriques {
+			routes.HandleFunc("/metrics", ServirMetriques)
+			slog.Info("metriques activées", "adresse", "http://"+adresse+"/metrics")
+		}
+		ServirHttp(ctx, adresse, routes)
+	}()
+
+	//on verifie que la chaine d'anonymisation fonctionne avant d'accepter des clients
+	debutTest := time.Now()
+	err = AutoTest(detecteurs)
+	sante.ResultatAutoTest(err, time.Since(debutTest))
+	audit.Ecrire("auto_test", "", map[string]interface{}{"ok": err == nil, "duree": time.Since(debutTest).String()})
+	if err != nil {
+		slog.Error("auto test echoué, le serveur refuse de demarrer", "erreur", err)
+		return SORTIE_TRAITEMENT
 	}
+	slog.Info("auto test reussi", "duree", time.Since(debutTest))
 
 	serveur, err := net.Listen("tcp", serveurip) //serveur en attente sur la socket d'écoute
 	if err != nil {
-		log.Fatal("Erreur sur la socket d'écoute: ", err)
+		slog.Error("erreur sur la socket d'écoute", "adresse", serveurip, "erreur", err)
+		return SORTIE_CONNEXION
 	}
 	defer serveur.Close()
-	fmt.Println("Serveur en attente de connections...")
-
-	for { //boucle infinie sur attente de connection
+	sante.Ecoute(true)
+	slog.Info("serveur en attente de connections", "adresse", serveurip)
+
+	//a l'arret on ferme la socket d'écoute pour sortir de Accept
+	go func() {
+		<-ctx.Done()
+		slog.Info("arret demandé, on n'accepte plus de connexions")
+		sante.Ecoute(false)
+		serveur.Close()
+	}()
+
+	for idConnexion := 1; ; idConnexion++ { //boucle sur attente de connection jusqu'a l'arret
 		connection, err := serveur.Accept() //il y a une connection et on attribue un id unique (connection)
 		if err != nil {
-			log.Fatal("Erreur sur la socket d'écoute: ", err)
+			if ctx.Err() == nil {
+				slog.Error("erreur sur la socket d'écoute", "erreur", err)
+				code = SORTIE_CONNEXION
+			}
+			break //on laisse finir les clients connectés dans les deux cas
 		}
 
-		fmt.Println("Client connecté")
-
-		go screenshotserveur(connection, classifier) //go routine au cas ou il y a plusieurs clients
+		logger := slog.With("remote", connection.RemoteAddr().String(), "connexion", idConnexion)
+		logger.Info("client connecté")
+		audit.Ecrire("connexion", connection.RemoteAddr().String(), nil)
+
+		clients.Add(1)
+		connexionsActives.Ajouter("", 1)
+		go func() { //go routine au cas ou il y a plusieurs clients
+			defer clients.Done()
+			defer connexionsActives.Ajouter("", -1)
+			screenshotserveur(ctx, connection, detecteurs, logger)
+		}()
 	}
 
-	fmt.Println("Fin programme serveur")
+	//on laisse les images en cours de traitement etre renvoyées avant de quitter
+	termine := make(chan struct{})
+	go func() {
+		clients.Wait()
+		close(termine)
+	}()
+	select {
+	case <-termine:
+	case <-time.After(DELAI_ARRET):
+		slog.Warn("des traitements ne sont pas terminés, arret forcé", "delai", DELAI_ARRET)
+		arretForce = true
+	}
+	audit.Ecrire("arret", "", nil)
 
+	slog.Info("fin programme serveur")
+	return code
 }
 
 /*
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+const COMMANDE_CODEC = "CODEC" //negociation du format des images, suivie de la demande du client en json
+
+// format de transmission des images negocié avec le client
+type Codec struct {
+	Format     string `json:"codec"`     //jpg, png ou webp
+	Qualite    int    `json:"quality"`   //de 1 a 100 pour jpg et webp, ignorée pour png (sans perte)
+	LargeurMax int    `json:"max_width"` //les images plus larges sont reduites avant l'envoi, 0 pour ne jamais reduire
+}
+
+// demande du client : formats par ordre de preference
+type DemandeCodec struct {
+	Formats    []string `json:"codecs"`
+	Qualite    int      `json:"quality"`
+	LargeurMax int      `json:"max_width"`
+}
+
+var CODEC_DEFAUT = Codec{Format: "jpg", Qualite: 95} //celui des clients qui ne negocient pas
+
+var FORMATS = map[string]gocv.FileExt{"jpg": gocv.JPEGFileExt, "png": gocv.PNGFileExt, "webp": ".webp"}
+
+var formatsTestes sync.Once
+var formatsDisponibles = map[string]bool{}
+
+// un format n'est disponible que si opencv a ete compilé avec, on le verifie en encodant une petite image
+func FormatDisponible(format string) bool {
+	formatsTestes.Do(func() {
+		img := gocv.NewMatWithSize(8, 8, gocv.MatTypeCV8UC3)
+		defer img.Close()
+		for nom, extension := range FORMATS {
+			if buffer, err := gocv.IMEncode(extension, img); err == nil {
+				formatsDisponibles[nom] = buffer.Len() > 0
+				buffer.Close()
+			}
+		}
+	})
+	return formatsDisponibles[format]
+}
+
+// choisit le premier format demandé que l'on sait encoder
+func NegociationCodec(demande DemandeCodec) (Codec, error) {
+	codec := CODEC_DEFAUT
+	if demande.Qualite != 0 {
+		if demande.Qualite < 1 || demande.Qualite > 100 {
+			return codec, fmt.Errorf("qualité %d hors de [1, 100]", demande.Qualite)
+		}
+		codec.Qualite = demande.Qualite
+	}
+	if demande.LargeurMax < 0 {
+		return codec, fmt.Errorf("largeur maximale %d negative", demande.LargeurMax)
+	}
+	codec.LargeurMax = demande.LargeurMax
+
+	for _, format := range demande.Formats {
+		if FormatDisponible(format) {
+			codec.Format = format
+			return codec, nil
+		}
+	}
+	return codec, fmt.Errorf("aucun des formats %v n'est disponible", demande.Formats)
+}
+
+// lit la demande du client et prepare la reponse en json avec le codec choisi
+// en cas d'erreur le client recoit une reponse vide et garde CODEC_DEFAUT
+func reponseNegociationCodec(demande_bytes []byte) (Codec, []byte, error) {
+	var demande DemandeCodec
+	if err := json.Unmarshal(demande_bytes, &demande); err != nil {
+		return Codec{}, nil, fmt.Errorf("demande de codec illisible: %w", err)
+	}
+	codec, err := NegociationCodec(demande)
+	if err != nil {
+		return Codec{}, nil, err
+	}
+	reponse, err := json.Marshal(codec)
+	return codec, reponse, err
+}
+
+// reduit l'image si besoin puis l'encode dans le format du codec
+func (codec Codec) Encoder(img gocv.Mat) ([]byte, error) {
+	defer latenceCodec.Duree("encode", time.Now())
+	if codec.LargeurMax > 0 && img.Cols() > codec.LargeurMax {
+		reduite := gocv.NewMat()
+		defer reduite.Close()
+		hauteur := img.Rows() * codec.LargeurMax / img.Cols()
+		gocv.Resize(img, &reduite, image.Pt(codec.LargeurMax, hauteur), 0, 0, gocv.InterpolationArea)
+		img = reduite
+	}
+
+	extension, ok := FORMATS[codec.Format]
+	if !ok {
+		return nil, fmt.Errorf("format inconnu %q", codec.Format)
+	}
+	var params []int
+	switch codec.Format {
+	case "jpg":
+		params = []int{gocv.IMWriteJpegQuality, codec.Qualite}
+	case "webp":
+		params = []int{gocv.IMWriteWebpQuality, codec.Qualite}
+	}
+
+	buffer, err := gocv.IMEncodeWithParams(extension, img, params)
+	if err != nil {
+		return nil, fmt.Errorf("encodage %s de l'image: %w", codec.Format, err)
+	}
+	defer buffer.Close()
+	return append([]byte(nil), buffer.GetBytes()...), nil //copie car GetBytes pointe dans le buffer natif libéré par Close
+}
+
+// decode une image dans n'importe quel format supporté par opencv
+func Decoder(img_bytes []byte, flags gocv.IMReadFlag) (gocv.Mat, error) {
+	defer latenceCodec.Duree("decode", time.Now())
+	img, err := gocv.IMDecode(img_bytes, flags)
+	if err != nil {
+		return img, fmt.Errorf("decodage de l'image: %w", err)
+	}
+	if img.Empty() {
+		img.Close()
+		return img, errors.New("image recue illisible")
+	}
+	return img, nil
+}
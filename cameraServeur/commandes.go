@@ -0,0 +1,456 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+// codes de sortie communs a toutes les commandes
+const (
+	SORTIE_OK            = 0
+	SORTIE_TRAITEMENT    = 1 //image illisible, anonymisation ou auto test echoué
+	SORTIE_CONFIGURATION = 2 //options, fichier de configuration ou modeles invalides
+	SORTIE_CONNEXION     = 3 //socket d'écoute indisponible
+)
+
+const NOM_PROGRAMME = "cameraServeur"
+
+type Commande struct {
+	Nom    string
+	Resume string
+	Lancer func(args []string) int
+}
+
+// dans une fonction car l'aide fait partie des commandes
+func listeCommandes() []Commande {
+	return []Commande{
+		{"serve", "lance le serveur (commande par defaut)", commandeServe},
+		{"anonymize", "anonymise une image sans passer par le reseau", commandeAnonymize},
+		{"detect", "affiche en json les visages detectés sur une image", commandeDetect},
+		{"bench", "mesure le temps de traitement d'une image", commandeBench},
+		{"reveal", "restaure les regions d'origine d'une image avec la clé de redaction", commandeReveal},
+		{"verify-audit", "verifie la chaine d'un journal d'audit", commandeVerifyAudit},
+		{"help", "affiche cette aide", commandeAide},
+	}
+}
+
+// sans commande, ou avec seulement des options, on lance le serveur comme avant les sous-commandes
+func executerCommande(args []string) int {
+	if len(args) == 0 || (strings.HasPrefix(args[0], "-") && !estAide(args[0])) {
+		return commandeServe(args)
+	}
+	if estAide(args[0]) {
+		return commandeAide(args[1:])
+	}
+	for _, commande := range listeCommandes() {
+		if commande.Nom == args[0] {
+			return commande.Lancer(args[1:])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "commande inconnue %q\n\n", args[0])
+	aide(os.Stderr)
+	return SORTIE_CONFIGURATION
+}
+
+func estAide(arg string) bool {
+	return arg == "-h" || arg == "-help" || arg == "--help"
+}
+
+func commandeAide(args []string) int {
+	aide(os.Stdout)
+	return SORTIE_OK
+}
+
+func aide(w io.Writer) {
+	fmt.Fprintf(w, "usage : %s <commande> [options]\n\ncommandes :\n", NOM_PROGRAMME)
+	for _, commande := range listeCommandes() {
+		fmt.Fprintf(w, "  %-13s %s\n", commande.Nom, commande.Resume)
+	}
+	fmt.Fprintf(w, "\n%s <commande> -help donne les options de la commande\n", NOM_PROGRAMME)
+	fmt.Fprintf(w, "codes de sortie : %d ok, %d erreur de traitement, %d erreur de configuration, %d erreur de connexion\n",
+		SORTIE_OK, SORTIE_TRAITEMENT, SORTIE_CONFIGURATION, SORTIE_CONNEXION)
+}
+
+// options de la commande, l'aide donne l'usage et la description
+func nouvellesOptions(nom, usage, description string) *flag.FlagSet {
+	options := flag.NewFlagSet(nom, flag.ContinueOnError)
+	options.Usage = func() {
+		fmt.Fprintf(options.Output(), "usage : %s %s %s\n\n%s\n\noptions :\n", NOM_PROGRAMME, nom, usage, description)
+		options.PrintDefaults()
+	}
+	return options
+}
+
+// code de sortie de l'analyse des options, -help n'est pas une erreur
+func codeAnalyse(err error) int {
+	if errors.Is(err, flag.ErrHelp) {
+		return SORTIE_OK
+	}
+	return SORTIE_CONFIGURATION
+}
+
+// options de log et de configuration communes aux commandes
+type OptionsCommunes struct {
+	niveauLogs    *string
+	formatLogs    *string
+	fichierConfig *string
+	surcharges    func(*Configuration)
+}
+
+func optionsCommunes(options *flag.FlagSet) *OptionsCommunes {
+	return &OptionsCommunes{
+		niveauLogs:    options.String("log-level", "info", "niveau des logs : debug, info, warn ou error"),
+		formatLogs:    options.String("log-format", "text", "format des logs : text ou json"),
+		fichierConfig: options.String("config", "", "fichier de configuration json, rechargé sur SIGHUP ou a sa modification par serve (valeurs par defaut si vide)"),
+		surcharges:    optionsConfiguration(options),
+	}
+}
+
+// configure les logs et charge la configuration, renvoie SORTIE_OK ou SORTIE_CONFIGURATION
+func (o *OptionsCommunes) Preparer() (*Configuration, int) {
+	if err := ConfigurerLogs(*o.niveauLogs, *o.formatLogs); err != nil {
+		fmt.Fprintln(os.Stderr, "options de log invalides :", err)
+		return nil, SORTIE_CONFIGURATION
+	}
+	surchargesCommande = o.surcharges
+	config, err := ChargerConfiguration(*o.fichierConfig)
+	if err != nil {
+		slog.Error("configuration invalide", "fichier", *o.fichierConfig, "erreur", err)
+		return nil, SORTIE_CONFIGURATION
+	}
+	configuration.Store(config)
+	return config, SORTIE_OK
+}
+
+// detecteurs de la configuration, les detecteurs choisis doivent en faire partie
+func chargerDetecteursConfig(config *Configuration) (Detecteurs, int) {
+	detecteurs, err := ChargerDetecteurs(config.DossierCascades)
+	if err != nil {
+		slog.Error("chargement des detecteurs impossible", "erreur", err)
+		return nil, SORTIE_CONFIGURATION
+	}
+	if err := config.ValiderDetecteurs(detecteurs); err != nil {
+		detecteurs.Close()
+		slog.Error("configuration invalide", "erreur", err)
+		return nil, SORTIE_CONFIGURATION
+	}
+	return detecteurs, SORTIE_OK
+}
+
+// ouvre le journal d'audit global avec sa clé hmac, audit reste nil si aucun fichier n'est donné
+func ouvrirAudit(chemin string, fichierCle string) int {
+	if chemin == "" {
+		return SORTIE_OK
+	}
+	cle, err := ChargerCleAudit(fichierCle)
+	if err == nil {
+		audit, err = OuvrirJournalAudit(chemin, cle)
+	}
+	if err != nil {
+		slog.Error("journal d'audit inutilisable, verifier avec verify-audit", "fichier", chemin, "erreur", err)
+		return SORTIE_CONFIGURATION
+	}
+	return SORTIE_OK
+}
+
+// clé de la redaction reversible de la configuration, cleRedaction reste nil si aucun fichier n'est donné
+func chargerCleConfig(config *Configuration) int {
+	if config.CleRedaction == "" {
+		return SORTIE_OK
+	}
+	cle, err := ChargerCle(config.CleRedaction)
+	if err != nil {
+		slog.Error("clé de redaction inutilisable", "erreur", err)
+		return SORTIE_CONFIGURATION
+	}
+	cleRedaction = cle
+	slog.Info("redaction reversible activée", "cle", idCle(cle))
+	return SORTIE_OK
+}
+
+func commandeAnonymize(args []string) int {
+	options := nouvellesOptions("anonymize", "-in image.jpg -out image_floutee.jpg [options]",
+		"anonymise les visages d'une image jpeg, png ou webp avec les reglages de la configuration.\nl'image produite ne contient aucune metadonnee, son format suit l'extension de -out.\navec -redaction-key, les regions d'origine chiffrées sont ecrites dans le sidecar <out>.json.")
+	entree := options.String("in", "", "image a anonymiser")
+	sortie := options.String("out", "", "image anonymisée a ecrire")
+	communes := optionsCommunes(options)
+	if err := options.Parse(args); err != nil {
+		return codeAnalyse(err)
+	}
+	if *entree == "" || *sortie == "" {
+		fmt.Fprintln(os.Stderr, "-in et -out sont obligatoires")
+		options.Usage()
+		return SORTIE_CONFIGURATION
+	}
+	config, code := communes.Preparer()
+	if code != SORTIE_OK {
+		return code
+	}
+	if code := chargerCleConfig(config); code != SORTIE_OK {
+		return code
+	}
+	detecteurs, code := chargerDetecteursConfig(config)
+	if code != SORTIE_OK {
+		return code
+	}
+	defer detecteurs.Close()
+
+	img_bytes, err := os.ReadFile(*entree)
+	if err != nil {
+		slog.Error("lecture de l'image impossible", "fichier", *entree, "erreur", err)
+		return SORTIE_TRAITEMENT
+	}
+	img, _, err := DecoderSansMetadonnees(img_bytes, gocv.IMReadColor)
+	if err != nil {
+		slog.Error("image illisible", "fichier", *entree, "erreur", err)
+		return SORTIE_TRAITEMENT
+	}
+	defer img.Close()
+
+	img_blured_mat, regions, err := DetectionVisageFloutage(img, detecteurs, config.Floutage, config.Plaques)
+	defer img_blured_mat.Close()
+	if err != nil {
+		slog.Error("erreur d'anonymisation", "erreur", err)
+		return SORTIE_TRAITEMENT
+	}
+	if ok := gocv.IMWrite(*sortie, img_blured_mat); !ok {
+		slog.Error("ecriture de l'image impossible, verifier le dossier et l'extension", "fichier", *sortie)
+		return SORTIE_TRAITEMENT
+	}
+	fmt.Println(len(regions.Visages), "visage(s) anonymisé(s) avec", config.Floutage.Methode, "dans", *sortie)
+	if config.Plaques.Active {
+		fmt.Println(len(regions.Plaques), "plaque(s) anonymisée(s) avec", config.Plaques.Methode)
+	}
+
+	if cleRedaction != nil {
+		img_sortie, err := os.ReadFile(*sortie) //l'empreinte du sidecar est celle du fichier ecrit
+		if err != nil {
+			slog.Error("relecture de l'image ecrite impossible", "fichier", *sortie, "erreur", err)
+			return SORTIE_TRAITEMENT
+		}
+		sidecar := NouveauSidecar(detecteurs, config.Floutage, config.Plaques, img, regions, img_bytes, img_sortie)
+		sidecar.Source = "fichier " + filepath.Base(*entree)
+		if err := sidecar.Chiffrer(img, regions.Toutes()); err != nil {
+			slog.Error("erreur de redaction", "erreur", err)
+			return SORTIE_TRAITEMENT
+		}
+		contenu, err := json.MarshalIndent(sidecar, "", "  ")
+		if err == nil {
+			err = os.WriteFile(*sortie+".json", contenu, 0o640)
+		}
+		if err != nil {
+			slog.Error("ecriture du sidecar impossible", "fichier", *sortie+".json", "erreur", err)
+			return SORTIE_TRAITEMENT
+		}
+		fmt.Println(len(sidecar.Redaction.Regions), "region(s) chiffrée(s) dans", *sortie+".json")
+	}
+	return SORTIE_OK
+}
+
+func commandeReveal(args []string) int {
+	options := nouvellesOptions("reveal", "-in image_floutee.jpg -sidecar sidecar.json -out image.png -redaction-key cle [options]",
+		"remet dans l'image anonymisée les pixels d'origine chiffrés dans son sidecar, a l'echelle de l'image si le codec l'a reduite.\nreservé aux demandes legales : avec -audit, la restauration est inscrite au journal d'audit.")
+	entree := options.String("in", "", "image anonymisée")
+	fichierSidecar := options.String("sidecar", "", "sidecar de l'image, ecrit par serve -sidecars ou anonymize")
+	numero := options.Int("frame", 0, "numero de l'image dans un sidecar de segment de flux, a partir de 0")
+	sortie := options.String("out", "", "image restaurée a ecrire, png conseillé pour ne pas perdre de detail")
+	fichierAudit := options.String("audit", "", "journal d'audit chainé ou inscrire la restauration (desactivé si vide)")
+	cleAudit := options.String("audit-key", "", "fichier de la clé hmac du journal d'audit (obligatoire avec -audit)")
+	communes := optionsCommunes(options)
+	if err := options.Parse(args); err != nil {
+		return codeAnalyse(err)
+	}
+	if *entree == "" || *fichierSidecar == "" || *sortie == "" {
+		fmt.Fprintln(os.Stderr, "-in, -sidecar et -out sont obligatoires")
+		options.Usage()
+		return SORTIE_CONFIGURATION
+	}
+	config, code := communes.Preparer()
+	if code != SORTIE_OK {
+		return code
+	}
+	if code := chargerCleConfig(config); code != SORTIE_OK {
+		return code
+	}
+	if cleRedaction == nil {
+		fmt.Fprintln(os.Stderr, "la clé de redaction est obligatoire (-redaction-key, redaction_key_file ou "+PREFIXE_ENV+"REDACTION_KEY_FILE)")
+		return SORTIE_CONFIGURATION
+	}
+	if code := ouvrirAudit(*fichierAudit, *cleAudit); code != SORTIE_OK {
+		return code
+	}
+	defer audit.Close()
+
+	redaction, err := LireRedaction(*fichierSidecar, *numero)
+	if err != nil {
+		slog.Error("sidecar inutilisable", "erreur", err)
+		return SORTIE_TRAITEMENT
+	}
+	img := gocv.IMRead(*entree, gocv.IMReadColor)
+	if img.Empty() {
+		slog.Error("image illisible", "fichier", *entree)
+		return SORTIE_TRAITEMENT
+	}
+	defer img.Close()
+
+	details := map[string]interface{}{"image": *entree, "sidecar": *fichierSidecar, "frame": *numero, "cle": redaction.IdCle, "regions": len(redaction.Regions)}
+	if err := ReveleRegions(cleRedaction, &img, redaction); err != nil {
+		details["erreur"] = err.Error()
+		audit.Ecrire("revelation", "", details)
+		slog.Error("restauration impossible", "erreur", err)
+		if errors.Is(err, ErrMauvaiseCle) {
+			return SORTIE_CONFIGURATION
+		}
+		return SORTIE_TRAITEMENT
+	}
+	if ok := gocv.IMWrite(*sortie, img); !ok {
+		slog.Error("ecriture de l'image impossible, verifier le dossier et l'extension", "fichier", *sortie)
+		return SORTIE_TRAITEMENT
+	}
+	details["sortie"] = *sortie
+	audit.Ecrire("revelation", "", details)
+	fmt.Println(len(redaction.Regions), "region(s) restaurée(s) dans", *sortie)
+	return SORTIE_OK
+}
+
+func commandeDetect(args []string) int {
+	options := nouvellesOptions("detect", "-in image.jpg [options]",
+		"affiche sur la sortie standard le json des visages detectés, comme POST /v1/detect.\nles cascades de haar ne donnent pas de score : confidence vaut null et confidence_available false.")
+	entree := options.String("in", "", "image a analyser")
+	communes := optionsCommunes(options)
+	if err := options.Parse(args); err != nil {
+		return codeAnalyse(err)
+	}
+	if *entree == "" {
+		fmt.Fprintln(os.Stderr, "-in est obligatoire")
+		options.Usage()
+		return SORTIE_CONFIGURATION
+	}
+	config, code := communes.Preparer()
+	if code != SORTIE_OK {
+		return code
+	}
+	detecteurs, code := chargerDetecteursConfig(config)
+	if code != SORTIE_OK {
+		return code
+	}
+	defer detecteurs.Close()
+
+	img_bytes, err := os.ReadFile(*entree)
+	if err != nil {
+		slog.Error("lecture de l'image impossible", "fichier", *entree, "erreur", err)
+		return SORTIE_TRAITEMENT
+	}
+	resultat, _, err := traitementDetection(img_bytes, detecteurs, config.Floutage.Detecteur)
+	if err != nil {
+		slog.Error("erreur de detection", "fichier", *entree, "erreur", err)
+		return SORTIE_TRAITEMENT
+	}
+	fmt.Println(string(resultat))
+	return SORTIE_OK
+}
+
+// resultat de bench, affiché en texte ou en json
+type ResultatBench struct {
+	Image     string  `json:"image"`
+	Images    int     `json:"frames"`
+	Visages   int     `json:"faces_last_frame"`
+	Min       float64 `json:"min_ms"`
+	Moyenne   float64 `json:"mean_ms"`
+	P95       float64 `json:"p95_ms"`
+	Max       float64 `json:"max_ms"`
+	ParSecond float64 `json:"frames_per_second"`
+}
+
+func commandeBench(args []string) int {
+	options := nouvellesOptions("bench", "[-in image.jpg] [-n 50] [options]",
+		"traite plusieurs fois la meme image comme une requete de floutage (decodage, detection, anonymisation, encodage)\net affiche les durées. sans -in on utilise l'image synthetique de l'auto test.")
+	entree := options.String("in", "", "image a traiter (image synthetique si vide)")
+	nombre := options.Int("n", 50, "nombre de traitements")
+	enJson := options.Bool("json", false, "resultat en json")
+	communes := optionsCommunes(options)
+	if err := options.Parse(args); err != nil {
+		return codeAnalyse(err)
+	}
+	if *nombre < 1 {
+		fmt.Fprintln(os.Stderr, "-n doit etre positif")
+		return SORTIE_CONFIGURATION
+	}
+	config, code := communes.Preparer()
+	if code != SORTIE_OK {
+		return code
+	}
+	detecteurs, code := chargerDetecteursConfig(config)
+	if code != SORTIE_OK {
+		return code
+	}
+	defer detecteurs.Close()
+
+	resultat := ResultatBench{Image: *entree, Images: *nombre}
+	var img_bytes []byte
+	var err error
+	if *entree == "" {
+		resultat.Image = "synthetique"
+		img_bytes, err = pngAutoTest()
+	} else {
+		img_bytes, err = os.ReadFile(*entree)
+	}
+	if err != nil {
+		slog.Error("lecture de l'image impossible", "fichier", *entree, "erreur", err)
+		return SORTIE_TRAITEMENT
+	}
+
+	durees := make([]time.Duration, 0, *nombre)
+	debutBench := time.Now()
+	for i := 0; i < *nombre; i++ {
+		debut := time.Now()
+		_, sidecar, err := traitementImage(img_bytes, detecteurs, CODEC_DEFAUT)
+		if err != nil {
+			slog.Error("erreur de traitement", "image", resultat.Image, "erreur", err)
+			return SORTIE_TRAITEMENT
+		}
+		durees = append(durees, time.Since(debut))
+		resultat.Visages = len(sidecar.Visages)
+	}
+	total := time.Since(debutBench)
+
+	sort.Slice(durees, func(i, j int) bool { return durees[i] < durees[j] })
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	resultat.Min, resultat.Max = ms(durees[0]), ms(durees[len(durees)-1])
+	resultat.Moyenne = ms(total / time.Duration(len(durees)))
+	resultat.P95 = ms(durees[(len(durees)*95+99)/100-1])
+	resultat.ParSecond = float64(len(durees)) / total.Seconds()
+
+	if *enJson {
+		json.NewEncoder(os.Stdout).Encode(resultat)
+		return SORTIE_OK
+	}
+	fmt.Printf("%s : %d images, %d visage(s), methode %s, detecteur %s\n", filepath.Base(resultat.Image), resultat.Images, resultat.Visages, config.Floutage.Methode, config.Floutage.Detecteur)
+	fmt.Printf("min %.1f ms, moyenne %.1f ms, p95 %.1f ms, max %.1f ms, %.1f images/s\n", resultat.Min, resultat.Moyenne, resultat.P95, resultat.Max, resultat.ParSecond)
+	return SORTIE_OK
+}
+
+func commandeVerifyAudit(args []string) int {
+	options := nouvellesOptions("verify-audit", "-audit-key cle journal.jsonl",
+		"verifie la chaine d'empreintes d'un journal d'audit ecrit avec serve -audit, avec la meme clé -audit-key.")
+	cleAudit := options.String("audit-key", "", "fichier de la clé hmac du journal d'audit")
+	if err := options.Parse(args); err != nil {
+		return codeAnalyse(err)
+	}
+	if options.NArg() != 1 {
+		options.Usage()
+		return SORTIE_CONFIGURATION
+	}
+	return commandeVerifierAudit(options.Arg(0), *cleAudit)
+}
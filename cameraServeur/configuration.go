@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// configuration du serveur, lue au demarrage dans un fichier json (option -config)
+// chaque reglage peut etre surchargé par une variable d'environnement CAMERA_SERVEUR_*, puis par une option de la ligne de commande
+// le floutage, la detection, les plaques et le delai d'inactivité sont rechargés a chaud sur SIGHUP ou quand le fichier change,
+// sans couper les connexions ; les ports, le buffer, le dossier des cascades et la clé de redaction demandent un redemarrage
+
+const PREFIXE_ENV = "CAMERA_SERVEUR_"
+const INTERVALLE_SURVEILLANCE = 2 * time.Second //verification de la date de modification du fichier
+
+// parametres de DetectMultiScale, les valeurs par defaut sont celles d'opencv
+type ParametresDetection struct {
+	FacteurEchelle float64 `json:"scale_factor"`  //agrandissement entre deux passes, > 1
+	VoisinsMin     int     `json:"min_neighbors"` //detections voisines necessaires pour garder un visage, plus haut = moins de fausses detections
+	TailleMin      int     `json:"min_size"`      //taille minimale d'un visage en pixels, 0 pour aucune
+}
+
+var DETECTION_DEFAUT = ParametresDetection{FacteurEchelle: 1.1, VoisinsMin: 3}
+
+// prefixe est le chemin des parametres dans le json, pour les messages d'erreur
+func (p ParametresDetection) Valider(prefixe string) []error {
+	var erreurs []error
+	if p.FacteurEchelle <= 1 {
+		erreurs = append(erreurs, fmt.Errorf("%s.scale_factor: %g doit etre superieur a 1", prefixe, p.FacteurEchelle))
+	}
+	if p.VoisinsMin < 0 {
+		erreurs = append(erreurs, fmt.Errorf("%s.min_neighbors: %d negatif", prefixe, p.VoisinsMin))
+	}
+	if p.TailleMin < 0 {
+		erreurs = append(erreurs, fmt.Errorf("%s.min_size: %d negatif", prefixe, p.TailleMin))
+	}
+	return erreurs
+}
+
+type Configuration struct {
+	//structurels, lus au demarrage seulement
+	Port            string `json:"port"`
+	PortHttp        string `json:"http_port"`
+	HoteHttp        string `json:"http_host"`   //interface de l'api http, vide pour toutes
+	TailleBuffer    int64  `json:"buffer_size"` //taille des paquets de la socket
+	DossierCascades string `json:"cascades_dir"`
+	CleRedaction    string `json:"redaction_key_file"` //active la redaction reversible, vide pour la desactiver
+
+	//rechargés a chaud
+	DelaiInactivite Duree               `json:"idle_timeout"`
+	Floutage        ParametresFloutage  `json:"anonymization"`
+	Detection       ParametresDetection `json:"detection"`
+	Plaques         ParametresPlaques   `json:"plates"`
+}
+
+var CONFIGURATION_DEFAUT = Configuration{
+	Port:            PORT,
+	PortHttp:        PORT_HTTP,
+	HoteHttp:        HOTE_HTTP,
+	TailleBuffer:    BUFFERSIZE,
+	DossierCascades: DOSSIER_CASCADES,
+	DelaiInactivite: Duree(DELAI_INACTIVITE),
+	Floutage:        PARAMETRES_DEFAUT,
+	Detection:       DETECTION_DEFAUT,
+	Plaques:         PLAQUES_DEFAUT,
+}
+
+var configuration atomic.Pointer[Configuration] //remplacée en bloc au rechargement, jamais modifiée
+
+var surchargesCommande = func(*Configuration) {} //options de la ligne de commande, reappliquées a chaque rechargement
+
+// configuration en cours, a relire a chaque traitement pour suivre les rechargements
+func ConfigActuelle() *Configuration {
+	if c := configuration.Load(); c != nil {
+		return c
+	}
+	defaut := CONFIGURATION_DEFAUT
+	return &defaut
+}
+
+// durée ecrite "30s" ou "5m" dans le json
+type Duree time.Duration
+
+func (d Duree) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duree) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duree) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durée attendue sous la forme \"30s\" ou \"5m\": %w", err)
+	}
+	duree, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duree(duree)
+	return nil
+}
+
+// verifie les reglages qui ne dependent pas des detecteurs chargés
+func (c *Configuration) Valider() error {
+	var erreurs []error
+	for nom, port := range map[string]string{"port": c.Port, "http_port": c.PortHttp} {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			erreurs = append(erreurs, fmt.Errorf("%s: port invalide %q", nom, port))
+		}
+	}
+	if c.Port == c.PortHttp {
+		erreurs = append(erreurs, fmt.Errorf("port et http_port identiques (%s)", c.Port))
+	}
+	if c.TailleBuffer < 1 {
+		erreurs = append(erreurs, fmt.Errorf("buffer_size: %d doit etre positif", c.TailleBuffer))
+	}
+	if c.DossierCascades == "" {
+		erreurs = append(erreurs, errors.New("cascades_dir: dossier vide"))
+	}
+	if c.DelaiInactivite <= 0 {
+		erreurs = append(erreurs, fmt.Errorf("idle_timeout: %s doit etre positif", c.DelaiInactivite.Duration()))
+	}
+	erreurs = append(erreurs, c.Detection.Valider("detection")...)
+	erreurs = append(erreurs, c.Plaques.Valider())
+	return errors.Join(erreurs...)
+}
+
+// verifie ce qui depend des detecteurs chargés au demarrage
+func (c *Configuration) ValiderDetecteurs(detecteurs Detecteurs) error {
+	return errors.Join(c.Floutage.Valider(detecteurs), c.Plaques.ValiderDetecteurs(detecteurs))
+}
+
+// valeurs par defaut, puis fichier (si chemin n'est pas vide), puis variables d'environnement, puis options
+// les champs absents du fichier gardent leur valeur par defaut, les champs inconnus sont refusés
+func ChargerConfiguration(chemin string) (*Configuration, error) {
+	config := CONFIGURATION_DEFAUT
+	if chemin != "" {
+		contenu, err := os.ReadFile(chemin)
+		if err != nil {
+			return nil, err
+		}
+		decodeur := json.NewDecoder(bytes.NewReader(contenu))
+		decodeur.DisallowUnknownFields()
+		if err := decodeur.Decode(&config); err != nil {
+			return nil, fmt.Errorf("%s: %w", chemin, err)
+		}
+	}
+	if err := config.surchargesEnvironnement(); err != nil {
+		return nil, err
+	}
+	surchargesCommande(&config)
+	if err := config.Valider(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// CAMERA_SERVEUR_PORT, CAMERA_SERVEUR_METHOD... une valeur illisible est une erreur plutot qu'ignorée
+func (c *Configuration) surchargesEnvironnement() error {
+	var erreurs []error
+	envChaine(&c.Port, "PORT")
+	envChaine(&c.PortHttp, "HTTP_PORT")
+	envChaine(&c.HoteHttp, "HTTP_HOST")
+	erreurs = append(erreurs, envEntier64(&c.TailleBuffer, "BUFFER_SIZE"))
+	envChaine(&c.DossierCascades, "CASCADES_DIR")
+	envChaine(&c.CleRedaction, "REDACTION_KEY_FILE")
+	erreurs = append(erreurs, envDuree(&c.DelaiInactivite, "IDLE_TIMEOUT"))
+	envChaine(&c.Floutage.Methode, "METHOD")
+	erreurs = append(erreurs, envEntier(&c.Floutage.TailleCarre, "BLOCK_SIZE"))
+	envChaine(&c.Floutage.Detecteur, "DETECTOR")
+	erreurs = append(erreurs, envReel(&c.Detection.FacteurEchelle, "SCALE_FACTOR"))
+	erreurs = append(erreurs, envEntier(&c.Detection.VoisinsMin, "MIN_NEIGHBORS"))
+	erreurs = append(erreurs, envEntier(&c.Detection.TailleMin, "MIN_SIZE"))
+	erreurs = append(erreurs, envBooleen(&c.Plaques.Active, "PLATES"))
+	envChaine(&c.Plaques.Methode, "PLATE_METHOD")
+	erreurs = append(erreurs, envEntier(&c.Plaques.TailleCarre, "PLATE_BLOCK_SIZE"))
+	erreurs = append(erreurs, envReel(&c.Plaques.Detection.FacteurEchelle, "PLATE_SCALE_FACTOR"))
+	erreurs = append(erreurs, envEntier(&c.Plaques.Detection.VoisinsMin, "PLATE_MIN_NEIGHBORS"))
+	erreurs = append(erreurs, envEntier(&c.Plaques.Detection.TailleMin, "PLATE_MIN_SIZE"))
+	return errors.Join(erreurs...)
+}
+
+func envChaine(valeur *string, nom string) {
+	if v, ok := os.LookupEnv(PREFIXE_ENV + nom); ok {
+		*valeur = v
+	}
+}
+
+func envEntier(valeur *int, nom string) error {
+	v, ok := os.LookupEnv(PREFIXE_ENV + nom)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("%s%s: entier attendu: %w", PREFIXE_ENV, nom, err)
+	}
+	*valeur = n
+	return nil
+}
+
+func envEntier64(valeur *int64, nom string) error {
+	n := int(*valeur)
+	if err := envEntier(&n, nom); err != nil {
+		return err
+	}
+	*valeur = int64(n)
+	return nil
+}
+
+func envReel(valeur *float64, nom string) error {
+	v, ok := os.LookupEnv(PREFIXE_ENV + nom)
+	if !ok {
+		return nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fmt.Errorf("%s%s: nombre attendu: %w", PREFIXE_ENV, nom, err)
+	}
+	*valeur = f
+	return nil
+}
+
+func envBooleen(valeur *bool, nom string) error {
+	v, ok := os.LookupEnv(PREFIXE_ENV + nom)
+	if !ok {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("%s%s: booleen attendu: %w", PREFIXE_ENV, nom, err)
+	}
+	*valeur = b
+	return nil
+}
+
+func envDuree(valeur *Duree, nom string) error {
+	v, ok := os.LookupEnv(PREFIXE_ENV + nom)
+	if !ok {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("%s%s: durée attendue: %w", PREFIXE_ENV, nom, err)
+	}
+	*valeur = Duree(d)
+	return nil
+}
+
+// declare une option par reglage, avec la valeur par defaut de la configuration
+// la fonction renvoyée applique seulement les options données sur la ligne de commande
+func optionsConfiguration(options *flag.FlagSet) func(*Configuration) {
+	defaut := CONFIGURATION_DEFAUT
+	port := options.String("port", defaut.Port, "port de la socket")
+	portHttp := options.String("http-port", defaut.PortHttp, "port de l'api http")
+	hoteHttp := options.String("http-host", defaut.HoteHttp, "interface de l'api http, 0.0.0.0 ou vide pour toutes (acces depuis le reseau)")
+	tailleBuffer := options.Int64("buffer-size", defaut.TailleBuffer, "taille des paquets de la socket")
+	dossierCascades := options.String("cascades-dir", defaut.DossierCascades, "dossier des modeles de reconnaissance")
+	cleRedaction := options.String("redaction-key", defaut.CleRedaction, "fichier de la clé AES-256 de la redaction reversible (desactivée si vide)")
+	delaiInactivite := options.Duration("idle-timeout", defaut.DelaiInactivite.Duration(), "fermeture des connexions inactives depuis ce delai")
+	methode := options.String("method", defaut.Floutage.Methode, "methode d'anonymisation : pixelate, blur ou fill")
+	tailleCarre := options.Int("block-size", defaut.Floutage.TailleCarre, "taille des carrés de la pixelisation ou du noyau du flou")
+	detecteur := options.String("detector", defaut.Floutage.Detecteur, "detecteur de visages : face, face_alt ou profile")
+	facteurEchelle := options.Float64("scale-factor", defaut.Detection.FacteurEchelle, "agrandissement entre deux passes de la detection")
+	voisinsMin := options.Int("min-neighbors", defaut.Detection.VoisinsMin, "detections voisines necessaires pour garder un visage")
+	tailleMin := options.Int("min-size", defaut.Detection.TailleMin, "taille minimale d'un visage en pixels")
+	plaques := options.Bool("plates", defaut.Plaques.Active, "detecte et anonymise aussi les plaques d'immatriculation")
+	methodePlaques := options.String("plate-method", defaut.Plaques.Methode, "methode d'anonymisation des plaques : pixelate, blur ou fill")
+	tailleCarrePlaques := options.Int("plate-block-size", defaut.Plaques.TailleCarre, "taille des carrés ou du noyau du flou des plaques")
+	facteurEchellePlaques := options.Float64("plate-scale-factor", defaut.Plaques.Detection.FacteurEchelle, "agrandissement entre deux passes de la detection des plaques")
+	voisinsMinPlaques := options.Int("plate-min-neighbors", defaut.Plaques.Detection.VoisinsMin, "detections voisines necessaires pour garder une plaque")
+	tailleMinPlaques := options.Int("plate-min-size", defaut.Plaques.Detection.TailleMin, "taille minimale d'une plaque en pixels")
+
+	return func(c *Configuration) {
+		options.Visit(func(option *flag.Flag) {
+			switch option.Name {
+			case "port":
+				c.Port = *port
+			case "http-port":
+				c.PortHttp = *portHttp
+			case "http-host":
+				c.HoteHttp = *hoteHttp
+			case "buffer-size":
+				c.TailleBuffer = *tailleBuffer
+			case "cascades-dir":
+				c.DossierCascades = *dossierCascades
+			case "redaction-key":
+				c.CleRedaction = *cleRedaction
+			case "idle-timeout":
+				c.DelaiInactivite = Duree(*delaiInactivite)
+			case "method":
+				c.Floutage.Methode = *methode
+			case "block-size":
+				c.Floutage.TailleCarre = *tailleCarre
+			case "detector":
+				c.Floutage.Detecteur = *detecteur
+			case "scale-factor":
+				c.Detection.FacteurEchelle = *facteurEchelle
+			case "min-neighbors":
+				c.Detection.VoisinsMin = *voisinsMin
+			case "min-size":
+				c.Detection.TailleMin = *tailleMin
+			case "plates":
+				c.Plaques.Active = *plaques
+			case "plate-method":
+				c.Plaques.Methode = *methodePlaques
+			case "plate-block-size":
+				c.Plaques.TailleCarre = *tailleCarrePlaques
+			case "plate-scale-factor":
+				c.Plaques.Detection.FacteurEchelle = *facteurEchellePlaques
+			case "plate-min-neighbors":
+				c.Plaques.Detection.VoisinsMin = *voisinsMinPlaques
+			case "plate-min-size":
+				c.Plaques.Detection.TailleMin = *tailleMinPlaques
+			}
+		})
+	}
+}
+
+// remet les reglages structurels de la configuration en cours et renvoie ceux qui avaient changé
+func (c *Configuration) garderStructure(actuelle *Configuration) []string {
+	var ignores []string
+	if c.Port != actuelle.Port {
+		ignores = append(ignores, "port")
+	}
+	if c.PortHttp != actuelle.PortHttp {
+		ignores = append(ignores, "http_port")
+	}
+	if c.HoteHttp != actuelle.HoteHttp {
+		ignores = append(ignores, "http_host")
+	}
+	if c.TailleBuffer != actuelle.TailleBuffer {
+		ignores = append(ignores, "buffer_size")
+	}
+	if c.DossierCascades != actuelle.DossierCascades {
+		ignores = append(ignores, "cascades_dir")
+	}
+	if c.CleRedaction != actuelle.CleRedaction {
+		ignores = append(ignores, "redaction_key_file")
+	}
+	c.Port, c.PortHttp, c.HoteHttp, c.TailleBuffer, c.DossierCascades, c.CleRedaction = actuelle.Port, actuelle.PortHttp, actuelle.HoteHttp, actuelle.TailleBuffer, actuelle.DossierCascades, actuelle.CleRedaction
+	return ignores
+}
+
+// recharge la configuration sur SIGHUP ou quand le fichier est modifié, jusqu'a l'annulation de ctx
+// valider complete Valider avec ce qui depend de l'etat du programme (detecteurs chargés)
+// une configuration invalide est refusée et la precedente reste en place
+func SurveillerConfiguration(ctx context.Context, chemin string, valider func(*Configuration) error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP) //n'arrive jamais sous windows, la surveillance du fichier suffit
+	defer signal.Stop(hup)
+
+	modification := dateModification(chemin)
+	ticker := time.NewTicker(INTERVALLE_SURVEILLANCE)
+	defer ticker.Stop()
+
+	for {
+		raison := "SIGHUP"
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-ticker.C:
+			date := dateModification(chemin)
+			if date.Equal(modification) {
+				continue
+			}
+			modification = date
+			raison = "fichier modifié"
+		}
+		rechargerConfiguration(chemin, raison, valider)
+	}
+}
+
+func rechargerConfiguration(chemin, raison string, valider func(*Configuration) error) {
+	nouvelle, err := ChargerConfiguration(chemin)
+	if err == nil {
+		err = valider(nouvelle)
+	}
+	if err != nil {
+		slog.Error("configuration invalide, la precedente est conservée", "fichier", chemin, "raison", raison, "erreur", err)
+		audit.Ecrire("configuration", "", map[string]interface{}{"fichier": chemin, "raison": raison, "erreur": err.Error()})
+		return
+	}
+	if ignores := nouvelle.garderStructure(ConfigActuelle()); len(ignores) > 0 {
+		slog.Warn("reglages ignorés jusqu'au prochain redemarrage", "reglages", ignores)
+	}
+	configuration.Store(nouvelle)
+	slog.Info("configuration rechargée", "fichier", chemin, "raison", raison,
+		"methode", nouvelle.Floutage.Methode, "taille_carre", nouvelle.Floutage.TailleCarre, "detecteur", nouvelle.Floutage.Detecteur, "plaques", nouvelle.Plaques.Active)
+	audit.Ecrire("configuration", "", map[string]interface{}{"fichier": chemin, "raison": raison, "floutage": nouvelle.Floutage, "detection": nouvelle.Detection, "plaques": nouvelle.Plaques})
+}
+
+// date nulle si le fichier est illisible, sa reapparition sera vue comme une modification
+func dateModification(chemin string) time.Time {
+	info, err := os.Stat(chemin)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json" //resultat de la detection
+	"fmt"
+	"image" //rectangles des visages
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+const DOSSIER_CASCADES = "C:\\opencv\\haar-cascade-files-master\\" //dossier des modeles de reconnaissance
+const DETECTEUR_DEFAUT = "face"
+
+// modeles de reconnaissance proposés, par nom de detecteur
+// seul le detecteur par defaut est obligatoire, les autres sont chargés s'ils sont presents
+var CASCADES = map[string]string{
+	"face":     "haarcascade_frontalface_default.xml",  //visage frontal
+	"face_alt": "haarcascade_frontalface_alt2.xml",     //visage frontal, moins de fausses detections
+	"profile":  "haarcascade_profileface.xml",          //visage de profil
+	"plate":    "haarcascade_russian_plate_number.xml", //plaque d'immatriculation, voir DETECTEUR_PLAQUES
+}
+
+// un classifieur gocv n'est pas prevu pour etre utilisé par plusieurs goroutines a la fois
+// on le protege donc par un mutex car il est partagé entre tous les clients
+type Detecteur struct {
+	Nom        string
+	Fichier    string
+	classifier gocv.CascadeClassifier
+	mu         sync.Mutex
+	enCours    atomic.Int32 //detections en cours ou en attente du mutex, pour /readyz
+}
+
+type Detecteurs map[string]*Detecteur
+
+// charge tous les classifieurs de CASCADES trouvés dans dossier
+func ChargerDetecteurs(dossier string) (Detecteurs, error) {
+	detecteurs := Detecteurs{}
+	for nom, fichier := range CASCADES {
+		classifier := gocv.NewCascadeClassifier()
+		if !classifier.Load(filepath.Join(dossier, fichier)) {
+			classifier.Close()
+			if nom == DETECTEUR_DEFAUT {
+				detecteurs.Close()
+				return nil, fmt.Errorf("erreur chargement du fichier: %s", filepath.Join(dossier, fichier))
+			}
+			slog.Warn("detecteur indisponible, fichier absent", "detecteur", nom, "fichier", filepath.Join(dossier, fichier))
+			continue
+		}
+		detecteurs[nom] = &Detecteur{Nom: nom, Fichier: fichier, classifier: classifier}
+	}
+	return detecteurs, nil
+}
+
+func (detecteurs Detecteurs) Close() {
+	for _, d := range detecteurs {
+		d.classifier.Close()
+	}
+}
+
+// detection des objets de la cascade (visages ou plaques) qui sont retournés dans une liste de rectangles
+func (d *Detecteur) Detecter(img gocv.Mat, params ParametresDetection) []image.Rectangle {
+	tailleMin := image.Pt(params.TailleMin, params.TailleMin)
+	d.enCours.Add(1)
+	defer d.enCours.Add(-1)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	debut := time.Now()
+	rects := d.classifier.DetectMultiScaleWithParams(img, params.FacteurEchelle, params.VoisinsMin, 0, tailleMin, image.Point{})
+	latenceDetection.Duree(d.Nom, debut)
+	return rects
+}
+
+// rectangles detectés dans une image, par classe
+type Regions struct {
+	Visages []image.Rectangle
+	Plaques []image.Rectangle
+}
+
+// tous les rectangles anonymisés, pour la redaction
+func (r Regions) Toutes() []image.Rectangle {
+	return append(append([]image.Rectangle{}, r.Visages...), r.Plaques...)
+}
+
+// rectangle detecté, en pixels de l'image
+// gocv ne donne pas les poids de detectMultiScale3, les cascades de haar n'ont donc pas de score :
+// Confiance vaut toujours null avec elles et ResultatDetection.ConfianceDisponible le signale
+type Boite struct {
+	X         int      `json:"x"`
+	Y         int      `json:"y"`
+	Largeur   int      `json:"width"`
+	Hauteur   int      `json:"height"`
+	Confiance *float64 `json:"confidence"`
+}
+
+// resultat de la detection seule, renvoyé en json au lieu de l'image floutée
+type ResultatDetection struct {
+	Detecteur string  `json:"detector"`
+	Largeur   int     `json:"image_width"`
+	Hauteur   int     `json:"image_height"`
+	Visages   []Boite `json:"faces"`
+	Plaques   []Boite `json:"plates,omitempty"` //absent si les plaques sont desactivées ou si aucune n'est detectée
+	//faux avec les cascades de haar, seuls detecteurs actuels : les champs confidence sont null
+	ConfianceDisponible bool `json:"confidence_available"`
+}
+
+func NouveauResultatDetection(detecteur string, img gocv.Mat, regions Regions) ResultatDetection {
+	return ResultatDetection{Detecteur: detecteur, Largeur: img.Cols(), Hauteur: img.Rows(), Visages: boites(regions.Visages), Plaques: boites(regions.Plaques)}
+}
+
+func boites(rects []image.Rectangle) []Boite {
+	resultat := []Boite{}
+	for _, rect := range rects {
+		resultat = append(resultat, Boite{X: rect.Min.X, Y: rect.Min.Y, Largeur: rect.Dx(), Hauteur: rect.Dy()})
+	}
+	return resultat
+}
+
+// decode l'image, detecte les visages (et les plaques si elles sont activées)
+// et renvoie le resultat en json et le nombre de visages, l'image n'est pas reencodée
+func traitementDetection(img_bytes []byte, detecteurs Detecteurs, nom string) ([]byte, int, error) {
+	detecteur, ok := detecteurs[nom]
+	if !ok {
+		return nil, 0, fmt.Errorf("detecteur inconnu %q", nom)
+	}
+
+	img, _, err := DecoderSansMetadonnees(img_bytes, gocv.IMReadGrayScale) //la detection se fait en niveaux de gris
+	if err != nil {
+		return nil, 0, err
+	}
+	defer img.Close()
+
+	config := ConfigActuelle()
+	regions := Regions{Visages: detecteur.Detecter(img, config.Detection)}
+	visagesParImage.Observer("", float64(len(regions.Visages)))
+	regions.Plaques, err = DetecterPlaques(img, detecteurs, config.Plaques)
+	if err != nil {
+		return nil, 0, err
+	}
+	resultat, err := json.Marshal(NouveauResultatDetection(nom, img, regions))
+	return resultat, len(regions.Visages), err
+}
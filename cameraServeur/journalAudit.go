@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// journal d'audit en ajout seul : chaque ligne json contient l'empreinte de la ligne precedente
+// et sa propre empreinte, un hmac-sha256 de la ligne sans le champ "hash" avec la clé d'audit.
+// modifier ou supprimer une ligne casse la chaine, ce que VerifierJournalAudit detecte ;
+// sans la clé, qui n'est pas stockée avec le journal, la chaine ne peut pas etre recalculée apres une modification.
+// une troncature de la fin n'est visible qu'en comparant avec la derniere empreinte notée ailleurs.
+type JournalAudit struct {
+	mu        sync.Mutex
+	fichier   *os.File
+	cle       []byte
+	seq       int64
+	precedent string
+	taille    int64 //fin de la derniere entrée complete, on y revient si une ecriture echoue
+	ferme     bool  //apres un arret forcé des connexions peuvent encore ecrire
+}
+
+type EntreeAudit struct {
+	Seq        int64                  `json:"seq"`
+	Horodatage time.Time              `json:"time"`
+	Evenement  string                 `json:"event"`
+	Connexion  string                 `json:"remote,omitempty"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+	Precedent  string                 `json:"prev"`
+	Empreinte  string                 `json:"hash,omitempty"` //toujours en dernier
+}
+
+const EMPREINTE_INITIALE = "0000000000000000000000000000000000000000000000000000000000000000"
+
+var audit *JournalAudit //nil si le journal d'audit est desactivé
+
+// derniere ligne sans fin de ligne : ecriture interrompue par un arret brutal
+var ErrLigneIncomplete = errors.New("derniere ligne incomplete")
+
+// ouvre le journal en ajout, la chaine existante est verifiée avant de la continuer
+// une derniere ligne incomplete ne fait pas partie de la chaine, elle est retirée
+func OuvrirJournalAudit(chemin string, cle []byte) (*JournalAudit, error) {
+	seq, precedent, taille, err := VerifierJournalAudit(chemin, cle)
+	if err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, ErrLigneIncomplete) {
+		return nil, err
+	}
+	fichier, err := os.OpenFile(chemin, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	journal := &JournalAudit{fichier: fichier, cle: cle, seq: seq, precedent: precedent, taille: taille}
+	if info, err := fichier.Stat(); err == nil && info.Size() > taille {
+		slog.Warn("journal d'audit : ecriture interrompue retirée", "fichier", chemin, "octets", info.Size()-taille)
+		if err := fichier.Truncate(taille); err != nil {
+			fichier.Close()
+			return nil, err
+		}
+	}
+	return journal, nil
+}
+
+// clé hmac du journal, meme format que la clé de redaction (openssl rand -hex 32)
+func ChargerCleAudit(chemin string) ([]byte, error) {
+	if chemin == "" {
+		return nil, errors.New("la clé d'audit est obligatoire avec le journal d'audit (-audit-key)")
+	}
+	return ChargerCle(chemin)
+}
+
+func (journal *JournalAudit) Close() error {
+	if journal == nil {
+		return nil
+	}
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	if journal.ferme {
+		return nil
+	}
+	journal.ferme = true
+	return journal.fichier.Close()
+}
+
+// ajoute un evenement au journal, ne fait rien si le journal est desactivé
+func (journal *JournalAudit) Ecrire(evenement string, connexion string, details map[string]interface{}) {
+	if journal == nil {
+		return
+	}
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	if journal.ferme {
+		slog.Warn("journal d'audit fermé, evenement non ecrit", "evenement", evenement, "remote", connexion)
+		return
+	}
+
+	entree := EntreeAudit{
+		Seq:        journal.seq + 1,
+		Horodatage: time.Now().UTC(),
+		Evenement:  evenement,
+		Connexion:  connexion,
+		Details:    details,
+		Precedent:  journal.precedent,
+	}
+	ligne, err := json.Marshal(entree)
+	if err != nil {
+		slog.Error("erreur du journal d'audit", "evenement", evenement, "erreur", err)
+		return
+	}
+	empreinte := empreinteLigne(journal.cle, ligne)
+	ligne = append(ligne[:len(ligne)-1], `,"hash":"`+empreinte+`"}`+"\n"...)
+
+	_, err = journal.fichier.Write(ligne)
+	if err == nil {
+		err = journal.fichier.Sync()
+	}
+	if err != nil {
+		slog.Error("erreur d'ecriture du journal d'audit", "evenement", evenement, "erreur", err)
+		//une ligne a moitié ecrite casserait la chaine et empecherait de rouvrir le journal
+		if err := journal.fichier.Truncate(journal.taille); err != nil {
+			slog.Error("journal d'audit : impossible de retirer l'ecriture incomplete", "erreur", err)
+		}
+		return
+	}
+	journal.seq, journal.precedent = entree.Seq, empreinte
+	journal.taille += int64(len(ligne))
+}
+
+func empreinteLigne(cle []byte, ligne []byte) string {
+	mac := hmac.New(sha256.New, cle)
+	mac.Write(ligne)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifie toute la chaine du journal, renvoie le numero et l'empreinte de la derniere entrée
+// et la taille du journal jusqu'a la fin de cette entrée
+func VerifierJournalAudit(chemin string, cle []byte) (int64, string, int64, error) {
+	fichier, err := os.Open(chemin)
+	if err != nil {
+		return 0, EMPREINTE_INITIALE, 0, err
+	}
+	defer fichier.Close()
+
+	seq, precedent, taille := int64(0), EMPREINTE_INITIALE, int64(0)
+	lecteur := bufio.NewReader(fichier)
+	for noLigne := 1; ; noLigne++ {
+		ligne, err := lecteur.ReadBytes('\n')
+		if err == io.EOF && len(ligne) == 0 {
+			break
+		}
+		if err == io.EOF {
+			return seq, precedent, taille, fmt.Errorf("ligne %d: %w", noLigne, ErrLigneIncomplete)
+		}
+		if err != nil {
+			return seq, precedent, taille, err
+		}
+		ligne = bytes.TrimSuffix(ligne, []byte("\n"))
+		var entree EntreeAudit
+		if err := json.Unmarshal(ligne, &entree); err != nil {
+			return seq, precedent, taille, fmt.Errorf("ligne %d illisible: %w", noLigne, err)
+		}
+
+		suffixe := `,"hash":"` + entree.Empreinte + `"}`
+		if len(entree.Empreinte) != len(EMPREINTE_INITIALE) || !bytes.HasSuffix(ligne, []byte(suffixe)) {
+			return seq, precedent, taille, fmt.Errorf("ligne %d: empreinte absente ou mal placée", noLigne)
+		}
+		sansEmpreinte := append(append([]byte(nil), ligne[:len(ligne)-len(suffixe)]...), '}')
+		switch {
+		case !hmac.Equal([]byte(empreinteLigne(cle, sansEmpreinte)), []byte(entree.Empreinte)):
+			return seq, precedent, taille, fmt.Errorf("ligne %d (seq %d): contenu modifié ou mauvaise clé d'audit", noLigne, entree.Seq)
+		case entree.Precedent != precedent:
+			return seq, precedent, taille, fmt.Errorf("ligne %d (seq %d): chaine rompue, une entrée a ete supprimée ou inserée", noLigne, entree.Seq)
+		case entree.Seq != seq+1:
+			return seq, precedent, taille, fmt.Errorf("ligne %d: numero %d au lieu de %d", noLigne, entree.Seq, seq+1)
+		}
+		seq, precedent, taille = entree.Seq, entree.Empreinte, taille+int64(len(ligne))+1
+	}
+	return seq, precedent, taille, nil
+}
+
+// commande de verification : affiche le resultat et renvoie le code de sortie du programme
+func commandeVerifierAudit(chemin string, fichierCle string) int {
+	cle, err := ChargerCleAudit(fichierCle)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "clé d'audit inutilisable :", err)
+		return SORTIE_CONFIGURATION
+	}
+	seq, derniere, _, err := VerifierJournalAudit(chemin, cle)
+	if err != nil {
+		fmt.Println("Journal d'audit NON intègre :", err)
+		return SORTIE_TRAITEMENT
+	}
+	fmt.Println("Journal d'audit intègre :", seq, "entrées")
+	fmt.Println("Derniere empreinte (a conserver pour detecter une troncature) :", derniere)
+	return SORTIE_OK
+}
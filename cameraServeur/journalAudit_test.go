@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+var CLE_AUDIT_TEST = bytes.Repeat([]byte{0x42}, TAILLE_CLE)
+
+// journal de n entrées dans un dossier temporaire
+func journalTest(t *testing.T, n int) string {
+	t.Helper()
+	chemin := filepath.Join(t.TempDir(), "audit.jsonl")
+	journal, err := OuvrirJournalAudit(chemin, CLE_AUDIT_TEST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		journal.Ecrire("test", "127.0.0.1:1234", map[string]interface{}{"numero": i})
+	}
+	if err := journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return chemin
+}
+
+func TestJournalAuditChaine(t *testing.T) {
+	chemin := journalTest(t, 3)
+	seq, derniere, taille, err := VerifierJournalAudit(chemin, CLE_AUDIT_TEST)
+	if err != nil || seq != 3 || derniere == EMPREINTE_INITIALE {
+		t.Fatalf("seq %d, empreinte %s, erreur %v", seq, derniere, err)
+	}
+	if info, _ := os.Stat(chemin); info.Size() != taille {
+		t.Errorf("taille %d, le fichier fait %d octets", taille, info.Size())
+	}
+
+	journal, err := OuvrirJournalAudit(chemin, CLE_AUDIT_TEST) //la chaine continue apres reouverture
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Ecrire("reprise", "", nil)
+	journal.Close()
+	if seq, _, _, err := VerifierJournalAudit(chemin, CLE_AUDIT_TEST); err != nil || seq != 4 {
+		t.Fatalf("seq %d apres reouverture, erreur %v", seq, err)
+	}
+}
+
+func TestJournalAuditFalsifie(t *testing.T) {
+	autreCle := bytes.Repeat([]byte{0x17}, TAILLE_CLE)
+	cas := []struct {
+		nom      string
+		modifier func(contenu []byte) []byte
+		cle      []byte
+	}{
+		{"mauvaise clé", func(contenu []byte) []byte { return contenu }, autreCle},
+		{"contenu modifié", func(contenu []byte) []byte {
+			return bytes.Replace(contenu, []byte(`"numero":1`), []byte(`"numero":7`), 1)
+		}, CLE_AUDIT_TEST},
+		{"ligne supprimée", func(contenu []byte) []byte {
+			lignes := bytes.SplitAfter(contenu, []byte("\n"))
+			return bytes.Join(append(lignes[:1], lignes[2:]...), nil)
+		}, CLE_AUDIT_TEST},
+	}
+	for _, c := range cas {
+		t.Run(c.nom, func(t *testing.T) {
+			chemin := journalTest(t, 3)
+			contenu, _ := os.ReadFile(chemin)
+			os.WriteFile(chemin, c.modifier(contenu), 0o640)
+			if _, _, _, err := VerifierJournalAudit(chemin, c.cle); err == nil {
+				t.Fatal("journal falsifié accepté")
+			}
+			if _, err := OuvrirJournalAudit(chemin, c.cle); err == nil {
+				t.Error("un journal falsifié ne doit pas etre continué")
+			}
+		})
+	}
+}
+
+func TestJournalAuditLigneIncomplete(t *testing.T) {
+	chemin := journalTest(t, 2)
+	_, _, taille, _ := VerifierJournalAudit(chemin, CLE_AUDIT_TEST)
+	fichier, _ := os.OpenFile(chemin, os.O_WRONLY|os.O_APPEND, 0o640)
+	fichier.WriteString(`{"seq":3,"time":"2026-`) //arret brutal pendant l'ecriture
+	fichier.Close()
+
+	if _, _, _, err := VerifierJournalAudit(chemin, CLE_AUDIT_TEST); !errors.Is(err, ErrLigneIncomplete) {
+		t.Fatalf("erreur %v, attendu %v", err, ErrLigneIncomplete)
+	}
+	journal, err := OuvrirJournalAudit(chemin, CLE_AUDIT_TEST)
+	if err != nil {
+		t.Fatalf("journal avec une ecriture interrompue refusé: %v", err)
+	}
+	if info, _ := os.Stat(chemin); info.Size() != taille {
+		t.Errorf("ecriture interrompue non retirée, %d octets au lieu de %d", info.Size(), taille)
+	}
+	journal.Ecrire("reprise", "", nil)
+	journal.Close()
+	if seq, _, _, err := VerifierJournalAudit(chemin, CLE_AUDIT_TEST); err != nil || seq != 3 {
+		t.Fatalf("seq %d, erreur %v", seq, err)
+	}
+}
+
+// apres un arret forcé des connexions ecrivent encore pendant et apres la fermeture du journal
+func TestJournalAuditApresFermeture(t *testing.T) {
+	chemin := filepath.Join(t.TempDir(), "audit.jsonl")
+	journal, err := OuvrirJournalAudit(chemin, CLE_AUDIT_TEST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Ecrire("demarrage", "", nil)
+
+	var connexions sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		connexions.Add(1)
+		go func(i int) {
+			defer connexions.Done()
+			for j := 0; j < 20; j++ {
+				journal.Ecrire("image", "127.0.0.1:1234", map[string]interface{}{"connexion": i})
+			}
+		}(i)
+	}
+	if err := journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	connexions.Wait()
+	avant, _ := os.ReadFile(chemin)
+	journal.Ecrire("arret", "", nil)
+	if err := journal.Close(); err != nil {
+		t.Errorf("deuxieme fermeture : %v", err)
+	}
+
+	apres, _ := os.ReadFile(chemin)
+	if !bytes.Equal(avant, apres) {
+		t.Error("evenement ecrit apres la fermeture du journal")
+	}
+	seq, _, _, err := VerifierJournalAudit(chemin, CLE_AUDIT_TEST)
+	if err != nil || seq < 1 || seq != int64(bytes.Count(apres, []byte("\n"))) {
+		t.Fatalf("seq %d pour %d lignes, erreur %v", seq, bytes.Count(apres, []byte("\n")), err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+// metadonnees qui ne sont pas retirées des images recues
+// "orientation" : l'orientation exif est appliquée aux pixels avant de retirer l'exif, sinon elle est ignorée
+// les autres noms (exif, xmp, iptc, icc, comment, ...) peuvent y etre ajoutés pour garder le bloc correspondant, le profil icc est retiré par defaut
+var METADONNEES_CONSERVEES = map[string]bool{"orientation": true}
+
+// ce qu'on a trouvé dans l'image en retirant ses metadonnees
+type Metadonnees struct {
+	Orientation int      //orientation exif de 1 a 8, 0 si absente
+	Retirees    []string //types de metadonnees retirées (exif, xmp, iptc, comment, ...)
+}
+
+var signaturePng = []byte("\x89PNG\r\n\x1a\n")
+
+// retire les metadonnees exif, xmp, iptc et commentaires d'une image jpeg ou png sans la reencoder
+// les autres formats sont renvoyés tels quels, opencv ne recopie de toute facon aucune metadonnee en reencodant
+func NettoyageMetadonnees(img_bytes []byte, conservees map[string]bool) ([]byte, Metadonnees, error) {
+	switch {
+	case bytes.HasPrefix(img_bytes, []byte{0xFF, 0xD8}):
+		return nettoyageJpeg(img_bytes, conservees)
+	case bytes.HasPrefix(img_bytes, signaturePng):
+		return nettoyagePng(img_bytes, conservees)
+	}
+	return img_bytes, Metadonnees{}, nil
+}
+
+// un jpeg est une suite de segments FF xx + taille sur 2 octets, jusqu'au debut des données compressées (SOS)
+func nettoyageJpeg(img_bytes []byte, conservees map[string]bool) ([]byte, Metadonnees, error) {
+	var meta Metadonnees
+	propre := []byte{0xFF, 0xD8}
+	i := 2
+	for {
+		if i+4 > len(img_bytes) || img_bytes[i] != 0xFF {
+			return nil, meta, errors.New("jpeg tronqué ou mal formé")
+		}
+		marqueur := img_bytes[i+1]
+		if marqueur == 0xFF { //octet de remplissage
+			i++
+			continue
+		}
+		taille := int(binary.BigEndian.Uint16(img_bytes[i+2:]))
+		fin := i + 2 + taille
+		if taille < 2 || fin > len(img_bytes) {
+			return nil, meta, errors.New("segment jpeg tronqué")
+		}
+		if marqueur == 0xDA { //SOS : la suite est l'image compressée, on la recopie telle quelle
+			propre = append(propre, img_bytes[i:]...)
+			return propre, meta, nil
+		}
+
+		contenu := img_bytes[i+4 : fin]
+		nom := typeSegmentJpeg(marqueur, contenu)
+		if nom == "exif" {
+			meta.Orientation = orientationExif(contenu[6:])
+		}
+		if nom == "" || conservees[nom] {
+			propre = append(propre, img_bytes[i:fin]...)
+		} else {
+			meta.Retirees = append(meta.Retirees, nom)
+		}
+		i = fin
+	}
+}
+
+// renvoie le type de metadonnee d'un segment, ou "" pour un segment necessaire a l'image
+func typeSegmentJpeg(marqueur byte, contenu []byte) string {
+	switch {
+	case marqueur == 0xE1 && bytes.HasPrefix(contenu, []byte("Exif\x00\x00")):
+		return "exif"
+	case marqueur == 0xE1 && bytes.HasPrefix(contenu, []byte("http://ns.adobe.com/")):
+		return "xmp"
+	case marqueur == 0xED:
+		return "iptc" //Photoshop 3.0
+	case marqueur == 0xE2 && bytes.HasPrefix(contenu, []byte("ICC_PROFILE\x00")):
+		return "icc"
+	case marqueur == 0xFE:
+		return "comment"
+	case marqueur == 0xE0 || marqueur == 0xEE: //JFIF et Adobe decrivent l'encodage des couleurs
+		return ""
+	case marqueur >= 0xE0 && marqueur <= 0xEF:
+		return "app" //donnees constructeur, miniatures (MPF), ...
+	}
+	return ""
+}
+
+// un png est une suite de chunks : taille sur 4 octets, type sur 4 octets, données, crc
+func nettoyagePng(img_bytes []byte, conservees map[string]bool) ([]byte, Metadonnees, error) {
+	var meta Metadonnees
+	propre := append([]byte(nil), signaturePng...)
+	i := len(signaturePng)
+	for i < len(img_bytes) {
+		if i+12 > len(img_bytes) {
+			return nil, meta, errors.New("png tronqué")
+		}
+		taille := int(binary.BigEndian.Uint32(img_bytes[i:]))
+		fin := i + 12 + taille
+		if fin > len(img_bytes) {
+			return nil, meta, errors.New("chunk png tronqué")
+		}
+		typeChunk := string(img_bytes[i+4 : i+8])
+
+		nom := ""
+		switch typeChunk {
+		case "eXIf":
+			nom = "exif"
+			meta.Orientation = orientationExif(img_bytes[i+8 : i+8+taille])
+		case "tEXt", "zTXt", "iTXt":
+			nom = "text" //commentaires, auteur, xmp
+		case "tIME":
+			nom = "time"
+		case "iCCP":
+			nom = "icc"
+		}
+		if nom == "" || conservees[nom] {
+			propre = append(propre, img_bytes[i:fin]...)
+		} else {
+			meta.Retirees = append(meta.Retirees, nom)
+		}
+		i = fin
+	}
+	return propre, meta, nil
+}
+
+// lit le tag orientation (0x0112) du premier ifd d'un bloc exif (entete tiff), 0 si absent
+func orientationExif(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var ordre binary.ByteOrder
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		ordre = binary.LittleEndian
+	case "MM\x00*":
+		ordre = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(ordre.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	entrees := int(ordre.Uint16(tiff[ifd:]))
+	for n := 0; n < entrees; n++ {
+		entree := ifd + 2 + 12*n
+		if entree+12 > len(tiff) {
+			return 0
+		}
+		if ordre.Uint16(tiff[entree:]) == 0x0112 {
+			orientation := int(ordre.Uint16(tiff[entree+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 0
+			}
+			return orientation
+		}
+	}
+	return 0
+}
+
+// remet les pixels dans le bon sens selon l'orientation exif
+func AppliquerOrientation(img *gocv.Mat, orientation int) {
+	if orientation <= 1 || orientation > 8 {
+		return
+	}
+	tournee := gocv.NewMat()
+	switch orientation {
+	case 2:
+		gocv.Flip(*img, &tournee, 1) //miroir horizontal
+	case 3:
+		gocv.Rotate(*img, &tournee, gocv.Rotate180Clockwise)
+	case 4:
+		gocv.Flip(*img, &tournee, 0) //miroir vertical
+	case 5:
+		gocv.Transpose(*img, &tournee)
+	case 6:
+		gocv.Rotate(*img, &tournee, gocv.Rotate90Clockwise)
+	case 7:
+		transposee := gocv.NewMat()
+		gocv.Transpose(*img, &transposee)
+		gocv.Rotate(transposee, &tournee, gocv.Rotate180Clockwise)
+		transposee.Close()
+	case 8:
+		gocv.Rotate(*img, &tournee, gocv.Rotate90CounterClockwise)
+	}
+	img.Close()
+	*img = tournee
+}
+
+// retire les metadonnees puis decode l'image, avec l'orientation appliquée si elle est conservée
+func DecoderSansMetadonnees(img_bytes []byte, flags gocv.IMReadFlag) (gocv.Mat, Metadonnees, error) {
+	propre, meta, err := NettoyageMetadonnees(img_bytes, METADONNEES_CONSERVEES)
+	if err != nil {
+		return gocv.NewMat(), meta, fmt.Errorf("lecture des metadonnees: %w", err)
+	}
+	img, err := Decoder(propre, flags|gocv.IMReadIgnoreOrientation) //l'orientation est appliquée par nous, pas par opencv
+	if err != nil {
+		return img, meta, err
+	}
+	if METADONNEES_CONSERVEES["orientation"] {
+		AppliquerOrientation(&img, meta.Orientation)
+	}
+	return img, meta, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+// images de testdata : 40x20, moitié gauche noire et moitié droite blanche
+// avec exif (gps, numero de serie, orientation), xmp, iptc et un commentaire
+var IMAGES_METADONNEES = []struct {
+	fichier     string
+	orientation int
+	largeur     int //dimensions une fois l'orientation appliquée
+	hauteur     int
+}{
+	{"metadonnees_orientation6.jpg", 6, 20, 40}, //exif little endian, rotation de 90°
+	{"metadonnees_orientation3.jpg", 3, 40, 20}, //exif big endian, rotation de 180°
+}
+
+// textes des metadonnees qui ne doivent plus apparaitre dans l'image nettoyée
+var TRACES_METADONNEES = []string{"Exif", "SN-4815162342", "Camera Test", "xmpmeta", "Photoshop 3.0", "Jean Photographe", "Paris"}
+
+func lectureTestdata(t *testing.T, fichier string) []byte {
+	t.Helper()
+	img_bytes, err := os.ReadFile(filepath.Join("testdata", fichier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img_bytes
+}
+
+func TestNettoyageMetadonnees(t *testing.T) {
+	for _, c := range IMAGES_METADONNEES {
+		t.Run(c.fichier, func(t *testing.T) {
+			img_bytes := lectureTestdata(t, c.fichier)
+			propre, meta, err := NettoyageMetadonnees(img_bytes, METADONNEES_CONSERVEES)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.Orientation != c.orientation {
+				t.Errorf("orientation %d, attendu %d", meta.Orientation, c.orientation)
+			}
+			for _, nom := range []string{"exif", "xmp", "iptc", "comment"} {
+				if !slices.Contains(meta.Retirees, nom) {
+					t.Errorf("%s absent des metadonnees retirées %v", nom, meta.Retirees)
+				}
+			}
+			for _, trace := range TRACES_METADONNEES {
+				if !bytes.Contains(img_bytes, []byte(trace)) {
+					t.Fatalf("%q absent de l'image de test", trace)
+				}
+				if bytes.Contains(propre, []byte(trace)) {
+					t.Errorf("%q encore present apres nettoyage", trace)
+				}
+			}
+			config, err := jpeg.DecodeConfig(bytes.NewReader(propre)) //les pixels ne sont pas touchés
+			if err != nil {
+				t.Fatalf("jpeg nettoyé illisible: %v", err)
+			}
+			if config.Width != 40 || config.Height != 20 {
+				t.Errorf("jpeg nettoyé de %dx%d, attendu 40x20", config.Width, config.Height)
+			}
+		})
+	}
+}
+
+func TestNettoyageMetadonneesConservees(t *testing.T) {
+	img_bytes := lectureTestdata(t, "metadonnees_orientation6.jpg")
+	propre, meta, err := NettoyageMetadonnees(img_bytes, map[string]bool{"exif": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(propre, []byte("SN-4815162342")) {
+		t.Error("l'exif conservé a été retiré")
+	}
+	if slices.Contains(meta.Retirees, "exif") || !slices.Contains(meta.Retirees, "xmp") {
+		t.Errorf("metadonnees retirées %v", meta.Retirees)
+	}
+}
+
+func TestNettoyageMetadonneesTronque(t *testing.T) {
+	img_bytes := lectureTestdata(t, "metadonnees_orientation6.jpg")
+	if _, _, err := NettoyageMetadonnees(img_bytes[:40], METADONNEES_CONSERVEES); err == nil {
+		t.Error("un jpeg tronqué dans ses segments doit etre refusé")
+	}
+}
+
+func TestDecoderSansMetadonnees(t *testing.T) {
+	for _, c := range IMAGES_METADONNEES {
+		t.Run(c.fichier, func(t *testing.T) {
+			img, meta, err := DecoderSansMetadonnees(lectureTestdata(t, c.fichier), gocv.IMReadColor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer img.Close()
+			if meta.Orientation != c.orientation {
+				t.Errorf("orientation %d, attendu %d", meta.Orientation, c.orientation)
+			}
+			if img.Cols() != c.largeur || img.Rows() != c.hauteur {
+				t.Fatalf("image de %dx%d, attendu %dx%d", img.Cols(), img.Rows(), c.largeur, c.hauteur)
+			}
+
+			//la moitié noire de l'image d'origine (a gauche) passe en haut pour 6 et a droite pour 3
+			sombre, claire := img.GetUCharAt(2, 3*2), img.GetUCharAt(img.Rows()-3, 3*(img.Cols()-3))
+			if c.orientation == 3 {
+				sombre, claire = claire, sombre
+			}
+			if sombre > 64 || claire < 192 {
+				t.Errorf("orientation mal appliquée, pixels %d et %d", sombre, claire)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// outils communs aux tests : detecteurs chargés depuis testdata et images synthetiques
+// seul le detecteur par defaut est dans testdata, les autres sont signalés absents au chargement
+
+const DOSSIER_CASCADES_TEST = "testdata"
+
+// remplace la configuration le temps du test, comme un rechargement a chaud
+func configTest(t *testing.T, modifier func(c *Configuration)) {
+	t.Helper()
+	ancienne := configuration.Load()
+	c := *ConfigActuelle()
+	modifier(&c)
+	configuration.Store(&c)
+	t.Cleanup(func() { configuration.Store(ancienne) })
+}
+
+func detecteursTest(t *testing.T) Detecteurs {
+	t.Helper()
+	detecteurs, err := ChargerDetecteurs(DOSSIER_CASCADES_TEST)
+	if err != nil {
+		t.Fatalf("chargement des detecteurs de test: %v", err)
+	}
+	t.Cleanup(detecteurs.Close)
+	return detecteurs
+}
+
+// degradé de couleurs : la pixelisation et le flou le modifient, contrairement a une image unie
+func degradeTest(largeur, hauteur int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, largeur, hauteur))
+	for y := 0; y < hauteur; y++ {
+		for x := 0; x < largeur; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x * 255 / largeur), G: uint8(y * 255 / hauteur), B: uint8((x + y) % 256), A: 255})
+		}
+	}
+	return img
+}
+
+func jpegTest(t *testing.T, largeur, hauteur int) []byte {
+	t.Helper()
+	var tampon bytes.Buffer
+	if err := jpeg.Encode(&tampon, degradeTest(largeur, hauteur), &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	return tampon.Bytes()
+}
+
+func pngTest(t *testing.T, largeur, hauteur int) []byte {
+	t.Helper()
+	var tampon bytes.Buffer
+	if err := png.Encode(&tampon, degradeTest(largeur, hauteur)); err != nil {
+		t.Fatal(err)
+	}
+	return tampon.Bytes()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+const DETECTEUR_PLAQUES = "plate" //nom du detecteur des plaques dans CASCADES, jamais utilisé pour les visages
+
+// detection et anonymisation des plaques d'immatriculation, une classe a part des visages
+// avec sa propre methode et ses propres parametres de DetectMultiScale
+type ParametresPlaques struct {
+	Active      bool                `json:"enabled"`
+	Methode     string              `json:"method"`     //METHODE_PIXEL, METHODE_FLOU ou METHODE_NOIR
+	TailleCarre int                 `json:"block_size"` //taille des carrés de la pixelisation ou du noyau du flou
+	Detection   ParametresDetection `json:"detection"`
+}
+
+// une plaque est petite et allongée, on la masque en noir plutot que de la pixeliser
+var PLAQUES_DEFAUT = ParametresPlaques{Methode: METHODE_NOIR, TailleCarre: 8, Detection: ParametresDetection{FacteurEchelle: 1.1, VoisinsMin: 3}}
+
+// verifie les reglages, meme si la detection est desactivée pour qu'elle puisse etre activée au rechargement
+func (p ParametresPlaques) Valider() error {
+	var erreurs []error
+	if err := p.Floutage().valider(); err != nil {
+		erreurs = append(erreurs, fmt.Errorf("plates: %w", err))
+	}
+	erreurs = append(erreurs, p.Detection.Valider("plates.detection")...)
+	return errors.Join(erreurs...)
+}
+
+// le detecteur des plaques n'est chargé que si sa cascade est presente
+func (p ParametresPlaques) ValiderDetecteurs(detecteurs Detecteurs) error {
+	if _, ok := detecteurs[DETECTEUR_PLAQUES]; p.Active && !ok {
+		return fmt.Errorf("plates: detecteur %q absent, verifier %s dans le dossier des cascades", DETECTEUR_PLAQUES, CASCADES[DETECTEUR_PLAQUES])
+	}
+	return nil
+}
+
+// parametres d'anonymisation des plaques, pour Anonymiser
+func (p ParametresPlaques) Floutage() ParametresFloutage {
+	return ParametresFloutage{Methode: p.Methode, TailleCarre: p.TailleCarre, Detecteur: DETECTEUR_PLAQUES}
+}
+
+// detection des plaques, aucune si elle est desactivée
+func DetecterPlaques(img gocv.Mat, detecteurs Detecteurs, params ParametresPlaques) ([]image.Rectangle, error) {
+	if !params.Active {
+		return nil, nil
+	}
+	detecteur, ok := detecteurs[DETECTEUR_PLAQUES]
+	if !ok {
+		return nil, fmt.Errorf("detecteur inconnu %q", DETECTEUR_PLAQUES)
+	}
+	rects := detecteur.Detecter(img, params.Detection)
+	plaquesParImage.Observer("", float64(len(rects)))
+	return rects, nil
+}
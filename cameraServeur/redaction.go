@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"log/slog"
+	"os"
+	"strings"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+// redaction reversible : avec une clé (redaction_key_file), les pixels d'origine de chaque region anonymisée
+// sont chiffrés en AES-256-GCM et gardés dans le sidecar de l'image ; la commande reveal les remet en place
+// sans la clé le sidecar ne permet pas de retrouver les visages
+
+const ALGORITHME_REDACTION = "AES-256-GCM"
+const TAILLE_CLE = 32 //AES-256
+
+var cleRedaction []byte //nil si la redaction reversible est desactivée
+
+// regions chiffrées d'une image, ajoutées au sidecar
+type Redaction struct {
+	Algorithme string           `json:"algorithm"`
+	IdCle      string           `json:"key_id"`       //debut de l'empreinte de la clé, pour verifier qu'on a la bonne
+	Largeur    int              `json:"image_width"`  //image d'origine, les regions sont dans ses coordonnées
+	Hauteur    int              `json:"image_height"` //l'image renvoyée peut etre reduite par le codec (max_width)
+	Regions    []RegionChiffree `json:"regions"`
+}
+
+// pixels d'origine d'un rectangle, encodés en png puis chiffrés ; nonce et donnees sont en base64 dans le json
+type RegionChiffree struct {
+	X       int    `json:"x"`
+	Y       int    `json:"y"`
+	Largeur int    `json:"width"`
+	Hauteur int    `json:"height"`
+	Nonce   []byte `json:"nonce"`
+	Donnees []byte `json:"ciphertext"`
+}
+
+func (region RegionChiffree) Rect() image.Rectangle {
+	return image.Rect(region.X, region.Y, region.X+region.Largeur, region.Y+region.Hauteur)
+}
+
+// le rectangle et la clé sont authentifiés avec les pixels : une region recopiée ailleurs ne se dechiffre pas
+func (region RegionChiffree) donneesAssociees(idCle string) []byte {
+	return []byte(fmt.Sprintf("%s|%d,%d,%d,%d", idCle, region.X, region.Y, region.Largeur, region.Hauteur))
+}
+
+// fichier de 32 octets, ou de 64 caracteres hexadecimaux (par exemple : openssl rand -hex 32)
+func ChargerCle(chemin string) ([]byte, error) {
+	contenu, err := os.ReadFile(chemin)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(chemin); err == nil && info.Mode().Perm()&0o077 != 0 {
+		slog.Warn("la clé est lisible par d'autres utilisateurs", "fichier", chemin, "droits", info.Mode().Perm().String())
+	}
+	if len(contenu) == TAILLE_CLE {
+		return contenu, nil
+	}
+	cle, err := hex.DecodeString(strings.TrimSpace(string(contenu)))
+	if err != nil || len(cle) != TAILLE_CLE {
+		return nil, fmt.Errorf("%s: %d octets ou %d caracteres hexadecimaux attendus", chemin, TAILLE_CLE, 2*TAILLE_CLE)
+	}
+	return cle, nil
+}
+
+func idCle(cle []byte) string {
+	return empreinte(cle)[:16]
+}
+
+func chiffreur(cle []byte) (cipher.AEAD, error) {
+	bloc, err := aes.NewCipher(cle)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(bloc)
+}
+
+// chiffre les pixels de img (l'image d'origine) dans chaque rectangle
+func ChiffrerRegions(cle []byte, img gocv.Mat, rects []image.Rectangle) (*Redaction, error) {
+	aead, err := chiffreur(cle)
+	if err != nil {
+		return nil, err
+	}
+	redaction := &Redaction{Algorithme: ALGORITHME_REDACTION, IdCle: idCle(cle), Largeur: img.Cols(), Hauteur: img.Rows()}
+	for _, rect := range rects {
+		rect = rect.Intersect(image.Rect(0, 0, img.Cols(), img.Rows()))
+		if rect.Empty() {
+			continue
+		}
+		region := img.Region(rect)
+		png, err := gocv.IMEncode(gocv.PNGFileExt, region) //sans perte
+		region.Close()
+		if err != nil {
+			return nil, fmt.Errorf("encodage de la region %v: %w", rect, err)
+		}
+		chiffree := RegionChiffree{X: rect.Min.X, Y: rect.Min.Y, Largeur: rect.Dx(), Hauteur: rect.Dy(), Nonce: make([]byte, aead.NonceSize())}
+		if _, err := rand.Read(chiffree.Nonce); err != nil {
+			png.Close()
+			return nil, err
+		}
+		chiffree.Donnees = aead.Seal(nil, chiffree.Nonce, png.GetBytes(), chiffree.donneesAssociees(redaction.IdCle))
+		png.Close()
+		redaction.Regions = append(redaction.Regions, chiffree)
+	}
+	return redaction, nil
+}
+
+// ajoute au sidecar les regions chiffrées si la redaction reversible est activée
+func (sidecar *Sidecar) Chiffrer(img gocv.Mat, rects []image.Rectangle) error {
+	if cleRedaction == nil {
+		return nil
+	}
+	redaction, err := ChiffrerRegions(cleRedaction, img, rects)
+	if err != nil {
+		return fmt.Errorf("redaction reversible: %w", err)
+	}
+	sidecar.Redaction = redaction
+	return nil
+}
+
+var ErrMauvaiseCle = errors.New("la clé ne correspond pas a celle du sidecar")
+
+// rectangle de la region dans une image de largeur x hauteur, l'image anonymisée a pu etre reduite par le codec
+// arrondi vers l'exterieur pour recouvrir les pixels de bord melangés par la reduction
+func (redaction *Redaction) rectDans(region RegionChiffree, largeur, hauteur int) image.Rectangle {
+	if redaction.Largeur == 0 || redaction.Hauteur == 0 || (redaction.Largeur == largeur && redaction.Hauteur == hauteur) {
+		return region.Rect() //meme taille, ou sidecar ecrit avant l'ajout des dimensions
+	}
+	rect := region.Rect()
+	return image.Rect(rect.Min.X*largeur/redaction.Largeur, rect.Min.Y*hauteur/redaction.Hauteur,
+		(rect.Max.X*largeur+redaction.Largeur-1)/redaction.Largeur, (rect.Max.Y*hauteur+redaction.Hauteur-1)/redaction.Hauteur)
+}
+
+// remet dans img (l'image anonymisée) les pixels d'origine de chaque region, mis a l'echelle si img a ete reduite
+func ReveleRegions(cle []byte, img *gocv.Mat, redaction *Redaction) error {
+	if redaction.Algorithme != ALGORITHME_REDACTION {
+		return fmt.Errorf("algorithme %q non supporté", redaction.Algorithme)
+	}
+	if redaction.IdCle != idCle(cle) {
+		return ErrMauvaiseCle
+	}
+	aead, err := chiffreur(cle)
+	if err != nil {
+		return err
+	}
+	bornes := image.Rect(0, 0, img.Cols(), img.Rows())
+	for i, chiffree := range redaction.Regions {
+		rect := redaction.rectDans(chiffree, img.Cols(), img.Rows())
+		if rect.Empty() || !rect.In(bornes) {
+			return fmt.Errorf("region %d %v hors de l'image %v", i, rect, bornes)
+		}
+		png, err := aead.Open(nil, chiffree.Nonce, chiffree.Donnees, chiffree.donneesAssociees(redaction.IdCle))
+		if err != nil {
+			return fmt.Errorf("region %d: dechiffrement impossible, sidecar modifié ou mauvaise clé", i)
+		}
+		origine, err := gocv.IMDecode(png, gocv.IMReadColor)
+		if err != nil || origine.Empty() || origine.Cols() != chiffree.Largeur || origine.Rows() != chiffree.Hauteur {
+			origine.Close()
+			return fmt.Errorf("region %d: pixels d'origine illisibles", i)
+		}
+		if rect.Size() != chiffree.Rect().Size() {
+			reduite := gocv.NewMat()
+			gocv.Resize(origine, &reduite, rect.Size(), 0, 0, gocv.InterpolationArea)
+			origine.Close()
+			origine = reduite
+		}
+		destination := img.Region(rect)
+		origine.CopyTo(&destination)
+		destination.Close()
+		origine.Close()
+	}
+	return nil
+}
+
+// redaction d'un sidecar d'image, ou de l'image numero (a partir de 0) d'un sidecar de segment de flux
+func LireRedaction(chemin string, numero int) (*Redaction, error) {
+	contenu, err := os.ReadFile(chemin)
+	if err != nil {
+		return nil, err
+	}
+	var lu struct {
+		Sidecar
+		Images []Sidecar `json:"frames"`
+	}
+	if err := json.Unmarshal(contenu, &lu); err != nil {
+		return nil, fmt.Errorf("%s: %w", chemin, err)
+	}
+	sidecar := lu.Sidecar
+	if lu.Images != nil {
+		if numero < 0 || numero >= len(lu.Images) {
+			return nil, fmt.Errorf("%s: segment de %d images, image %d demandée", chemin, len(lu.Images), numero)
+		}
+		sidecar = lu.Images[numero]
+	}
+	if sidecar.Redaction == nil {
+		return nil, fmt.Errorf("%s: pas de regions chiffrées, l'image a ete anonymisée sans clé de redaction", chemin)
+	}
+	return sidecar.Redaction, nil
+}
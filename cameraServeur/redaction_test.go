@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"testing"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+var CLE_REDACTION_TEST = bytes.Repeat([]byte{0x24}, TAILLE_CLE)
+
+func TestRedactionAllerRetour(t *testing.T) {
+	origine, err := gocv.ImageToMatRGB(degradeTest(320, 240))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origine.Close()
+	rect := image.Rect(16, 16, 112, 112) //x+y < 256 : le canal bleu du degradé ne repasse pas par 0 dans la region
+
+	cas := []struct {
+		nom        string
+		largeurMax int //max_width du codec, 0 sans reduction
+		tolerance  int //ecart permis par canal entre les pixels restaurés et l'origine a la meme echelle
+	}{
+		{"meme taille", 0, 0},
+		{"reduite de moitié", 160, 2},
+		{"reduite irregulierement", 250, 4},
+	}
+	for _, c := range cas {
+		t.Run(c.nom, func(t *testing.T) {
+			redaction, err := ChiffrerRegions(CLE_REDACTION_TEST, origine, []image.Rectangle{rect})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if redaction.Largeur != 320 || redaction.Hauteur != 240 {
+				t.Fatalf("dimensions d'origine %dx%d dans la redaction", redaction.Largeur, redaction.Hauteur)
+			}
+
+			//image anonymisée (rectangle noir) puis reduite comme par Codec.Encoder, et l'origine a la meme echelle
+			anonymisee, attendue := origine.Clone(), origine.Clone()
+			defer anonymisee.Close()
+			defer attendue.Close()
+			noir := anonymisee.Region(rect)
+			noir.SetTo(gocv.NewScalar(0, 0, 0, 0))
+			noir.Close()
+			if c.largeurMax > 0 {
+				taille := image.Pt(c.largeurMax, origine.Rows()*c.largeurMax/origine.Cols())
+				for _, img := range []*gocv.Mat{&anonymisee, &attendue} {
+					reduite := gocv.NewMat()
+					gocv.Resize(*img, &reduite, taille, 0, 0, gocv.InterpolationArea)
+					img.Close()
+					*img = reduite
+				}
+			}
+
+			if err := ReveleRegions(CLE_REDACTION_TEST, &anonymisee, redaction); err != nil {
+				t.Fatal(err)
+			}
+			//interieur de la region a l'echelle de l'image, loin des bords melangés par la reduction
+			echelle := redaction.rectDans(redaction.Regions[0], anonymisee.Cols(), anonymisee.Rows()).Inset(2)
+			for y := echelle.Min.Y; y < echelle.Max.Y; y++ {
+				for x := echelle.Min.X; x < echelle.Max.X; x++ {
+					for canal := 0; canal < 3; canal++ {
+						ecart := int(anonymisee.GetUCharAt(y, 3*x+canal)) - int(attendue.GetUCharAt(y, 3*x+canal))
+						if ecart > c.tolerance || -ecart > c.tolerance {
+							t.Fatalf("pixel %d,%d canal %d restauré a %d de l'origine", x, y, canal, ecart)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRedactionMauvaiseCle(t *testing.T) {
+	origine, err := gocv.ImageToMatRGB(degradeTest(64, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origine.Close()
+	redaction, err := ChiffrerRegions(CLE_REDACTION_TEST, origine, []image.Rectangle{image.Rect(8, 8, 40, 40)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ReveleRegions(bytes.Repeat([]byte{0x25}, TAILLE_CLE), &origine, redaction); err != ErrMauvaiseCle {
+		t.Errorf("erreur %v, attendu %v", err, ErrMauvaiseCle)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+const FILE_DETECTION_MAX = 8 //au dela de ce nombre de detections en cours ou en attente sur un detecteur, le serveur est saturé
+
+// etat du serveur pour /healthz et /readyz
+// le serveur est pret quand l'auto test est passé, que la socket ecoute et qu'aucun detecteur n'est saturé
+type Sante struct {
+	detecteurs Detecteurs
+	adresse    string //adresse de la socket d'écoute
+	mu         sync.Mutex
+	autoTest   error //ErrAutoTestEnCours tant qu'il n'est pas terminé
+	dureeTest  time.Duration
+	ecoute     bool
+}
+
+var ErrAutoTestEnCours = errors.New("auto test en cours")
+
+func NouvelleSante(detecteurs Detecteurs, adresse string) *Sante {
+	return &Sante{detecteurs: detecteurs, adresse: adresse, autoTest: ErrAutoTestEnCours}
+}
+
+func (sante *Sante) ResultatAutoTest(err error, duree time.Duration) {
+	sante.mu.Lock()
+	defer sante.mu.Unlock()
+	sante.autoTest, sante.dureeTest = err, duree
+}
+
+func (sante *Sante) Ecoute(ecoute bool) {
+	sante.mu.Lock()
+	defer sante.mu.Unlock()
+	sante.ecoute = ecoute
+}
+
+type EtatDetecteur struct {
+	Charge  bool   `json:"loaded"`
+	Fichier string `json:"file"`
+	EnCours int32  `json:"in_progress"` //detections en cours ou en attente du detecteur
+	Sature  bool   `json:"saturated"`
+}
+
+type EtatAutoTest struct {
+	Statut string  `json:"status"` //ok, running ou failed
+	Duree  float64 `json:"duration_seconds"`
+	Erreur string  `json:"error,omitempty"`
+}
+
+type EtatEcoute struct {
+	Adresse string `json:"address"`
+	Ecoute  bool   `json:"listening"`
+}
+
+// reponse json de /healthz et /readyz
+type RapportSante struct {
+	Pret       bool                     `json:"ready"`
+	Detecteurs map[string]EtatDetecteur `json:"detectors"`
+	AutoTest   EtatAutoTest             `json:"self_test"`
+	Ecoute     EtatEcoute               `json:"listener"`
+	Connexions int                      `json:"active_connections"`
+	OpenCV     string                   `json:"opencv_version"`
+	Anomalies  []string                 `json:"problems"`
+}
+
+func (sante *Sante) Rapport() RapportSante {
+	sante.mu.Lock()
+	defer sante.mu.Unlock()
+
+	rapport := RapportSante{
+		Detecteurs: map[string]EtatDetecteur{},
+		Ecoute:     EtatEcoute{Adresse: sante.adresse, Ecoute: sante.ecoute},
+		Connexions: int(connexionsActives.Valeur("")),
+		OpenCV:     gocv.OpenCVVersion(),
+		Anomalies:  []string{},
+	}
+
+	for nom, fichier := range CASCADES { //les detecteurs absents sont signalés sans rendre le serveur indisponible
+		etat := EtatDetecteur{Fichier: fichier}
+		if d, ok := sante.detecteurs[nom]; ok {
+			etat.Charge = true
+			etat.EnCours = d.enCours.Load()
+			etat.Sature = etat.EnCours > FILE_DETECTION_MAX
+			if etat.Sature {
+				rapport.Anomalies = append(rapport.Anomalies, fmt.Sprintf("detecteur %s saturé (%d en cours)", nom, etat.EnCours))
+			}
+		} else if nom == DETECTEUR_DEFAUT {
+			rapport.Anomalies = append(rapport.Anomalies, "detecteur par defaut non chargé")
+		}
+		rapport.Detecteurs[nom] = etat
+	}
+
+	switch {
+	case sante.autoTest == nil:
+		rapport.AutoTest = EtatAutoTest{Statut: "ok", Duree: sante.dureeTest.Seconds()}
+	case errors.Is(sante.autoTest, ErrAutoTestEnCours):
+		rapport.AutoTest = EtatAutoTest{Statut: "running"}
+		rapport.Anomalies = append(rapport.Anomalies, "auto test en cours")
+	default:
+		rapport.AutoTest = EtatAutoTest{Statut: "failed", Duree: sante.dureeTest.Seconds(), Erreur: sante.autoTest.Error()}
+		rapport.Anomalies = append(rapport.Anomalies, "auto test echoué")
+	}
+
+	if !sante.ecoute {
+		rapport.Anomalies = append(rapport.Anomalies, "la socket n'ecoute pas")
+	}
+
+	rapport.Pret = len(rapport.Anomalies) == 0
+	return rapport
+}
+
+// GET /healthz, le processus repond : toujours 200, le rapport donne le detail
+func (sante *Sante) Vivant(w http.ResponseWriter, r *http.Request) {
+	ecrireRapport(w, sante.Rapport(), http.StatusOK)
+}
+
+// GET /readyz, 200 si le serveur peut accepter des clients, 503 sinon
+func (sante *Sante) Pret(w http.ResponseWriter, r *http.Request) {
+	rapport := sante.Rapport()
+	statut := http.StatusOK
+	if !rapport.Pret {
+		statut = http.StatusServiceUnavailable
+	}
+	ecrireRapport(w, rapport, statut)
+}
+
+func ecrireRapport(w http.ResponseWriter, rapport RapportSante, statut int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statut)
+	json.NewEncoder(w).Encode(rapport)
+}
+
+// image synthetique embarquée dans le binaire : un damier noir et blanc de carrés de 4 pixels
+// le damier n'a pas de visage mais chaque methode d'anonymisation le transforme de facon verifiable
+func imageAutoTest() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 320, 240))
+	for y := 0; y < 240; y++ {
+		for x := 0; x < 320; x++ {
+			if (x/4+y/4)%2 == 0 {
+				img.Set(x, y, color.White)
+			} else {
+				img.Set(x, y, color.Black)
+			}
+		}
+	}
+	return img
+}
+
+// image synthetique encodée en png, comme l'enverrait un client
+func pngAutoTest() ([]byte, error) {
+	var png_bytes bytes.Buffer
+	if err := png.Encode(&png_bytes, imageAutoTest()); err != nil {
+		return nil, fmt.Errorf("encodage de l'image synthetique: %w", err)
+	}
+	return png_bytes.Bytes(), nil
+}
+
+// verifie toute la chaine avant d'accepter des clients :
+// decodage, detection et reencodage de l'image synthetique comme pour un client,
+// puis anonymisation d'un rectangle connu avec chaque methode
+func AutoTest(detecteurs Detecteurs) error {
+	synthetique := imageAutoTest()
+	png_bytes, err := pngAutoTest()
+	if err != nil {
+		return err
+	}
+
+	reponse, _, err := traitementImage(png_bytes, detecteurs, CODEC_DEFAUT)
+	if err != nil {
+		return fmt.Errorf("traitement de l'image synthetique: %w", err)
+	}
+	img_reponse, err := Decoder(reponse, gocv.IMReadColor)
+	if err != nil {
+		return fmt.Errorf("decodage de l'image traitée: %w", err)
+	}
+	dimensions := image.Pt(img_reponse.Cols(), img_reponse.Rows())
+	img_reponse.Close()
+	if dimensions != synthetique.Bounds().Size() {
+		return fmt.Errorf("image traitée de %v au lieu de %v", dimensions, synthetique.Bounds().Size())
+	}
+
+	img, err := NewMatRGB8FromImage(synthetique)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	rect := image.Rect(96, 64, 224, 176)               //aligné sur les carrés de la pixelisation
+	dedans, dehors := image.Pt(98, 66), image.Pt(2, 2) //deux pixels blancs du damier
+	for _, methode := range []string{METHODE_PIXEL, METHODE_FLOU, METHODE_NOIR} {
+		params := PARAMETRES_DEFAUT //le damier et les pixels testés sont prevus pour ses carrés, la configuration peut en avoir de plus petits
+		params.Methode = methode
+		anonymisee, err := Anonymiser(img, []image.Rectangle{rect}, params)
+		if err != nil {
+			return fmt.Errorf("methode %s: %w", methode, err)
+		}
+		blancDedans, blancDehors := estBlanc(anonymisee, dedans), estBlanc(anonymisee, dehors)
+		anonymisee.Close()
+		if blancDedans {
+			return fmt.Errorf("methode %s: le rectangle n'a pas ete anonymisé", methode)
+		}
+		if !blancDehors {
+			return fmt.Errorf("methode %s: l'image a ete modifiée hors du rectangle", methode)
+		}
+	}
+	return nil
+}
+
+func estBlanc(img gocv.Mat, p image.Point) bool {
+	for _, canal := range img.GetVecbAt(p.Y, p.X)[:3] {
+		if canal < 200 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// l'auto test ne depend pas des reglages de floutage : toute configuration acceptée par Valider doit demarrer
+func TestAutoTestTailleCarre(t *testing.T) {
+	detecteurs := detecteursTest(t)
+	for _, taille := range []int{2, 4, 16} {
+		for _, methode := range []string{METHODE_PIXEL, METHODE_FLOU, METHODE_NOIR} {
+			t.Run(methode+" "+strconv.Itoa(taille), func(t *testing.T) {
+				configTest(t, func(c *Configuration) {
+					c.Floutage.TailleCarre = taille
+					c.Floutage.Methode = methode
+				})
+				if err := ConfigActuelle().ValiderDetecteurs(detecteurs); err != nil {
+					t.Fatalf("configuration de test refusée: %v", err)
+				}
+				if err := AutoTest(detecteurs); err != nil {
+					t.Errorf("auto test echoué: %v", err)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const COMMANDE_FLUX = "FLUX" //ouvre une session ou le client envoie des images en continu
+
+// image recue dans une session de flux, seq est le numero donné par le client
+type imageFlux struct {
+	seq   string
+	bytes []byte
+}
+
+// session de floutage en continu : le client envoie pour chaque image son numero puis l'image,
+// on lui renvoie le meme numero puis l'image floutée, ou une image vide si elle a ete abandonnée.
+// si le serveur prend du retard on ne garde que la derniere image recue, les plus anciennes sont abandonnées.
+// la session se termine quand le client envoie FIN_CONNEXION a la place du numero ou se deconnecte.
+func sessionFlux(ctx context.Context, connection net.Conn, detecteurs Detecteurs, codec Codec, source string, logger *slog.Logger) error {
+	adresse := connection.RemoteAddr().String()
+	logger.Info("debut de session de flux", "source", source)
+	audit.Ecrire("debut_flux", adresse, map[string]interface{}{"source": source})
+
+	attente := make(chan imageFlux, 1)  //derniere image recue, pas encore traitée
+	reponses := make(chan imageFlux, 4) //reponses a envoyer dans l'ordre ou elles sont pretes
+	var errLecture error
+	abandonnees := 0 //images remplacées par une plus recente avant d'etre traitées
+
+	//lecture des images
+	go func() {
+		defer close(attente)
+		for {
+			connection.SetReadDeadline(time.Now().Add(ConfigActuelle().DelaiInactivite.Duration()))
+			if ctx.Err() != nil {
+				errLecture = ctx.Err()
+				return
+			}
+			seq, err := LectureEntete(connection)
+			if err == nil && seq == FIN_CONNEXION { //fin normale, aucune image ne suit
+				err = ErrFinConnexion
+			}
+			var img_bytes []byte
+			if err == nil {
+				img_bytes, err = ReceptionImage(connection)
+				if err == ErrFinConnexion { //FIN a la place de la taille n'est pas une fin normale
+					err = fmt.Errorf("image %s: %w", seq, err)
+				}
+			}
+			if err != nil {
+				errLecture = err
+				return
+			}
+
+			img := imageFlux{seq: seq, bytes: img_bytes}
+			for envoyee := false; !envoyee; { //on remplace l'image en attente si elle n'a pas encore ete prise
+				select {
+				case attente <- img:
+					envoyee = true
+				default:
+					select {
+					case ancienne := <-attente:
+						reponses <- imageFlux{seq: ancienne.seq} //image abandonnée
+						abandonnees++
+						audit.Ecrire("image_flux", adresse, map[string]interface{}{"seq": ancienne.seq, "abandonnee": true})
+					default:
+					}
+				}
+			}
+		}
+	}()
+
+	//envoi des reponses
+	var ecriture sync.WaitGroup
+	ecriture.Add(1)
+	go func() {
+		defer ecriture.Done()
+		enErreur := false
+		for reponse := range reponses {
+			if enErreur {
+				continue //on vide le canal pour ne pas bloquer la lecture et le traitement
+			}
+			_, err := connection.Write([]byte(fillString(reponse.seq, 10)))
+			if err == nil {
+				err = EnvoiImage(reponse.bytes, connection)
+			}
+			if err != nil {
+				logger.Error("erreur d'envoi dans la session de flux", "erreur", err)
+				erreurs.Ajouter("envoi", 1)
+				enErreur = true
+				connection.Close() //debloque la lecture
+			}
+		}
+	}()
+
+	//traitement des images, une a la fois
+	traitees, enErreur := 0, 0
+	segment := sidecars.NouveauSegment(source) //les sidecars du flux sont regroupés par segments
+	for img := range attente {
+		debut := time.Now()
+		img_blured_bytes, sidecar, err := traitementImage(img.bytes, detecteurs, codec)
+		details := map[string]interface{}{"seq": img.seq, "taille_requete": len(img.bytes), "taille_reponse": len(img_blured_bytes)}
+		if err != nil {
+			details["erreur"] = err.Error()
+		} else {
+			details["visages"] = len(sidecar.Visages)
+		}
+		audit.Ecrire("image_flux", adresse, details)
+		if err != nil {
+			logger.Error("erreur de traitement de l'image", "seq", img.seq, "erreur", err)
+			erreurs.Ajouter("traitement", 1)
+			enErreur++
+		} else {
+			logger.Debug("image du flux floutée", "seq", img.seq, "visages", len(sidecar.Visages), "duree", time.Since(debut))
+			traitees++
+			imagesTraitees.Ajouter(source, 1)
+			sidecar.Source = source
+			if err := segment.Ajouter(sidecar); err != nil {
+				logger.Error("erreur d'ecriture du sidecar", "erreur", err)
+				erreurs.Ajouter("sidecar", 1)
+			}
+		}
+		reponses <- imageFlux{seq: img.seq, bytes: img_blured_bytes}
+	}
+	close(reponses)
+	ecriture.Wait()
+	if err := segment.Fermer(); err != nil {
+		logger.Error("erreur d'ecriture du sidecar", "erreur", err)
+	}
+
+	logger.Info("fin de session de flux", "traitees", traitees, "abandonnees", abandonnees, "en_erreur", enErreur)
+	audit.Ecrire("fin_flux", adresse, map[string]interface{}{"traitees": traitees, "abandonnees": abandonnees, "en_erreur": enErreur})
+	return errLecture
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// une session qui recoit N images puis FIN renvoie N reponses et se termine sans attendre le delai d'inactivité
+func TestSessionFluxFinPropre(t *testing.T) {
+	detecteurs := detecteursTest(t)
+	ecoute, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ecoute.Close()
+
+	fin := make(chan error, 1)
+	go func() {
+		connection, err := ecoute.Accept()
+		if err != nil {
+			fin <- err
+			return
+		}
+		defer connection.Close() //comme la boucle de la connexion apres la session
+		fin <- sessionFlux(context.Background(), connection, detecteurs, CODEC_DEFAUT, "test", slog.Default())
+	}()
+
+	client, err := net.Dial("tcp", ecoute.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	const N = 5
+	img_bytes := jpegTest(t, 64, 48)
+	for seq := 1; seq <= N; seq++ {
+		if _, err := client.Write([]byte(fillString(strconv.Itoa(seq), 10))); err != nil {
+			t.Fatal(err)
+		}
+		if err := EnvoiImage(img_bytes, client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := client.Write([]byte(fillString(FIN_CONNEXION, 10))); err != nil {
+		t.Fatal(err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(10 * time.Second)) //bien avant le delai d'inactivité du serveur
+	recues := map[string]bool{}
+	for i := 0; i < N; i++ {
+		seq, err := LectureEntete(client)
+		if err != nil {
+			t.Fatalf("reponse %d: %v", i+1, err)
+		}
+		taille, err := LectureEntete(client)
+		if err == nil && taille != "0" { //0 pour une image abandonnée
+			_, err = ReceptionCorps(client, taille)
+		}
+		if err != nil {
+			t.Fatalf("image de la reponse %s: %v", seq, err)
+		}
+		recues[seq] = true
+	}
+	for seq := 1; seq <= N; seq++ {
+		if !recues[strconv.Itoa(seq)] {
+			t.Errorf("pas de reponse pour l'image %d", seq)
+		}
+	}
+
+	if _, err := LectureEntete(client); !errors.Is(err, io.EOF) {
+		t.Errorf("le serveur devait fermer la connexion apres les reponses, lecture: %v", err)
+	}
+	if err := <-fin; !errors.Is(err, ErrFinConnexion) {
+		t.Errorf("fin de session %v, attendu %v", err, ErrFinConnexion)
+	}
+}
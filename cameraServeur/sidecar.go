@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv" //librairie gocv
+)
+
+const COMMANDE_SOURCE = "SOURCE" //le client donne le nom de sa camera, repris dans les sidecars
+const IMAGES_PAR_SEGMENT = 100   //nombre d'images d'une session de flux regroupées dans un meme sidecar
+
+// trace de l'anonymisation d'une image, pour prouver que chaque image publiée a ete traitée
+type Sidecar struct {
+	Source         string     `json:"source"`
+	Horodatage     time.Time  `json:"timestamp"`
+	Detecteur      string     `json:"detector"`
+	Modele         string     `json:"detector_model"`
+	VersionOpenCV  string     `json:"opencv_version"`
+	VersionGocv    string     `json:"gocv_version"`
+	Methode        string     `json:"method"`
+	TailleCarre    int        `json:"block_size"`
+	Largeur        int        `json:"image_width"`
+	Hauteur        int        `json:"image_height"`
+	Visages        []Boite    `json:"faces"`
+	MethodePlaques string     `json:"plate_method,omitempty"` //vide si les plaques sont desactivées
+	Plaques        []Boite    `json:"plates,omitempty"`
+	Sha256Entree   string     `json:"input_sha256"`
+	Sha256Sortie   string     `json:"output_sha256"`
+	Redaction      *Redaction `json:"redaction,omitempty"` //regions d'origine chiffrées, si la redaction reversible est activée
+}
+
+// sidecar d'un segment de flux : les images consecutives d'une meme session
+type SidecarSegment struct {
+	Source string    `json:"source"`
+	Debut  time.Time `json:"start"`
+	Fin    time.Time `json:"end"`
+	Images []Sidecar `json:"frames"`
+}
+
+func NouveauSidecar(detecteurs Detecteurs, params ParametresFloutage, plaques ParametresPlaques, img gocv.Mat, regions Regions, entree, sortie []byte) Sidecar {
+	sidecar := Sidecar{
+		Horodatage:    time.Now().UTC(),
+		Detecteur:     params.Detecteur,
+		VersionOpenCV: gocv.OpenCVVersion(),
+		VersionGocv:   gocv.Version(),
+		Methode:       params.Methode,
+		TailleCarre:   params.TailleCarre,
+		Largeur:       img.Cols(),
+		Hauteur:       img.Rows(),
+		Visages:       boites(regions.Visages),
+		Plaques:       boites(regions.Plaques),
+		Sha256Entree:  empreinte(entree),
+		Sha256Sortie:  empreinte(sortie),
+	}
+	if detecteur, ok := detecteurs[params.Detecteur]; ok {
+		sidecar.Modele = detecteur.Fichier
+	}
+	if plaques.Active {
+		sidecar.MethodePlaques = plaques.Methode
+	}
+	return sidecar
+}
+
+func empreinte(donnees []byte) string {
+	somme := sha256.Sum256(donnees)
+	return hex.EncodeToString(somme[:])
+}
+
+// ecrit les sidecars en json dans un dossier, un fichier par image ou par segment de flux
+type JournalSidecars struct {
+	dossier  string
+	mu       sync.Mutex
+	compteur int
+}
+
+var sidecars *JournalSidecars //nil si les sidecars sont desactivés
+
+func NouveauJournalSidecars(dossier string) (*JournalSidecars, error) {
+	if err := os.MkdirAll(dossier, 0o750); err != nil {
+		return nil, err
+	}
+	return &JournalSidecars{dossier: dossier}, nil
+}
+
+// ecrit v dans un nouveau fichier, ne fait rien si les sidecars sont desactivés
+func (journal *JournalSidecars) Ecrire(v interface{}) error {
+	if journal == nil {
+		return nil
+	}
+	contenu, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	journal.mu.Lock()
+	journal.compteur++
+	nom := fmt.Sprintf("%s_%06d.json", time.Now().UTC().Format("20060102T150405.000"), journal.compteur)
+	journal.mu.Unlock()
+
+	//on ecrit dans un fichier temporaire puis on le renomme pour ne jamais laisser un sidecar incomplet
+	chemin := filepath.Join(journal.dossier, nom)
+	if err := os.WriteFile(chemin+".tmp", contenu, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(chemin+".tmp", chemin)
+}
+
+// regroupe les sidecars d'une session de flux, ecrit tous les IMAGES_PAR_SEGMENT images et a la fin
+type Segment struct {
+	journal *JournalSidecars
+	courant SidecarSegment
+}
+
+func (journal *JournalSidecars) NouveauSegment(source string) *Segment {
+	return &Segment{journal: journal, courant: SidecarSegment{Source: source}}
+}
+
+func (segment *Segment) Ajouter(sidecar Sidecar) error {
+	if segment.journal == nil {
+		return nil
+	}
+	if len(segment.courant.Images) == 0 {
+		segment.courant.Debut = sidecar.Horodatage
+	}
+	segment.courant.Fin = sidecar.Horodatage
+	segment.courant.Images = append(segment.courant.Images, sidecar)
+	if len(segment.courant.Images) >= IMAGES_PAR_SEGMENT {
+		return segment.Fermer()
+	}
+	return nil
+}
+
+// ecrit les images en attente
+func (segment *Segment) Fermer() error {
+	if segment.journal == nil || len(segment.courant.Images) == 0 {
+		return nil
+	}
+	err := segment.journal.Ecrire(segment.courant)
+	segment.courant.Images = nil
+	return err
+}